@@ -21,6 +21,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,10 +37,14 @@ import (
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/config"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/metricspipeline"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/nozzle"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/otlp"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/prometheus"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/spool"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/stackdriver"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/version"
 	"github.com/cloudfoundry/sonde-go/events"
+	"google.golang.org/grpc"
 )
 
 type App struct {
@@ -43,11 +53,14 @@ type App struct {
 	cfConfig    *cfclient.Config
 	cfClient    *cfclient.Client
 	rlpConfig   *cloudfoundry.ReverseLogProxyConfig
+	otlpConn    *grpc.ClientConn
+	dryRun      *stackdriver.DryRunAdapter
 	labelMaker  nozzle.LabelMaker
+	appControls *nozzle.AppControls
 	bufferEmpty func() bool
 }
 
-func New(c *config.Config, logger lager.Logger) *App {
+func New(ctx context.Context, c *config.Config, logger lager.Logger) *App {
 	logger.Info("version", lager.Data{"name": version.Name, "release": version.Release(), "user_agent": version.UserAgent()})
 	logger.Info("arguments", c.ToData())
 
@@ -61,13 +74,29 @@ func New(c *config.Config, logger lager.Logger) *App {
 		logger.Fatal("cfClient", err)
 	}
 
+	var metadataKeys []string
+	for _, key := range strings.Split(c.AppMetadataKeys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			metadataKeys = append(metadataKeys, key)
+		}
+	}
 	var appInfoRepository cloudfoundry.AppInfoRepository
 	if c.ResolveAppMetadata {
-		appInfoRepository = cloudfoundry.NewAppInfoRepository(cfClient)
+		ttl := time.Duration(c.AppMetadataTTL) * time.Second
+		negativeTTL := time.Duration(c.AppMetadataNegativeTTL) * time.Second
+		appInfoRepository = cloudfoundry.NewAppInfoRepository(ctx, cfClient, ttl, negativeTTL, len(metadataKeys) > 0 || c.AppMetadataControls, logger)
 	} else {
 		appInfoRepository = cloudfoundry.NullAppInfoRepository()
 	}
-	labelMaker := nozzle.NewLabelMaker(appInfoRepository, c.FoundationName)
+	metricAppLabels, err := nozzle.ParseAppLabelScheme(c.MetricAppLabels)
+	if err != nil {
+		logger.Fatal("metricAppLabels", err)
+	}
+	labelMaker := nozzle.NewLabelMaker(appInfoRepository, c.FoundationName, metricAppLabels, c.LogGUIDLabels, metadataKeys, c.AppMetadataMetricLabels)
+	var appControls *nozzle.AppControls
+	if c.AppMetadataControls {
+		appControls = nozzle.NewAppControls(appInfoRepository)
+	}
 
 	tlsConfig, err := loggregator.NewEgressTLSConfig(
 		c.RLPCACertFile,
@@ -85,13 +114,37 @@ func New(c *config.Config, logger lager.Logger) *App {
 		TLSConfig:         tlsConfig,
 	}
 
+	var dryRun *stackdriver.DryRunAdapter
+	if c.DryRun {
+		var out io.Writer = os.Stdout
+		if c.DryRunFile != "" {
+			out, err = os.OpenFile(c.DryRunFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				logger.Fatal("dryRunFile", err)
+			}
+		}
+		logger.Info("dryRun", lager.Data{"file": c.DryRunFile})
+		dryRun = stackdriver.NewDryRunAdapter(out, c.ProjectID, logger)
+	}
+
+	var otlpConn *grpc.ClientConn
+	if !c.DryRun && (c.MetricsBackend == "otlp" || c.LogsBackend == "otlp") {
+		otlpConn, err = otlp.Dial(c.OTLPEndpoint, c.OTLPInsecure)
+		if err != nil {
+			logger.Fatal("otlp", err)
+		}
+	}
+
 	return &App{
-		logger:     logger,
-		c:          c,
-		cfConfig:   cfConfig,
-		cfClient:   cfClient,
-		rlpConfig:  rlpConfig,
-		labelMaker: labelMaker,
+		logger:      logger,
+		c:           c,
+		cfConfig:    cfConfig,
+		cfClient:    cfClient,
+		rlpConfig:   rlpConfig,
+		otlpConn:    otlpConn,
+		dryRun:      dryRun,
+		labelMaker:  labelMaker,
+		appControls: appControls,
 	}
 }
 
@@ -116,20 +169,38 @@ func (a *App) newConsumer(ctx context.Context) (nozzle.Nozzle, error) {
 	}
 
 	var sinks []nozzle.Sink
-	logAdapter := a.newLogAdapter()
+	logAdapter := a.spoolLogs(ctx, a.newLogAdapter(ctx))
 	filteredLogSink, err := nozzle.NewFilterSink(logEvents, lbl, lwl,
-		nozzle.NewLogSink(a.labelMaker, logAdapter, a.c.NewlineToken, a.logger))
+		nozzle.NewLogSink(a.labelMaker, a.appControls, logAdapter, a.c.NewlineToken, a.logger))
 	if err != nil {
 		return nil, err
 	}
 	sinks = append(sinks, filteredLogSink)
 
 	// Destination for metrics
-	metricAdapter := a.newMetricAdapter()
+	metricAdapter := a.spoolMetrics(ctx, a.newMetricAdapter(ctx))
 	// Routes metrics to Stackdriver Logging/Stackdriver Monitoring
 	metricRouter := metricspipeline.NewRouter(metricAdapter, metricEvents, logAdapter, logEvents)
-	// Handles and translates Firehose events. Performs buffering/culling.
-	metricSink, err := a.newMetricSink(ctx, metricRouter)
+	// Optionally rolls up metrics across labels such as instanceIndex.
+	metricAggregator, err := a.newMetricAggregator(metricRouter)
+	if err != nil {
+		return nil, err
+	}
+	// Performs buffering/culling.
+	windowPolicies, err := a.newWindowPolicies()
+	if err != nil {
+		return nil, err
+	}
+	metricBuffer := metricspipeline.NewAutoCulledMetricsBuffer(ctx, a.logger, time.Duration(a.c.MetricsBufferDuration)*time.Second, windowPolicies, metricAggregator)
+	a.bufferEmpty = metricBuffer.IsEmpty
+	// Guards against runaway numbers of time series.
+	var metricLimiter stackdriver.MetricAdapter = metricBuffer
+	if a.c.MetricSeriesLimit > 0 || a.c.MetricSeriesLimitPerName > 0 {
+		ttl := time.Duration(a.c.MetricSeriesTTL) * time.Second
+		metricLimiter = metricspipeline.NewSeriesLimiter(a.logger, a.c.MetricSeriesLimit, a.c.MetricSeriesLimitPerName, ttl, a.c.MetricSeriesOverflow, metricBuffer)
+	}
+	// Handles and translates Firehose events.
+	metricSink, err := a.newMetricSink(ctx, metricLimiter)
 	if err != nil {
 		return nil, err
 	}
@@ -141,7 +212,8 @@ func (a *App) newConsumer(ctx context.Context) (nozzle.Nozzle, error) {
 	sinks = append(sinks, filteredMetricSink)
 
 	if a.c.EnableAppHTTPMetrics {
-		httpSink := nozzle.NewHTTPSink(a.logger, a.labelMaker)
+		ttl := time.Duration(a.c.CounterTrackerTTL) * time.Second
+		httpSink := nozzle.NewHTTPSink(ctx, a.logger, a.c.MetricPathPrefix, a.labelMaker, a.appControls, metricLimiter, ttl, a.instanceLabel())
 		filteredHTTPSink, err := nozzle.NewFilterSink([]events.Envelope_EventType{events.Envelope_HttpStartStop}, nil, nil, httpSink)
 		if err != nil {
 			return nil, err
@@ -152,9 +224,18 @@ func (a *App) newConsumer(ctx context.Context) (nozzle.Nozzle, error) {
 	return nozzle.NewNozzle(a.logger, sinks...), nil
 }
 
-func (a *App) newLogAdapter() stackdriver.LogAdapter {
+func (a *App) newLogAdapter(ctx context.Context) stackdriver.LogAdapter {
+	if a.dryRun != nil {
+		return a.dryRun
+	}
+	if a.c.LogsBackend == "otlp" {
+		batchDuration := time.Duration(a.c.LoggingBatchDuration) * time.Second
+		return otlp.NewLogAdapter(ctx, a.otlpConn, a.c.LoggingBatchCount, batchDuration, a.logger)
+	}
+
 	logAdapter, logErrs := stackdriver.NewLogAdapter(
 		a.c.ProjectID,
+		stackdriver.Endpoint{Address: a.c.LoggingEndpoint, Insecure: a.c.StackdriverInsecure},
 		a.c.LoggingBatchCount,
 		time.Duration(a.c.LoggingBatchDuration)*time.Second,
 		a.c.LoggingReqsInFlight,
@@ -167,40 +248,195 @@ func (a *App) newLogAdapter() stackdriver.LogAdapter {
 	return logAdapter
 }
 
-func (a *App) newMetricAdapter() stackdriver.MetricAdapter {
-	metricClient, err := stackdriver.NewMetricClient()
+func (a *App) newMetricAdapter(ctx context.Context) stackdriver.MetricAdapter {
+	if a.dryRun != nil {
+		return a.dryRun
+	}
+	switch a.c.MetricsBackend {
+	case "prometheus":
+		return a.newPrometheusAdapter(ctx)
+	case "otlp":
+		return otlp.NewMetricAdapter(a.otlpConn, a.c.MetricsBatchSize, a.logger)
+	}
+
+	metricClient, err := stackdriver.NewMetricClient(a.monitoringEndpoint(), time.Duration(a.c.MetricsRetryTimeout)*time.Second)
 	if err != nil {
 		a.logger.Fatal("metricClient", err)
 	}
 
-	metricAdapter, err := stackdriver.NewMetricAdapter(a.c.ProjectID, metricClient, a.c.MetricsBatchSize, a.logger)
-	if err != nil {
+	descriptors := stackdriver.NewDescriptorManager(a.c.ProjectID, metricClient, stackdriver.DescriptorPolicy(a.c.MetricDescriptorPolicy), a.logger)
+	if err := descriptors.Refresh(); err != nil {
 		a.logger.Fatal("metricAdapter", err)
 	}
+	descriptors.Start(ctx, time.Duration(a.c.MetricDescriptorRefresh)*time.Second)
+
+	return stackdriver.NewMetricAdapter(a.c.ProjectID, metricClient, descriptors, a.c.MetricsBatchSize, a.c.MetricsReqsInFlight,
+		time.Duration(a.c.MetricsMinPointInterval)*time.Second, a.c.MetricsRequestsPerSecond, a.logger)
+}
+
+// spoolLogs writes logs for Stackdriver Logging ahead to the spool, if enabled.
+func (a *App) spoolLogs(ctx context.Context, logAdapter stackdriver.LogAdapter) stackdriver.LogAdapter {
+	if a.c.SpoolDir == "" || a.dryRun != nil || a.c.LogsBackend != "stackdriver" {
+		return logAdapter
+	}
+	return spool.NewLogAdapter(ctx, a.openSpool("logs"), logAdapter, a.logger)
+}
+
+// spoolMetrics writes metrics for Stackdriver Monitoring ahead to the spool,
+// if enabled.
+func (a *App) spoolMetrics(ctx context.Context, metricAdapter stackdriver.MetricAdapter) stackdriver.MetricAdapter {
+	writer, ok := metricAdapter.(stackdriver.MetricWriter)
+	if a.c.SpoolDir == "" || !ok {
+		return metricAdapter
+	}
+	return spool.NewMetricAdapter(ctx, a.openSpool("metrics"), writer, a.logger)
+}
+
+func (a *App) openSpool(name string) *spool.Queue {
+	dir := filepath.Join(a.c.SpoolDir, name)
+	q, err := spool.Open(dir, int64(a.c.SpoolMaxSize)<<20, int64(a.c.SpoolSegmentSize)<<20)
+	if err != nil {
+		a.logger.Fatal("spool", err, lager.Data{"dir": dir})
+	}
+	records, bytes, oldest := q.Stats()
+	a.logger.Info("spool", lager.Data{"dir": dir, "records": records, "bytes": bytes, "oldest": oldest})
+	return q
+}
+
+func (a *App) monitoringEndpoint() stackdriver.Endpoint {
+	return stackdriver.Endpoint{Address: a.c.MonitoringEndpoint, Insecure: a.c.StackdriverInsecure}
+}
+
+func (a *App) newPrometheusAdapter(ctx context.Context) stackdriver.MetricAdapter {
+	ttl := time.Duration(a.c.PrometheusSeriesTTL) * time.Second
+	metricAdapter := prometheus.NewMetricAdapter(ctx, ttl, a.logger)
 
+	mux := http.NewServeMux()
+	mux.Handle(prometheus.MetricsPath, metricAdapter)
+	go func() {
+		a.logger.Error("prometheus", http.ListenAndServe(":"+strconv.Itoa(a.c.PrometheusPort), mux))
+	}()
 	return metricAdapter
 }
 
-func (a *App) newMetricSink(ctx context.Context, metricAdapter stackdriver.MetricAdapter) (nozzle.Sink, error) {
-	metricBuffer := metricspipeline.NewAutoCulledMetricsBuffer(ctx, a.logger, time.Duration(a.c.MetricsBufferDuration)*time.Second, metricAdapter)
-	a.bufferEmpty = metricBuffer.IsEmpty
+func (a *App) newMetricAggregator(metricAdapter stackdriver.MetricAdapter) (stackdriver.MetricAdapter, error) {
+	if a.c.MetricsPipelineJSON == nil || len(a.c.MetricsPipelineJSON.Aggregations) == 0 {
+		return metricAdapter, nil
+	}
+
+	var rules []*metricspipeline.AggregationRule
+	for _, r := range a.c.MetricsPipelineJSON.Aggregations {
+		rule, err := metricspipeline.NewAggregationRule(r.Regexp, r.Labels, r.Aggregation)
+		if err != nil {
+			return nil, fmt.Errorf("aggregation rule %s is invalid: %v", r, err)
+		}
+		rules = append(rules, rule)
+	}
+	return metricspipeline.NewAggregator(rules, metricAdapter), nil
+}
+
+func (a *App) newWindowPolicies() ([]*metricspipeline.WindowPolicy, error) {
+	if a.c.MetricsPipelineJSON == nil {
+		return nil, nil
+	}
 
+	var policies []*metricspipeline.WindowPolicy
+	for _, p := range a.c.MetricsPipelineJSON.WindowPolicies {
+		policy, err := metricspipeline.NewWindowPolicy(p.Regexp, p.Aggregation)
+		if err != nil {
+			return nil, fmt.Errorf("window policy %s is invalid: %v", p, err)
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+func (a *App) newMetricSink(ctx context.Context, metricBuffer stackdriver.MetricAdapter) (nozzle.Sink, error) {
 	var counterTracker *nozzle.CounterTracker
+	var counterSharding *nozzle.CounterSharding
 	if a.c.EnableCumulativeCounters {
 		ttl := time.Duration(a.c.CounterTrackerTTL) * time.Second
 		counterTracker = nozzle.NewCounterTracker(ctx, ttl, a.logger)
+		if a.c.DebugNozzle {
+			http.Handle(nozzle.CounterTrackerDebugPath, counterTracker)
+		}
+		if a.c.CounterTrackerSnapshotFile != "" {
+			period := time.Duration(a.c.CounterTrackerSnapshotPeriod) * time.Second
+			nozzle.PersistCounterTracker(ctx, counterTracker, a.c.CounterTrackerSnapshotFile, period, a.logger)
+		}
+		if a.c.EnableCounterSharding {
+			counterSharding = a.newCounterSharding(ctx)
+		}
+	}
+
+	var counterRates *nozzle.CounterRates
+	if a.c.CounterRateRegex != "" {
+		var err error
+		ttl := time.Duration(a.c.CounterTrackerTTL) * time.Second
+		counterRates, err = nozzle.NewCounterRates(ctx, a.c.CounterRateRegex, a.c.CounterRateReplace, ttl, a.logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var utilization *nozzle.ContainerUtilization
+	if a.c.EnableDerivedContainerMetrics {
+		utilization = nozzle.NewContainerUtilization(a.c.ContainerCPUEntitlementPerGiB)
+	}
+
+	return nozzle.NewMetricSink(a.logger, a.c.MetricPathPrefix, a.labelMaker, a.appControls, metricBuffer, counterTracker, counterSharding, counterRates, utilization, nozzle.NewUnitParser(), a.c.RuntimeMetricRegex, a.instanceLabel())
+}
+
+// instanceLabel is the value of the "nozzle" label that tells series written
+// by different nozzles apart, or empty if they are not labeled.
+func (a *App) instanceLabel() string {
+	if !a.c.MetricsInstanceLabel {
+		return ""
+	}
+	return a.c.NozzleInstance
+}
+
+func (a *App) newCounterSharding(ctx context.Context) *nozzle.CounterSharding {
+	port := strconv.Itoa(a.c.CounterShardingPort)
+	sharding := nozzle.NewCounterSharding(ctx, net.JoinHostPort(a.c.CounterShardingSelf, port), a.c.CounterShardingSecret, a.logger)
+	if a.c.CounterShardingPeersDNS != "" {
+		refresh := time.Duration(a.c.CounterShardingDNSRefresh) * time.Second
+		sharding.DiscoverPeersDNS(a.c.CounterShardingPeersDNS, a.c.CounterShardingPort, refresh)
+	} else {
+		var peers []string
+		for _, host := range strings.Split(a.c.CounterShardingPeers, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				peers = append(peers, net.JoinHostPort(host, port))
+			}
+		}
+		sharding.SetPeers(peers)
 	}
 
-	return nozzle.NewMetricSink(a.logger, a.c.MetricPathPrefix, a.labelMaker, metricBuffer, counterTracker, nozzle.NewUnitParser(), a.c.RuntimeMetricRegex)
+	mux := http.NewServeMux()
+	mux.Handle(nozzle.CounterShardingPath, sharding)
+	// Only listen on the address peers know this nozzle by.
+	go func() {
+		a.logger.Error("counterSharding", http.ListenAndServe(net.JoinHostPort(a.c.CounterShardingSelf, port), mux))
+	}()
+	return sharding
 }
 
 func (a *App) newTelemetryReporter() telemetry.Reporter {
-	metricClient, err := stackdriver.NewMetricClient()
+	logSink := telemetry.NewLogSink(a.logger)
+	if a.dryRun != nil {
+		// Nozzle telemetry is only logged, as it is not what the user is validating.
+		return telemetry.NewReporter(time.Duration(a.c.HeartbeatRate)*time.Second, logSink)
+	}
+	if a.c.MetricsBackend != "stackdriver" {
+		// Without Stackdriver Monitoring there may be no project or credentials to report to.
+		return telemetry.NewReporter(time.Duration(a.c.HeartbeatRate)*time.Second, logSink)
+	}
+
+	metricClient, err := stackdriver.NewMetricClient(a.monitoringEndpoint(), time.Duration(a.c.MetricsRetryTimeout)*time.Second)
 	if err != nil {
 		a.logger.Fatal("metricClient", err)
 	}
 
-	logSink := telemetry.NewLogSink(a.logger)
 	metricSink := stackdriver.NewTelemetrySink(a.logger, metricClient, a.c.ProjectID, a.c.SubscriptionID, a.c.FoundationName)
 	return telemetry.NewReporter(time.Duration(a.c.HeartbeatRate)*time.Second, logSink, metricSink)
 }
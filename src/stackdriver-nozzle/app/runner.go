@@ -35,7 +35,7 @@ func Run(ctx context.Context, a *App) {
 	ctx, cancel := context.WithCancel(ctx)
 
 	if a.c.DebugNozzle {
-		defer handleFatalError(a, cancel)
+		defer handleFatalError(ctx, a, cancel)
 
 		go func() {
 			a.logger.Info("debug", lager.Data{
@@ -86,7 +86,7 @@ func blockTillInterrupt() {
 	signal.Stop(c)
 }
 
-func handleFatalError(a *App, cancel context.CancelFunc) {
+func handleFatalError(ctx context.Context, a *App, cancel context.CancelFunc) {
 	if e := recover(); e != nil {
 		// Cancel the context
 		cancel()
@@ -110,8 +110,9 @@ func handleFatalError(a *App, cancel context.CancelFunc) {
 		}
 
 		// Purposefully get a new log adapter here since there
-		// were issues re-using the one that the nozzle uses.
-		logAdapter := a.newLogAdapter()
+		// were issues re-using the one that the nozzle uses. It is
+		// flushed explicitly, as ctx is already done.
+		logAdapter := a.newLogAdapter(ctx)
 		logAdapter.PostLog(log)
 		if err := logAdapter.Flush(); err != nil {
 			fmt.Printf("error flushing when handling fatal error: %v", err)
@@ -16,7 +16,57 @@
 
 package cloudfoundry
 
-import "github.com/cloudfoundry-community/go-cfclient"
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
+)
+
+const (
+	appLookupWorkers   = 4
+	appLookupQueueSize = 1024
+	// Cache entries not requested for appIdleTTLs times the ttl are evicted.
+	appIdleTTLs = 3
+)
+
+var (
+	appCacheResults *telemetry.CounterMap
+
+	appCacheHits     *telemetry.Counter
+	appCacheMisses   *telemetry.Counter
+	appCacheStale    *telemetry.Counter
+	appCacheNegative *telemetry.Counter
+
+	appLookups        *telemetry.Counter
+	appLookupErrs     *telemetry.Counter
+	appLookupsDropped *telemetry.Counter
+	appLookupLatency  *telemetry.Counter
+	appCacheWarmed    *telemetry.Counter
+	appCacheDeleted   *telemetry.Counter
+	appCacheEvicted   *telemetry.Counter
+)
+
+func init() {
+	appCacheResults = telemetry.NewCounterMap(telemetry.Nozzle, "app_metadata.cache.requests", "result")
+
+	appCacheHits = appCacheResults.MustCounter("hit")
+	appCacheMisses = appCacheResults.MustCounter("miss")
+	appCacheStale = appCacheResults.MustCounter("stale")
+	appCacheNegative = appCacheResults.MustCounter("negative")
+
+	appLookups = telemetry.NewCounter(telemetry.Nozzle, "app_metadata.lookups")
+	appLookupErrs = telemetry.NewCounter(telemetry.Nozzle, "app_metadata.lookups.errors")
+	appLookupsDropped = telemetry.NewCounter(telemetry.Nozzle, "app_metadata.lookups.dropped")
+	appLookupLatency = telemetry.NewCounter(telemetry.Nozzle, "app_metadata.lookups.latency_ms")
+	appCacheWarmed = telemetry.NewCounter(telemetry.Nozzle, "app_metadata.cache.warmed")
+	appCacheDeleted = telemetry.NewCounter(telemetry.Nozzle, "app_metadata.cache.deleted")
+	appCacheEvicted = telemetry.NewCounter(telemetry.Nozzle, "app_metadata.cache.evicted")
+}
 
 type AppInfoRepository interface {
 	GetAppInfo(string) AppInfo
@@ -28,37 +78,326 @@ type AppInfo struct {
 	SpaceName string
 	OrgGUID   string
 	OrgName   string
+	// Metadata holds the CAPI v3 labels and annotations of the app, merged
+	// with those of its space and org (see mergeMetadata). It is only
+	// populated if the repository was created with fetchMetadata.
+	Metadata Metadata
+}
+
+// appClient is the subset of *cfclient.Client (extended by capiClient) used to
+// look up apps.
+type appClient interface {
+	AppByGuid(guid string) (cfclient.App, error)
+	ListApps() ([]cfclient.App, error)
+	Metadata(resource, guid string) (Metadata, error)
+	ListMetadata(resource string) (map[string]Metadata, error)
 }
 
-func NewAppInfoRepository(cfClient *cfclient.Client) AppInfoRepository {
-	return &appInfoRepository{cfClient, map[string]AppInfo{}}
+// NewAppInfoRepository returns an AppInfoRepository that caches app metadata
+// looked up from the Cloud Controller.
+//
+// GetAppInfo never blocks on the Cloud Controller: apps missing from the cache
+// are looked up asynchronously, and until that completes their AppInfo is
+// empty. Entries are refreshed in the background once they are older than
+// ttl, and in the meantime their previous AppInfo is still returned, unless
+// the refresh finds that the app was deleted. Apps that could not be looked up
+// are cached as unknown for negativeTTL. Entries not requested for a few ttls
+// are evicted. The cache is warmed by listing all apps in bulk when the
+// repository is created. Background work stops when ctx is done.
+//
+// If fetchMetadata is set, the CAPI v3 metadata of apps, spaces and orgs is
+// fetched as well. Space and org metadata is cached for ttl.
+func NewAppInfoRepository(ctx context.Context, cfClient *cfclient.Client, ttl, negativeTTL time.Duration, fetchMetadata bool, logger lager.Logger) AppInfoRepository {
+	air := newAppInfoRepository(ctx, capiClient{cfClient}, ttl, negativeTTL, fetchMetadata, logger)
+	go air.warm()
+	return air
 }
 
 func NullAppInfoRepository() AppInfoRepository {
 	return &nullAppInfoRepository{}
 }
 
+type appCacheEntry struct {
+	info    AppInfo
+	found   bool
+	expires time.Time
+	// requested is when GetAppInfo last returned the entry, in Unix
+	// nanoseconds. It is updated atomically, under the read lock.
+	requested int64
+}
+
+type metadataCacheEntry struct {
+	metadata Metadata
+	expires  time.Time
+}
+
 type appInfoRepository struct {
-	cfClient *cfclient.Client
-	cache    map[string]AppInfo
+	client        appClient
+	ttl           time.Duration
+	negativeTTL   time.Duration
+	fetchMetadata bool
+	logger        lager.Logger
+	lookups       chan string
+
+	mu       sync.RWMutex // protects cache, pending and metadata
+	cache    map[string]*appCacheEntry
+	pending  map[string]bool
+	metadata map[string]*metadataCacheEntry // space and org metadata, by resource type and GUID
+}
+
+func newAppInfoRepository(ctx context.Context, client appClient, ttl, negativeTTL time.Duration, fetchMetadata bool, logger lager.Logger) *appInfoRepository {
+	air := &appInfoRepository{
+		client:        client,
+		ttl:           ttl,
+		negativeTTL:   negativeTTL,
+		fetchMetadata: fetchMetadata,
+		logger:        logger,
+		lookups:       make(chan string, appLookupQueueSize),
+		cache:         map[string]*appCacheEntry{},
+		pending:       map[string]bool{},
+		metadata:      map[string]*metadataCacheEntry{},
+	}
+	for i := 0; i < appLookupWorkers; i++ {
+		go air.lookupWorker(ctx)
+	}
+	go air.evictIdle(ctx)
+	return air
 }
 
 func (air *appInfoRepository) GetAppInfo(guid string) AppInfo {
-	appInfo, ok := air.cache[guid]
+	air.mu.RLock()
+	entry, ok := air.cache[guid]
+	air.mu.RUnlock()
+
 	if !ok {
-		app, err := air.cfClient.AppByGuid(guid)
+		appCacheMisses.Increment()
+		air.lookup(guid)
+		return AppInfo{}
+	}
+
+	now := time.Now()
+	atomic.StoreInt64(&entry.requested, now.UnixNano())
+	switch {
+	case now.After(entry.expires):
+		appCacheStale.Increment()
+		air.lookup(guid)
+	case !entry.found:
+		appCacheNegative.Increment()
+	default:
+		appCacheHits.Increment()
+	}
+	return entry.info
+}
+
+// lookup queues an asynchronous lookup of guid, unless one is already pending.
+func (air *appInfoRepository) lookup(guid string) {
+	air.mu.Lock()
+	defer air.mu.Unlock()
+
+	if air.pending[guid] {
+		return
+	}
+	select {
+	case air.lookups <- guid:
+		air.pending[guid] = true
+	default:
+		appLookupsDropped.Increment()
+	}
+}
+
+func (air *appInfoRepository) lookupWorker(ctx context.Context) {
+	for {
+		select {
+		case guid := <-air.lookups:
+			air.lookupApp(guid)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// lookupApp looks up guid and caches the result.
+func (air *appInfoRepository) lookupApp(guid string) {
+	start := time.Now()
+	app, err := air.client.AppByGuid(guid)
+	var metadata Metadata
+	if err == nil && air.fetchMetadata {
+		metadata = air.appMetadata(app)
+	}
+	appLookups.Increment()
+	appLookupLatency.Add(int64(time.Since(start) / time.Millisecond))
+
+	air.mu.Lock()
+	defer air.mu.Unlock()
+	delete(air.pending, guid)
+	switch {
+	case cfclient.IsAppNotFoundError(err):
+		// The app was deleted, or never existed: forget what was known about it.
+		if entry, ok := air.cache[guid]; ok && entry.found {
+			appCacheDeleted.Increment()
+		}
+		air.cache[guid] = &appCacheEntry{expires: time.Now().Add(air.negativeTTL), requested: time.Now().UnixNano()}
+	case err != nil:
+		appLookupErrs.Increment()
+		air.logger.Error("appInfoRepository", err, lager.Data{"guid": guid})
+		entry, ok := air.cache[guid]
+		if !ok || !entry.found {
+			entry = &appCacheEntry{requested: time.Now().UnixNano()}
+			air.cache[guid] = entry
+		}
+		// Keep returning previously known metadata, but retry no sooner than negativeTTL.
+		entry.expires = time.Now().Add(air.negativeTTL)
+	default:
+		air.store(guid, app, metadata)
+	}
+}
+
+// evictIdle periodically drops cache entries that have not been requested for
+// appIdleTTLs times the ttl, and space and org metadata that has been expired
+// for as long, so that the cache does not grow with every app ever seen.
+func (air *appInfoRepository) evictIdle(ctx context.Context) {
+	idle := appIdleTTLs * air.ttl
+	ticker := time.NewTicker(air.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			air.evict(time.Now().Add(-idle))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// evict drops app entries last requested before cutoff and metadata entries
+// that expired before it.
+func (air *appInfoRepository) evict(cutoff time.Time) {
+	air.mu.Lock()
+	defer air.mu.Unlock()
+
+	for guid, entry := range air.cache {
+		if atomic.LoadInt64(&entry.requested) < cutoff.UnixNano() && !air.pending[guid] {
+			delete(air.cache, guid)
+			appCacheEvicted.Increment()
+		}
+	}
+	for key, entry := range air.metadata {
+		if entry.expires.Before(cutoff) {
+			delete(air.metadata, key)
+		}
+	}
+}
+
+// appMetadata returns the merged metadata of an app. Metadata that cannot be
+// fetched is logged and left out.
+func (air *appInfoRepository) appMetadata(app cfclient.App) Metadata {
+	appMetadata, err := air.client.Metadata(v3Apps, app.Guid)
+	if err != nil {
+		appLookupErrs.Increment()
+		air.logger.Error("appInfoRepository", err, lager.Data{"info": "fetching app metadata failed", "guid": app.Guid})
+	}
+	space := air.cachedMetadata(v3Spaces, app.SpaceData.Entity.Guid)
+	org := air.cachedMetadata(v3Organizations, app.SpaceData.Entity.OrgData.Entity.Guid)
+	return mergeMetadata(org, space, appMetadata)
+}
+
+// cachedMetadata returns the metadata of a space or org, fetching it if it is
+// not cached or has expired.
+func (air *appInfoRepository) cachedMetadata(resource, guid string) Metadata {
+	if guid == "" {
+		return Metadata{}
+	}
+	key := resource + "/" + guid
+
+	air.mu.RLock()
+	entry, ok := air.metadata[key]
+	air.mu.RUnlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.metadata
+	}
+
+	metadata, err := air.client.Metadata(resource, guid)
+	if err != nil {
+		appLookupErrs.Increment()
+		air.logger.Error("appInfoRepository", err, lager.Data{"info": "fetching " + resource + " metadata failed", "guid": guid})
+		if ok {
+			return entry.metadata
+		}
+		return Metadata{}
+	}
+	air.mu.Lock()
+	air.metadata[key] = &metadataCacheEntry{metadata: metadata, expires: time.Now().Add(air.ttl)}
+	air.mu.Unlock()
+	return metadata
+}
+
+// warm populates the cache with all apps known to the Cloud Controller.
+func (air *appInfoRepository) warm() {
+	apps, err := air.client.ListApps()
+	if err != nil {
+		appLookupErrs.Increment()
+		air.logger.Error("appInfoRepository", err, lager.Data{"info": "warming app metadata cache failed"})
+		return
+	}
+
+	var appMetadata, spaceMetadata, orgMetadata map[string]Metadata
+	if air.fetchMetadata {
+		appMetadata, err = air.client.ListMetadata(v3Apps)
 		if err == nil {
-			appInfo = AppInfo{
-				AppName:   app.Name,
-				SpaceGUID: app.SpaceData.Entity.Guid,
-				SpaceName: app.SpaceData.Entity.Name,
-				OrgGUID:   app.SpaceData.Entity.OrgData.Entity.Guid,
-				OrgName:   app.SpaceData.Entity.OrgData.Entity.Name,
-			}
-			air.cache[guid] = appInfo
+			spaceMetadata, err = air.client.ListMetadata(v3Spaces)
+		}
+		if err == nil {
+			orgMetadata, err = air.client.ListMetadata(v3Organizations)
+		}
+		if err != nil {
+			appLookupErrs.Increment()
+			air.logger.Error("appInfoRepository", err, lager.Data{"info": "warming app metadata cache failed"})
+			return
 		}
 	}
-	return appInfo
+
+	air.mu.Lock()
+	defer air.mu.Unlock()
+	expires := time.Now().Add(air.ttl)
+	for guid, metadata := range spaceMetadata {
+		air.metadata[v3Spaces+"/"+guid] = &metadataCacheEntry{metadata: metadata, expires: expires}
+	}
+	for guid, metadata := range orgMetadata {
+		air.metadata[v3Organizations+"/"+guid] = &metadataCacheEntry{metadata: metadata, expires: expires}
+	}
+	for _, app := range apps {
+		var metadata Metadata
+		if air.fetchMetadata {
+			metadata = mergeMetadata(
+				orgMetadata[app.SpaceData.Entity.OrgData.Entity.Guid],
+				spaceMetadata[app.SpaceData.Entity.Guid],
+				appMetadata[app.Guid])
+		}
+		air.store(app.Guid, app, metadata)
+	}
+	appCacheWarmed.Add(int64(len(apps)))
+	air.logger.Info("appInfoRepository", lager.Data{"info": "warmed app metadata cache", "count": len(apps)})
+}
+
+// store caches app; the caller must hold air.mu.
+func (air *appInfoRepository) store(guid string, app cfclient.App, metadata Metadata) {
+	requested := time.Now().UnixNano()
+	if entry, ok := air.cache[guid]; ok {
+		requested = atomic.LoadInt64(&entry.requested)
+	}
+	air.cache[guid] = &appCacheEntry{
+		info: AppInfo{
+			AppName:   app.Name,
+			SpaceGUID: app.SpaceData.Entity.Guid,
+			SpaceName: app.SpaceData.Entity.Name,
+			OrgGUID:   app.SpaceData.Entity.OrgData.Entity.Guid,
+			OrgName:   app.SpaceData.Entity.OrgData.Entity.Name,
+			Metadata:  metadata,
+		},
+		found:     true,
+		expires:   time.Now().Add(air.ttl),
+		requested: requested,
+	}
 }
 
 type nullAppInfoRepository struct{}
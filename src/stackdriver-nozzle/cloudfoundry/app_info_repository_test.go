@@ -0,0 +1,272 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cloudfoundry
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/go-cfclient"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeAppClient struct {
+	mu       sync.Mutex
+	apps     map[string]cfclient.App
+	metadata map[string]Metadata
+	lookups  map[string]int
+	release  chan struct{}
+	err      error
+}
+
+func newFakeAppClient() *fakeAppClient {
+	return &fakeAppClient{apps: map[string]cfclient.App{}, metadata: map[string]Metadata{}, lookups: map[string]int{}}
+}
+
+func (c *fakeAppClient) AppByGuid(guid string) (cfclient.App, error) {
+	if c.release != nil {
+		<-c.release
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lookups[guid]++
+	if c.err != nil {
+		return cfclient.App{}, c.err
+	}
+	app, ok := c.apps[guid]
+	if !ok {
+		return cfclient.App{}, cfclient.CloudFoundryError{Code: 100004, ErrorCode: "CF-AppNotFound"}
+	}
+	return app, nil
+}
+
+func (c *fakeAppClient) ListApps() ([]cfclient.App, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var apps []cfclient.App
+	for _, app := range c.apps {
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+func (c *fakeAppClient) Metadata(resource, guid string) (Metadata, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lookups[resource+"/"+guid]++
+	return c.metadata[resource+"/"+guid], nil
+}
+
+func (c *fakeAppClient) ListMetadata(resource string) (map[string]Metadata, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	metadata := map[string]Metadata{}
+	for key, m := range c.metadata {
+		if strings.HasPrefix(key, resource+"/") {
+			metadata[strings.TrimPrefix(key, resource+"/")] = m
+		}
+	}
+	return metadata, nil
+}
+
+func (c *fakeAppClient) setApp(guid, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	app := cfclient.App{Guid: guid, Name: name}
+	app.SpaceData.Entity.Guid = "space-guid"
+	app.SpaceData.Entity.Name = "space"
+	app.SpaceData.Entity.OrgData.Entity.Guid = "org-guid"
+	app.SpaceData.Entity.OrgData.Entity.Name = "org"
+	c.apps[guid] = app
+}
+
+func (c *fakeAppClient) setMetadata(resource, guid string, labels, annotations map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metadata[resource+"/"+guid] = Metadata{Labels: labels, Annotations: annotations}
+}
+
+func (c *fakeAppClient) deleteApp(guid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.apps, guid)
+}
+
+func (c *fakeAppClient) setErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+func (c *fakeAppClient) lookupCount(guid string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookups[guid]
+}
+
+var _ = Describe("AppInfoRepository", func() {
+	var (
+		ctx     context.Context
+		cancel  context.CancelFunc
+		client  *fakeAppClient
+		subject *appInfoRepository
+	)
+
+	appName := func(guid string) func() string {
+		return func() string { return subject.GetAppInfo(guid).AppName }
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+		client = newFakeAppClient()
+		client.setApp("guid-1", "app-1")
+		subject = newAppInfoRepository(ctx, client, time.Minute, time.Minute, false, lager.NewLogger("test"))
+		appCacheHits.Set(0)
+		appCacheMisses.Set(0)
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("resolves misses asynchronously", func() {
+		client.release = make(chan struct{})
+		Expect(subject.GetAppInfo("guid-1")).To(Equal(AppInfo{}))
+		Expect(appCacheMisses.IntValue()).To(Equal(1))
+
+		close(client.release)
+		Eventually(appName("guid-1")).Should(Equal("app-1"))
+		info := subject.GetAppInfo("guid-1")
+		Expect(info.SpaceName).To(Equal("space"))
+		Expect(info.OrgName).To(Equal("org"))
+		Expect(appCacheHits.IntValue()).To(BeNumerically(">=", 1))
+		Expect(client.lookupCount("guid-1")).To(Equal(1))
+	})
+
+	It("caches failed lookups", func() {
+		subject.GetAppInfo("unknown")
+		Eventually(func() int { return client.lookupCount("unknown") }).Should(Equal(1))
+		Eventually(func() int {
+			subject.GetAppInfo("unknown")
+			return appCacheNegative.IntValue()
+		}).Should(BeNumerically(">", 0))
+		Expect(client.lookupCount("unknown")).To(Equal(1))
+	})
+
+	It("refreshes expired entries in the background", func() {
+		subject = newAppInfoRepository(ctx, client, 10*time.Millisecond, time.Minute, false, lager.NewLogger("test"))
+		subject.warm()
+
+		client.setApp("guid-1", "renamed")
+		time.Sleep(20 * time.Millisecond)
+		// The stale entry is still served while it is refreshed.
+		Expect(subject.GetAppInfo("guid-1").AppName).To(Equal("app-1"))
+		Eventually(appName("guid-1")).Should(Equal("renamed"))
+	})
+
+	It("keeps known metadata when a refresh fails", func() {
+		subject = newAppInfoRepository(ctx, client, 10*time.Millisecond, time.Minute, false, lager.NewLogger("test"))
+		subject.warm()
+
+		client.setErr(errors.New("CAPI unavailable"))
+		time.Sleep(20 * time.Millisecond)
+		subject.GetAppInfo("guid-1")
+		Eventually(func() int { return client.lookupCount("guid-1") }).Should(Equal(1))
+		Consistently(appName("guid-1")).Should(Equal("app-1"))
+	})
+
+	It("forgets apps that were deleted", func() {
+		appCacheDeleted.Set(0)
+		subject = newAppInfoRepository(ctx, client, 10*time.Millisecond, time.Minute, false, lager.NewLogger("test"))
+		subject.warm()
+
+		client.deleteApp("guid-1")
+		time.Sleep(20 * time.Millisecond)
+		subject.GetAppInfo("guid-1")
+		Eventually(appName("guid-1")).Should(BeEmpty())
+		Expect(appCacheDeleted.IntValue()).To(Equal(1))
+		Expect(client.lookupCount("guid-1")).To(Equal(1))
+	})
+
+	It("evicts entries that are no longer requested", func() {
+		appCacheEvicted.Set(0)
+		client.setApp("guid-2", "app-2")
+		subject.warm()
+		time.Sleep(time.Millisecond)
+		cutoff := time.Now()
+
+		subject.GetAppInfo("guid-1")
+		subject.evict(cutoff)
+		Expect(subject.cache).To(HaveLen(1))
+		Expect(subject.cache).To(HaveKey("guid-1"))
+
+		subject.evict(time.Now().Add(time.Millisecond))
+		Expect(subject.cache).To(BeEmpty())
+		Expect(appCacheEvicted.IntValue()).To(Equal(2))
+	})
+
+	It("stops looking up apps once the context is done", func() {
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+		subject.GetAppInfo("guid-1")
+		Consistently(func() int { return client.lookupCount("guid-1") }, 50*time.Millisecond).Should(Equal(0))
+	})
+
+	It("warms the cache by listing all apps", func() {
+		client.setApp("guid-2", "app-2")
+		subject.warm()
+		Expect(subject.GetAppInfo("guid-1").AppName).To(Equal("app-1"))
+		Expect(subject.GetAppInfo("guid-2").AppName).To(Equal("app-2"))
+		Expect(client.lookupCount("guid-1")).To(Equal(0))
+	})
+
+	Context("with metadata", func() {
+		expected := Metadata{
+			Labels:      map[string]string{"team": "payments", "tier": "frontend", "cost-center": "1234"},
+			Annotations: map[string]string{"contact": "oncall@example.com"},
+		}
+
+		BeforeEach(func() {
+			client.setMetadata(v3Organizations, "org-guid", map[string]string{"team": "platform", "cost-center": "1234"}, nil)
+			client.setMetadata(v3Spaces, "space-guid", map[string]string{"team": "payments"}, map[string]string{"contact": "oncall@example.com"})
+			client.setMetadata(v3Apps, "guid-1", map[string]string{"tier": "frontend"}, nil)
+			subject = newAppInfoRepository(ctx, client, time.Minute, time.Minute, true, lager.NewLogger("test"))
+		})
+
+		It("merges app, space and org metadata on lookup", func() {
+			client.setApp("guid-2", "app-2")
+			Eventually(appName("guid-1")).Should(Equal("app-1"))
+			Expect(subject.GetAppInfo("guid-1").Metadata).To(Equal(expected))
+
+			// Space and org metadata is cached.
+			Eventually(appName("guid-2")).Should(Equal("app-2"))
+			Expect(client.lookupCount(v3Spaces + "/space-guid")).To(Equal(1))
+			Expect(client.lookupCount(v3Organizations + "/org-guid")).To(Equal(1))
+		})
+
+		It("warms metadata in bulk", func() {
+			subject.warm()
+			Expect(subject.GetAppInfo("guid-1").Metadata).To(Equal(expected))
+			Expect(client.lookupCount(v3Apps + "/guid-1")).To(Equal(0))
+		})
+	})
+})
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cloudfoundry
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+// Resource types that carry CAPI v3 metadata, as named in v3 API paths.
+const (
+	v3Apps          = "apps"
+	v3Spaces        = "spaces"
+	v3Organizations = "organizations"
+)
+
+// Metadata holds the CAPI v3 metadata labels and annotations of a resource.
+type Metadata struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// mergeMetadata combines the metadata of an app with that of its space and
+// org. For keys set on several of them, the app's value wins over the space's,
+// which wins over the org's.
+func mergeMetadata(org, space, app Metadata) Metadata {
+	merged := Metadata{Labels: map[string]string{}, Annotations: map[string]string{}}
+	for _, m := range []Metadata{org, space, app} {
+		for k, v := range m.Labels {
+			merged.Labels[k] = v
+		}
+		for k, v := range m.Annotations {
+			merged.Annotations[k] = v
+		}
+	}
+	return merged
+}
+
+// capiClient adds the CAPI v3 metadata endpoints, which go-cfclient does not
+// provide, to a *cfclient.Client.
+type capiClient struct {
+	*cfclient.Client
+}
+
+// Metadata fetches the metadata of a single resource.
+func (c capiClient) Metadata(resource, guid string) (Metadata, error) {
+	var r struct {
+		Metadata Metadata `json:"metadata"`
+	}
+	err := c.get("/v3/"+resource+"/"+guid, &r)
+	return r.Metadata, err
+}
+
+// ListMetadata fetches the metadata of all resources of a type, by GUID.
+func (c capiClient) ListMetadata(resource string) (map[string]Metadata, error) {
+	metadata := map[string]Metadata{}
+	path := "/v3/" + resource + "?per_page=5000"
+	for path != "" {
+		var page struct {
+			Pagination struct {
+				Next *cfclient.Link `json:"next"`
+			} `json:"pagination"`
+			Resources []struct {
+				GUID     string   `json:"guid"`
+				Metadata Metadata `json:"metadata"`
+			} `json:"resources"`
+		}
+		if err := c.get(path, &page); err != nil {
+			return nil, err
+		}
+		for _, r := range page.Resources {
+			metadata[r.GUID] = r.Metadata
+		}
+
+		path = ""
+		if page.Pagination.Next != nil && page.Pagination.Next.Href != "" {
+			next, err := url.Parse(page.Pagination.Next.Href)
+			if err != nil {
+				return nil, err
+			}
+			path = next.RequestURI()
+		}
+	}
+	return metadata, nil
+}
+
+func (c capiClient) get(path string, v interface{}) error {
+	resp, err := c.DoRequest(c.NewRequest("GET", path))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -15,7 +15,13 @@
  */
 
 /*
-ClearMetricsDescriptors - delete custom MetricDescriptors from a Google Cloud Project
+ClearMetricsDescriptors - delete unused custom MetricDescriptors from a Google Cloud Project
+
+Descriptors are selected by metric type prefix and the --include and --exclude
+regular expressions. Only those without data in the last --unused-days days
+are deleted; with --dry-run nothing is. A JSON report of every selected
+descriptor, whether it is in use and what was done with it, is written to
+--report (stdout by default).
 
 Setup:
 - Setup application default credentials to a user with 'roles/monitoring.admin'
@@ -24,92 +30,274 @@ Setup:
   For example if you set your GOPATH to $HOME/GO
     export GOPATH=$HOME/go
   This file should be located at:
-    $HOME/go/src/github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/cmd/clear-metric-descriptors.go
+    $HOME/go/src/github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/cmd/clear-metrics-descriptors/clear-metrics-descriptors.go
 
 Usage (from this directory):
-go run ./clear-metric-descriptors.go --help
+go run ./clear-metrics-descriptors.go --help
 */
 package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/monitoring/apiv3"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"golang.org/x/net/context"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc"
 )
 
 var (
-	projectID string
-	prefix    string
+	projectID  string
+	prefix     string
+	include    string
+	exclude    string
+	unusedDays int
+	dryRun     bool
+	yes        bool
+	reportPath string
+	endpoint   string
+	insecure   bool
 )
 
 func init() {
 	flag.StringVar(&projectID, "project-id", "", "The Google Cloud Project ID used for Stackdriver Monitoring, eg cf-prod-mon")
 	flag.StringVar(&prefix, "prefix", "custom.googleapis.com/", "Prefix of metric.type for finding Metric Descriptors")
+	flag.StringVar(&include, "include", "", "Only consider Metric Descriptors whose metric.type matches this regular expression")
+	flag.StringVar(&exclude, "exclude", "", "Never consider Metric Descriptors whose metric.type matches this regular expression")
+	flag.IntVar(&unusedDays, "unused-days", 30, "Only delete Metric Descriptors without data in this many days")
+	flag.BoolVar(&dryRun, "dry-run", false, "Only report which Metric Descriptors would be deleted")
+	flag.BoolVar(&yes, "yes", false, "Delete without asking for confirmation")
+	flag.StringVar(&reportPath, "report", "", "File to write the JSON report to; stdout if empty")
+	flag.StringVar(&endpoint, "endpoint", "", "Address (host:port) of the Stackdriver Monitoring API, if not the default")
+	flag.BoolVar(&insecure, "insecure", false, "Connect to --endpoint without TLS and credentials, e.g. to fake-stackdriver")
+}
+
+// Report is what the tool found and did.
+type Report struct {
+	Project     string             `json:"project"`
+	Prefix      string             `json:"prefix"`
+	Include     string             `json:"include,omitempty"`
+	Exclude     string             `json:"exclude,omitempty"`
+	UnusedDays  int                `json:"unused_days"`
+	DryRun      bool               `json:"dry_run"`
+	CheckedAt   time.Time          `json:"checked_at"`
+	Descriptors []DescriptorReport `json:"descriptors"`
+}
+
+// DescriptorReport describes one selected Metric Descriptor. Action is "keep"
+// or "delete"; Deleted is only set once a descriptor is actually deleted.
+type DescriptorReport struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	InUse   bool   `json:"in_use"`
+	Action  string `json:"action"`
+	Deleted bool   `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Options select the Metric Descriptors to clear and how.
+type Options struct {
+	ProjectID  string
+	Prefix     string
+	Include    string
+	Exclude    string
+	UnusedDays int
+	DryRun     bool
+	// Confirm is asked before deleting count descriptors; if nil, they are
+	// deleted without asking.
+	Confirm func(count int) bool
 }
 
 func main() {
 	flag.Parse()
 
-	if projectID == "" {
-		log.Fatalf("error: project-id flag required, try runnig with --help")
+	opts := Options{
+		ProjectID:  projectID,
+		Prefix:     prefix,
+		Include:    include,
+		Exclude:    exclude,
+		UnusedDays: unusedDays,
+		DryRun:     dryRun,
+	}
+	if !yes {
+		opts.Confirm = confirm
+	}
+
+	clientOpts := []option.ClientOption{option.WithScopes("https://www.googleapis.com/auth/monitoring")}
+	if endpoint != "" {
+		clientOpts = append(clientOpts, option.WithEndpoint(endpoint))
+	}
+	if insecure {
+		clientOpts = append(clientOpts, option.WithoutAuthentication(), option.WithGRPCDialOption(grpc.WithInsecure()))
 	}
 
 	ctx := context.Background()
-	metricClient, err := monitoring.NewMetricClient(ctx, option.WithScopes("https://www.googleapis.com/auth/monitoring"))
+	metricClient, err := monitoring.NewMetricClient(ctx, clientOpts...)
 	if err != nil {
 		panic(err)
 	}
 
-	log.Printf("discovering metric descriptors for %s", projectID)
+	report, err := clearDescriptors(ctx, metricClient, opts)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if err := writeReport(report); err != nil {
+		log.Fatalf("writing report: %v", err)
+	}
+}
+
+// clearDescriptors finds the Metric Descriptors opts select, checks which of
+// them have no data in the last opts.UnusedDays days and, unless opts.DryRun,
+// deletes those. Descriptors that could not be checked or deleted are kept
+// and their error recorded in the report.
+func clearDescriptors(ctx context.Context, client *monitoring.MetricClient, opts Options) (*Report, error) {
+	if opts.ProjectID == "" {
+		return nil, errors.New("project-id flag required, try runnig with --help")
+	}
+	if opts.UnusedDays <= 0 {
+		return nil, errors.New("unused-days must be positive")
+	}
+	includeRe, err := compile(opts.Include)
+	if err != nil {
+		return nil, fmt.Errorf("include: %v", err)
+	}
+	excludeRe, err := compile(opts.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("exclude: %v", err)
+	}
 
-	itr := metricClient.ListMetricDescriptors(ctx, &monitoringpb.ListMetricDescriptorsRequest{
-		Name:   fmt.Sprintf("projects/%s", projectID),
-		Filter: fmt.Sprintf(`metric.type = starts_with("%s")`, prefix),
+	report := &Report{
+		Project:    opts.ProjectID,
+		Prefix:     opts.Prefix,
+		Include:    opts.Include,
+		Exclude:    opts.Exclude,
+		UnusedDays: opts.UnusedDays,
+		DryRun:     opts.DryRun,
+		CheckedAt:  time.Now().UTC(),
+	}
+
+	log.Printf("discovering metric descriptors for %s", opts.ProjectID)
+
+	itr := client.ListMetricDescriptors(ctx, &monitoringpb.ListMetricDescriptorsRequest{
+		Name:   fmt.Sprintf("projects/%s", opts.ProjectID),
+		Filter: fmt.Sprintf(`metric.type = starts_with("%s")`, opts.Prefix),
 	})
-	var names []string
 	for resp, err := itr.Next(); err != iterator.Done; resp, err = itr.Next() {
 		if err != nil {
-			log.Fatalf("listing metric descriptors for %s: %v", projectID, err)
+			return nil, fmt.Errorf("listing metric descriptors for %s: %v", opts.ProjectID, err)
+		}
+		if includeRe != nil && !includeRe.MatchString(resp.Type) || excludeRe != nil && excludeRe.MatchString(resp.Type) {
+			continue
 		}
+		report.Descriptors = append(report.Descriptors, DescriptorReport{Name: resp.Name, Type: resp.Type, Action: "keep"})
+	}
 
-		names = append(names, resp.Name)
-		log.Printf("Found metric descriptor for deletion: %s\n", resp.Name)
+	var unused []*DescriptorReport
+	since := report.CheckedAt.AddDate(0, 0, -opts.UnusedDays)
+	for i := range report.Descriptors {
+		d := &report.Descriptors[i]
+		inUse, err := hasData(ctx, client, opts.ProjectID, d.Type, since, report.CheckedAt)
+		if err != nil {
+			// Descriptors that could not be checked are kept.
+			d.Error = err.Error()
+			log.Printf("Could not check %s for data, keeping it: %v\n", d.Name, err)
+			continue
+		}
+		d.InUse = inUse
+		if inUse {
+			log.Printf("In use, keeping: %s\n", d.Name)
+			continue
+		}
+		d.Action = "delete"
+		unused = append(unused, d)
+		log.Printf("Unused for %d days, found for deletion: %s\n", opts.UnusedDays, d.Name)
 	}
 
-	if len(names) == 0 {
-		log.Printf("no metric descriptors found for deletion")
-		os.Exit(0)
+	if len(unused) == 0 {
+		log.Printf("no unused metric descriptors found for deletion")
+	} else if opts.DryRun {
+		log.Printf("dry run: not deleting %d unused metric descriptors", len(unused))
+	} else if opts.Confirm == nil || opts.Confirm(len(unused)) {
+		for _, d := range unused {
+			log.Printf("Clearing: %s\n", d.Name)
+			err := client.DeleteMetricDescriptor(ctx, &monitoringpb.DeleteMetricDescriptorRequest{Name: d.Name})
+			if err != nil {
+				d.Error = err.Error()
+				log.Printf("deleting %s: %v", d.Name, err)
+				continue
+			}
+			d.Deleted = true
+		}
 	}
 
-	fmt.Printf("Delete %d metric descriptors from project?\n", len(names))
-	fmt.Printf("This is irreversible and will result in data loss: (y/n) ")
-	reader := bufio.NewReader(os.Stdin)
-	confirm, err := reader.ReadString('\n')
+	return report, nil
+}
+
+func compile(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+// hasData reports whether any time series of metricType has points between
+// start and end.
+func hasData(ctx context.Context, client *monitoring.MetricClient, projectID, metricType string, start, end time.Time) (bool, error) {
+	itr := client.ListTimeSeries(ctx, &monitoringpb.ListTimeSeriesRequest{
+		Name:   fmt.Sprintf("projects/%s", projectID),
+		Filter: fmt.Sprintf(`metric.type = "%s"`, metricType),
+		Interval: &monitoringpb.TimeInterval{
+			StartTime: &timestamp.Timestamp{Seconds: start.Unix(), Nanos: int32(start.Nanosecond())},
+			EndTime:   &timestamp.Timestamp{Seconds: end.Unix(), Nanos: int32(end.Nanosecond())},
+		},
+		View:     monitoringpb.ListTimeSeriesRequest_HEADERS,
+		PageSize: 1,
+	})
+	_, err := itr.Next()
+	if err == iterator.Done {
+		return false, nil
+	}
 	if err != nil {
-		log.Fatalf("could not read stdin: %v", err)
+		return false, err
 	}
+	return true, nil
+}
 
-	if strings.TrimSpace(strings.ToLower(confirm)) != "y" {
-		os.Exit(0)
+func confirm(count int) bool {
+	fmt.Fprintf(os.Stderr, "Delete %d unused metric descriptors from project?\n", count)
+	fmt.Fprintf(os.Stderr, "This is irreversible and will result in data loss: (y/n) ")
+	reader := bufio.NewReader(os.Stdin)
+	answer, err := reader.ReadString('\n')
+	if err != nil {
+		log.Fatalf("could not read stdin: %v", err)
 	}
+	return strings.TrimSpace(strings.ToLower(answer)) == "y"
+}
 
-	for _, name := range names {
-		log.Printf("Clearing: %s\n", name)
-		req := &monitoringpb.DeleteMetricDescriptorRequest{
-			Name: name,
-		}
-		err = metricClient.DeleteMetricDescriptor(ctx, req)
+func writeReport(report *Report) error {
+	var w io.Writer = os.Stdout
+	if reportPath != "" {
+		f, err := os.Create(reportPath)
 		if err != nil {
-			log.Fatalf("deleting %s: %v", name, err)
+			return err
 		}
+		defer f.Close()
+		w = f
 	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
 }
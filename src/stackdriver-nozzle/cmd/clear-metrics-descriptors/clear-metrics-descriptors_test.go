@@ -0,0 +1,193 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+
+	"cloud.google.com/go/monitoring/apiv3"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/fakestackdriver"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc"
+)
+
+var _ = Describe("clearDescriptors", func() {
+	const project = "projects/my-project"
+
+	var (
+		ctx    context.Context
+		server *fakestackdriver.Server
+		client *monitoring.MetricClient
+		opts   Options
+	)
+
+	createDescriptor := func(metricType string) {
+		_, err := client.CreateMetricDescriptor(ctx, &monitoringpb.CreateMetricDescriptorRequest{
+			Name: project,
+			MetricDescriptor: &metricpb.MetricDescriptor{
+				Type:       metricType,
+				MetricKind: metricpb.MetricDescriptor_GAUGE,
+				ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	writePoint := func(metricType string, at time.Time) {
+		err := client.CreateTimeSeries(ctx, &monitoringpb.CreateTimeSeriesRequest{
+			Name: project,
+			TimeSeries: []*monitoringpb.TimeSeries{{
+				Metric: &metricpb.Metric{Type: metricType},
+				Points: []*monitoringpb.Point{{
+					Interval: &monitoringpb.TimeInterval{EndTime: &timestamp.Timestamp{Seconds: at.Unix(), Nanos: int32(at.Nanosecond())}},
+					Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: 1}},
+				}},
+			}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	descriptorTypes := func() []string {
+		var types []string
+		for _, d := range server.MetricDescriptors() {
+			types = append(types, d.Type)
+		}
+		return types
+	}
+
+	actions := func(report *Report) map[string]string {
+		byType := map[string]string{}
+		for _, d := range report.Descriptors {
+			byType[d.Type] = d.Action
+		}
+		return byType
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		var err error
+		server, err = fakestackdriver.NewServer()
+		Expect(err).NotTo(HaveOccurred())
+		client, err = monitoring.NewMetricClient(ctx,
+			option.WithEndpoint(server.Addr()),
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithInsecure()))
+		Expect(err).NotTo(HaveOccurred())
+
+		createDescriptor("custom.googleapis.com/firehose/unused")
+		createDescriptor("custom.googleapis.com/firehose/excluded")
+		createDescriptor("custom.googleapis.com/other/unused")
+		createDescriptor("external.googleapis.com/unused")
+		createDescriptor("custom.googleapis.com/firehose/stale")
+		writePoint("custom.googleapis.com/firehose/stale", time.Now().AddDate(0, 0, -40))
+		writePoint("custom.googleapis.com/firehose/used", time.Now())
+
+		opts = Options{
+			ProjectID:  "my-project",
+			Prefix:     "custom.googleapis.com/",
+			Include:    "/firehose/",
+			Exclude:    "excluded$",
+			UnusedDays: 30,
+		}
+	})
+
+	AfterEach(func() {
+		client.Close()
+		server.Stop()
+	})
+
+	It("deletes selected descriptors without data in the last days", func() {
+		report, err := clearDescriptors(ctx, client, opts)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(actions(report)).To(Equal(map[string]string{
+			"custom.googleapis.com/firehose/unused": "delete",
+			"custom.googleapis.com/firehose/stale":  "delete",
+			"custom.googleapis.com/firehose/used":   "keep",
+		}))
+		for _, d := range report.Descriptors {
+			Expect(d.Deleted).To(Equal(d.Action == "delete"), d.Type)
+			Expect(d.InUse).To(Equal(d.Action == "keep"), d.Type)
+		}
+		Expect(descriptorTypes()).To(ConsistOf(
+			"custom.googleapis.com/firehose/excluded",
+			"custom.googleapis.com/firehose/used",
+			"custom.googleapis.com/other/unused",
+			"external.googleapis.com/unused",
+		))
+	})
+
+	It("only reports in a dry run", func() {
+		opts.DryRun = true
+		report, err := clearDescriptors(ctx, client, opts)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(actions(report)).To(HaveKeyWithValue("custom.googleapis.com/firehose/unused", "delete"))
+		Expect(server.Requests(fakestackdriver.DeleteMetricDescriptor)).To(Equal(0))
+		Expect(descriptorTypes()).To(HaveLen(6))
+	})
+
+	It("asks for confirmation", func() {
+		var asked int
+		opts.Confirm = func(count int) bool {
+			asked = count
+			return false
+		}
+		report, err := clearDescriptors(ctx, client, opts)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(asked).To(Equal(2))
+		for _, d := range report.Descriptors {
+			Expect(d.Deleted).To(BeFalse())
+		}
+		Expect(server.Requests(fakestackdriver.DeleteMetricDescriptor)).To(Equal(0))
+	})
+
+	It("keeps descriptors that could not be checked, and records errors", func() {
+		server.FailNext(fakestackdriver.ListTimeSeries, fakestackdriver.ErrInvalidArgument, 1)
+		server.FailNext(fakestackdriver.DeleteMetricDescriptor, fakestackdriver.ErrInvalidArgument, 1)
+		report, err := clearDescriptors(ctx, client, opts)
+		Expect(err).NotTo(HaveOccurred())
+
+		var errs int
+		for _, d := range report.Descriptors {
+			if d.Error != "" {
+				errs++
+				Expect(d.Deleted).To(BeFalse())
+			}
+		}
+		Expect(errs).To(Equal(2))
+		Expect(descriptorTypes()).To(HaveLen(6))
+	})
+
+	It("rejects invalid options", func() {
+		opts.Include = "("
+		_, err := clearDescriptors(ctx, client, opts)
+		Expect(err).To(MatchError(ContainSubstring("include")))
+
+		opts.Include = ""
+		opts.UnusedDays = 0
+		_, err = clearDescriptors(ctx, client, opts)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// fake-stackdriver serves the Stackdriver Monitoring and Logging APIs from
+// memory, so the nozzle can run offline with
+//
+//	STACKDRIVER_MONITORING_ENDPOINT=<addr>
+//	STACKDRIVER_LOGGING_ENDPOINT=<addr>
+//	STACKDRIVER_INSECURE=true
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/fakestackdriver"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8085", "address to listen on")
+	latency := flag.Duration("latency", 0, "delay of every CreateTimeSeries and WriteLogEntries call")
+	report := flag.Duration("report", 30*time.Second, "how often to print what was received")
+	flag.Parse()
+
+	server, err := fakestackdriver.Listen(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.SetLatency(fakestackdriver.CreateTimeSeries, *latency)
+	server.SetLatency(fakestackdriver.WriteLogEntries, *latency)
+	log.Printf("listening on %s", server.Addr())
+
+	exitSignal := make(chan os.Signal, 1)
+	signal.Notify(exitSignal, os.Interrupt)
+
+	t := time.NewTicker(*report)
+	for {
+		select {
+		case <-t.C:
+			log.Printf("descriptors: %d, time series: %d, log entries: %d, CreateTimeSeries calls: %d",
+				len(server.MetricDescriptors()), len(server.TimeSeries()), len(server.LogEntries()),
+				server.Requests(fakestackdriver.CreateTimeSeries))
+		case <-exitSignal:
+			server.Stop()
+			os.Exit(0)
+		}
+	}
+}
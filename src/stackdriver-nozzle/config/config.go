@@ -51,11 +51,23 @@ func NewConfig() (*Config, error) {
 		return nil, err
 	}
 
+	err = c.maybeLoadMetricsPipelineFile()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.NozzleInstance == "" {
+		c.NozzleInstance = c.NozzleID
+	}
 	c.setNozzleHostInfo()
 
 	return &c, nil
 }
 
+// dryRunProjectID is the project in resource names written in dry-run mode
+// when GCP_PROJECT_ID is unset and the nozzle is not running on GCE.
+const dryRunProjectID = "dry-run"
+
 type Config struct {
 	// Firehose config
 	APIEndpoint      string `envconfig:"firehose_endpoint" required:"true"`
@@ -81,39 +93,144 @@ type Config struct {
 	LoggingBatchCount    int    `envconfig:"logging_batch_count" default:"1000"`
 	LoggingBatchDuration int    `envconfig:"logging_batch_duration" default:"30"`
 	LoggingReqsInFlight  int    `envconfig:"logging_requests_in_flight" default:"16"`
+	MetricsReqsInFlight  int    `envconfig:"metrics_requests_in_flight" default:"4"`
+	// Points of a time series written less than MetricsMinPointInterval seconds apart are held back, as Stackdriver
+	// rejects them. CreateTimeSeries requests are limited to MetricsRequestsPerSecond if it is positive.
+	MetricsMinPointInterval  int `envconfig:"metrics_min_point_interval" default:"5"`
+	MetricsRequestsPerSecond int `envconfig:"metrics_requests_per_second"`
+	// With MetricsInstanceLabel, gauges not about an app and app HTTP metrics get a "nozzle" label with NozzleInstance,
+	// so that several nozzles write separate time series rather than points of the same series out of order.
+	// NozzleInstance must stay the same when the nozzle's VM is recreated (e.g. the BOSH instance ID); it defaults
+	// to NOZZLE_ID, as set before it is replaced by the GCE instance ID.
+	MetricsInstanceLabel bool   `envconfig:"metrics_instance_label"`
+	NozzleInstance       string `envconfig:"nozzle_instance"`
+	// Addresses (host:port) of the Stackdriver Monitoring and Logging APIs, replacing the defaults if set. With
+	// StackdriverInsecure, they are used without TLS and credentials, e.g. for a local fake-stackdriver server.
+	MonitoringEndpoint  string `envconfig:"stackdriver_monitoring_endpoint"`
+	LoggingEndpoint     string `envconfig:"stackdriver_logging_endpoint"`
+	StackdriverInsecure bool   `envconfig:"stackdriver_insecure"`
 
 	// Nozzle config
-	HeartbeatRate         int    `envconfig:"heartbeat_rate" default:"30"`
-	MetricsBufferDuration int    `envconfig:"metrics_buffer_duration" default:"30"`
-	MetricsBatchSize      int    `envconfig:"metrics_batch_size" default:"200"`
-	MetricPathPrefix      string `envconfig:"metric_path_prefix" default:"firehose"`
-	FoundationName        string `envconfig:"foundation_name" default:"cf"`
-	ResolveAppMetadata    bool   `envconfig:"resolve_app_metadata"`
-	NozzleID              string `envconfig:"nozzle_id" default:"local-nozzle"`
-	NozzleName            string `envconfig:"nozzle_name" default:"local-nozzle"`
-	NozzleZone            string `envconfig:"nozzle_zone" default:"local-nozzle"`
-	DebugNozzle           bool   `envconfig:"debug_nozzle"`
+	HeartbeatRate         int `envconfig:"heartbeat_rate" default:"30"`
+	MetricsBufferDuration int `envconfig:"metrics_buffer_duration" default:"30"`
+	MetricsBatchSize      int `envconfig:"metrics_batch_size" default:"200"`
+	MetricsRetryTimeout   int `envconfig:"metrics_retry_timeout" default:"20"`
+	// MetricDescriptorPolicy is what happens to custom metric descriptors that do not match the metrics written to
+	// them: "report" logs and counts the mismatch, "recreate" deletes and recreates the descriptor, losing its data.
+	// Descriptors are listed again every MetricDescriptorRefresh seconds.
+	MetricDescriptorPolicy  string `envconfig:"metric_descriptor_policy" default:"report"`
+	MetricDescriptorRefresh int    `envconfig:"metric_descriptor_refresh" default:"600"`
+	MetricPathPrefix        string `envconfig:"metric_path_prefix" default:"firehose"`
+	FoundationName          string `envconfig:"foundation_name" default:"cf"`
+	ResolveAppMetadata      bool   `envconfig:"resolve_app_metadata"`
+	// Resolved app metadata is refreshed after AppMetadataTTL seconds; failed lookups are retried after
+	// AppMetadataNegativeTTL seconds.
+	AppMetadataTTL         int `envconfig:"app_metadata_ttl" default:"600"`
+	AppMetadataNegativeTTL int `envconfig:"app_metadata_negative_ttl" default:"60"`
+	// CAPI v3 metadata labels and annotations (of the app, its space or its org) with keys in AppMetadataKeys (comma
+	// separated) are added to log labels, and with AppMetadataMetricLabels also to metric labels, as far as the limit
+	// of 10 labels per metric permits.
+	AppMetadataKeys         string `envconfig:"app_metadata_keys"`
+	AppMetadataMetricLabels bool   `envconfig:"app_metadata_metric_labels"`
+	// With AppMetadataControls, apps can opt out of logs or metrics, or set a minimum log severity, through the
+	// stackdriver.nozzle/logs, stackdriver.nozzle/metrics and stackdriver.nozzle/min-severity annotations.
+	AppMetadataControls bool `envconfig:"app_metadata_controls"`
+	// MetricAppLabels selects the labels identifying apps in metrics: "path" (applicationPath), "path_and_guid"
+	// (applicationPath, app_guid, space_guid and org_guid) or "guid" (only the GUIDs). With LogGUIDLabels, logs get the
+	// GUID labels alongside applicationPath.
+	MetricAppLabels string `envconfig:"metric_app_labels" default:"path"`
+	LogGUIDLabels   bool   `envconfig:"log_guid_labels"`
+
+	NozzleID    string `envconfig:"nozzle_id" default:"local-nozzle"`
+	NozzleName  string `envconfig:"nozzle_name" default:"local-nozzle"`
+	NozzleZone  string `envconfig:"nozzle_zone" default:"local-nozzle"`
+	DebugNozzle bool   `envconfig:"debug_nozzle"`
 	// By default 'origin' label is prepended to metric name, however for runtime metrics (defined here) we add it as a metric label instead.
 	RuntimeMetricRegex string `envconfig:"runtime_metric_regex" default:"^(numCPUS|numGoRoutines|memoryStats\\..*)$"`
 	// If enabled, CounterEvents will be reported as cumulative Stackdriver metrics instead of two gauges (<metric>.delta
 	// and <metric>.total). Reporting cumulative metrics involves nozzle keeping track of internal counter state, and
 	// requires deterministic routing of CounterEvents to nozzles (i.e. CounterEvent messages for a particular metric MUST
-	// always be routed to the same nozzle process); the easiest way to achieve that is to run a single copy of the nozzle.
+	// always be routed to the same nozzle process); the easiest way to achieve that is to run a single copy of the nozzle,
+	// the alternative is to enable counter sharding below.
 	EnableCumulativeCounters bool `envconfig:"enable_cumulative_counters"`
+	// CounterEvents with a metric name (including path prefix and origin) matching CounterRateRegex are also reported
+	// as a per-second rate gauge, <metric>.rate. With CounterRateReplace, they are only reported as rates.
+	CounterRateRegex   string `envconfig:"counter_rate_regex"`
+	CounterRateReplace bool   `envconfig:"counter_rate_replace"`
+	// If enabled, nozzles forward each CounterEvent to the peer that owns its time series (by consistent hashing), so
+	// several nozzles can report cumulative counters. Peers are listed in CounterShardingPeers (comma separated hosts),
+	// or resolved from CounterShardingPeersDNS every CounterShardingDNSRefresh seconds. CounterShardingSelf is the
+	// host under which this nozzle appears in that list. All peers listen on CounterShardingPort, and authenticate
+	// each other with CounterShardingSecret.
+	EnableCounterSharding     bool   `envconfig:"enable_counter_sharding"`
+	CounterShardingPort       int    `envconfig:"counter_sharding_port" default:"8081"`
+	CounterShardingSelf       string `envconfig:"counter_sharding_self"`
+	CounterShardingPeers      string `envconfig:"counter_sharding_peers"`
+	CounterShardingPeersDNS   string `envconfig:"counter_sharding_peers_dns"`
+	CounterShardingDNSRefresh int    `envconfig:"counter_sharding_dns_refresh" default:"30"`
+	CounterShardingSecret     string `envconfig:"counter_sharding_secret"`
 	// If enabled, the Nozzle will derive per-application HTTP metrics from
-	// HttpStartStop events and export them as counters to Stackdriver.
+	// HttpStartStop events and export them as cumulative counters to Stackdriver.
+	// These are routed like CounterEvents, so CounterEvent must be one of the
+	// events sent to Stackdriver Monitoring. Series expire after CounterTrackerTTL.
 	EnableAppHTTPMetrics bool `envconfig:"enable_app_http_metrics"`
+	// If enabled, ContainerMetrics also produce derived memoryUtilization, diskUtilization, memoryBytesFree and
+	// diskBytesFree gauges (and cpuEntitlement, if ContainerCPUEntitlementPerGiB is set). They add time series for
+	// every app instance.
+	EnableDerivedContainerMetrics bool `envconfig:"enable_derived_container_metrics"`
+	// CPU percentage (of a single core) a container is entitled to per GiB of memory quota. Used to normalize
+	// cpuPercentage into the cpuEntitlement gauge; zero disables that gauge.
+	ContainerCPUEntitlementPerGiB float64 `envconfig:"container_cpu_entitlement_per_gib"`
+	// Caps on the number of distinct time series, in total and per metric name; 0 disables a cap. Series count
+	// towards the caps until they have not been seen for MetricSeriesTTL seconds. New series over a cap are
+	// dropped, or if MetricSeriesOverflow is set, reported with all label values replaced by "__overflow__".
+	MetricSeriesLimit        int  `envconfig:"metric_series_limit"`
+	MetricSeriesLimitPerName int  `envconfig:"metric_series_limit_per_name"`
+	MetricSeriesTTL          int  `envconfig:"metric_series_ttl" default:"600"`
+	MetricSeriesOverflow     bool `envconfig:"metric_series_overflow"`
+	// MetricsBackend is where metrics go: "stackdriver" (Stackdriver Monitoring), "otlp" (an OpenTelemetry collector,
+	// see OTLPEndpoint) or "prometheus", which serves the latest value of every series on :PrometheusPort/metrics for
+	// Prometheus to scrape. Series that have not been updated for PrometheusSeriesTTL seconds are no longer served.
+	MetricsBackend      string `envconfig:"metrics_backend" default:"stackdriver"`
+	PrometheusPort      int    `envconfig:"prometheus_port" default:"9273"`
+	PrometheusSeriesTTL int    `envconfig:"prometheus_series_ttl" default:"300"`
+	// LogsBackend is where logs go: "stackdriver" (Stackdriver Logging) or "otlp".
+	LogsBackend string `envconfig:"logs_backend" default:"stackdriver"`
+	// OTLPEndpoint is the OTLP/gRPC address (host:port) of the OpenTelemetry collector for the "otlp" backends. The
+	// connection uses TLS unless OTLPInsecure is set.
+	OTLPEndpoint string `envconfig:"otlp_endpoint"`
+	OTLPInsecure bool   `envconfig:"otlp_insecure"`
+	// With DryRun, nothing is sent to Stackdriver (or the backends above): the log entries, metric descriptors and
+	// time series the nozzle would send are written as newline-delimited JSON to DryRunFile, or stdout if unset (and
+	// the nozzle's logs then go to stderr).
+	DryRun     bool   `envconfig:"dry_run"`
+	DryRunFile string `envconfig:"dry_run_file"`
+	// If SpoolDir is set, logs and metrics for the Stackdriver backends are written ahead to files in this directory
+	// and delivered from there, so they survive Stackdriver outages and restarts. Logs and metrics each get up to
+	// SpoolMaxSize MiB in segment files of SpoolSegmentSize MiB; new data is dropped while the spool is full.
+	SpoolDir         string `envconfig:"spool_dir"`
+	SpoolMaxSize     int    `envconfig:"spool_max_size" default:"1024"`
+	SpoolSegmentSize int    `envconfig:"spool_segment_size" default:"16"`
 	// Expire internal counter state if a given counter has not been seen for this many seconds.
 	CounterTrackerTTL int `envconfig:"counter_tracker_ttl" default:"130"`
+	// If set, internal counter state is saved to this file every CounterTrackerSnapshotPeriod seconds and restored
+	// on startup (unless older than CounterTrackerTTL), so cumulative metrics stay continuous across restarts.
+	CounterTrackerSnapshotFile   string `envconfig:"counter_tracker_snapshot_file"`
+	CounterTrackerSnapshotPeriod int    `envconfig:"counter_tracker_snapshot_period" default:"30"`
 
 	// Event blacklists / whitelists are too complex to stuff into environment
 	// vars, so instead they are templated from the manifest YAML into a JSON
 	// file which is loaded by the nozzle. Nil pointers are empty blacklists.
 	EventFilterFile string `envconfig:"event_filter_file" default:""`
 	EventFilterJSON *EventFilterJSON
+
+	// Rules for the metrics pipeline (e.g. pre-aggregation across app
+	// instances) are templated into a JSON file in the same way.
+	MetricsPipelineFile string `envconfig:"metrics_pipeline_file" default:""`
+	MetricsPipelineJSON *MetricsPipelineJSON
 }
 
-//TODO(evanbrown): Validate configs for both Firehose and RLP modes
+// TODO(evanbrown): Validate configs for both Firehose and RLP modes
 func (c *Config) validate() error {
 	if c.APIEndpoint == "" {
 		return errors.New("FIREHOSE_ENDPOINT is empty")
@@ -123,6 +240,35 @@ func (c *Config) validate() error {
 		return errors.New("FIREHOSE_EVENTS_TO_STACKDRIVER_LOGGING and FIREHOSE_EVENTS_TO_STACKDRIVER_MONITORING are empty")
 	}
 
+	if c.MetricsBackend != "stackdriver" && c.MetricsBackend != "otlp" && c.MetricsBackend != "prometheus" {
+		return fmt.Errorf("METRICS_BACKEND %q is not one of stackdriver, otlp, prometheus", c.MetricsBackend)
+	}
+	if c.LogsBackend != "stackdriver" && c.LogsBackend != "otlp" {
+		return fmt.Errorf("LOGS_BACKEND %q is not one of stackdriver, otlp", c.LogsBackend)
+	}
+	if (c.MetricsBackend == "otlp" || c.LogsBackend == "otlp") && c.OTLPEndpoint == "" {
+		return errors.New("OTLP_ENDPOINT is empty")
+	}
+	if c.MetricDescriptorPolicy != "report" && c.MetricDescriptorPolicy != "recreate" {
+		return fmt.Errorf("METRIC_DESCRIPTOR_POLICY %q is not one of report, recreate", c.MetricDescriptorPolicy)
+	}
+
+	if c.SpoolDir != "" && (c.SpoolSegmentSize <= 0 || c.SpoolMaxSize < c.SpoolSegmentSize) {
+		return fmt.Errorf("SPOOL_MAX_SIZE %d must be at least SPOOL_SEGMENT_SIZE %d, which must be positive", c.SpoolMaxSize, c.SpoolSegmentSize)
+	}
+
+	if c.EnableCounterSharding {
+		if c.CounterShardingSelf == "" {
+			return errors.New("COUNTER_SHARDING_SELF is empty")
+		}
+		if c.CounterShardingPeers == "" && c.CounterShardingPeersDNS == "" {
+			return errors.New("COUNTER_SHARDING_PEERS and COUNTER_SHARDING_PEERS_DNS are empty")
+		}
+		if c.CounterShardingSecret == "" {
+			return errors.New("COUNTER_SHARDING_SECRET is empty")
+		}
+	}
+
 	return nil
 }
 
@@ -130,6 +276,15 @@ func (c *Config) ensureProjectID() error {
 	if c.ProjectID != "" {
 		return nil
 	}
+	if c.DryRun && !metadata.OnGCE() {
+		// Only used to render resource names.
+		c.ProjectID = dryRunProjectID
+		return nil
+	}
+	if !c.DryRun && c.MetricsBackend != "stackdriver" && c.LogsBackend != "stackdriver" {
+		// Nothing is sent to Stackdriver.
+		return nil
+	}
 
 	projectID, err := metadata.ProjectID()
 	if err != nil {
@@ -188,6 +343,71 @@ func (c *Config) parseEventFilterJSON(r io.Reader) error {
 	return json.Unmarshal(data, c.EventFilterJSON)
 }
 
+// A MetricAggregationRule rolls up metrics whose name matches Regexp across
+// the given label keys, e.g. to report one series per app instead of one per
+// app instance.
+type MetricAggregationRule struct {
+	// Must be a valid regular expression matching the full metric name,
+	// including the metric path prefix.
+	Regexp string `json:"regexp"`
+	// Label keys to aggregate across; they are removed from the output series.
+	Labels []string `json:"labels"`
+	// Must be one of "sum", "mean", "max", "min" or "count".
+	Aggregation string `json:"aggregation"`
+}
+
+func (r MetricAggregationRule) String() string {
+	return fmt.Sprintf("%s of %q across %v", r.Aggregation, r.Regexp, r.Labels)
+}
+
+// A MetricWindowPolicy selects how points of metrics whose name matches Regexp
+// are combined in each metrics buffer window, e.g. to report the peak of a
+// spiky gauge rather than its last value.
+type MetricWindowPolicy struct {
+	// Must be a valid regular expression matching the full metric name,
+	// including the metric path prefix.
+	Regexp string `json:"regexp"`
+	// Must be one of "last", "sum", "mean", "max", "min" or "count".
+	Aggregation string `json:"aggregation"`
+}
+
+func (p MetricWindowPolicy) String() string {
+	return fmt.Sprintf("%s of %q", p.Aggregation, p.Regexp)
+}
+
+type MetricsPipelineJSON struct {
+	Aggregations   []MetricAggregationRule `json:"aggregations,omitempty"`
+	WindowPolicies []MetricWindowPolicy    `json:"window_policies,omitempty"`
+}
+
+func (c *Config) maybeLoadMetricsPipelineFile() error {
+	if c.MetricsPipelineFile == "" {
+		return nil
+	}
+	fh, err := os.Open(c.MetricsPipelineFile)
+	if err != nil {
+		return err
+	}
+
+	if err := c.parseMetricsPipelineJSON(fh); err != nil {
+		return err
+	}
+
+	return fh.Close()
+}
+
+func (c *Config) parseMetricsPipelineJSON(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	c.MetricsPipelineJSON = &MetricsPipelineJSON{}
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, c.MetricsPipelineJSON)
+}
+
 // If running on GCE, this will set the nozzle's ID, name, and zone to
 // the GCE instance's values.
 func (c *Config) setNozzleHostInfo() {
@@ -220,5 +440,7 @@ func (c *Config) ToData() lager.Data {
 		"SubscriptionID":                c.SubscriptionID,
 		"DebugNozzle":                   c.DebugNozzle,
 		"NewlineToken":                  c.NewlineToken,
+		"DryRun":                        c.DryRun,
+		"SpoolDir":                      c.SpoolDir,
 	}
 }
@@ -117,6 +117,103 @@ var _ = Describe("Config", func() {
 		})
 	})
 
+	Describe("metrics backend", func() {
+		AfterEach(func() {
+			os.Unsetenv("METRICS_BACKEND")
+		})
+		It("defaults to stackdriver", func() {
+			c, err := NewConfig()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.MetricsBackend).To(Equal("stackdriver"))
+		})
+		It("accepts prometheus", func() {
+			os.Setenv("METRICS_BACKEND", "prometheus")
+			_, err := NewConfig()
+			Expect(err).NotTo(HaveOccurred())
+		})
+		It("rejects unknown backends", func() {
+			os.Setenv("METRICS_BACKEND", "graphite")
+			_, err := NewConfig()
+			Expect(err).To(HaveOccurred())
+		})
+		It("needs no project without Stackdriver backends", func() {
+			os.Setenv("METRICS_BACKEND", "prometheus")
+			os.Setenv("LOGS_BACKEND", "otlp")
+			os.Setenv("OTLP_ENDPOINT", "localhost:4317")
+			os.Setenv("GCP_PROJECT_ID", "")
+			defer os.Unsetenv("LOGS_BACKEND")
+			defer os.Unsetenv("OTLP_ENDPOINT")
+			c, err := NewConfig()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.ProjectID).To(BeEmpty())
+		})
+		It("requires an endpoint for otlp", func() {
+			os.Setenv("METRICS_BACKEND", "otlp")
+			_, err := NewConfig()
+			Expect(err).To(HaveOccurred())
+
+			os.Setenv("OTLP_ENDPOINT", "localhost:4317")
+			defer os.Unsetenv("OTLP_ENDPOINT")
+			_, err = NewConfig()
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	It("rejects unknown metric descriptor policies", func() {
+		os.Setenv("METRIC_DESCRIPTOR_POLICY", "ignore")
+		defer os.Unsetenv("METRIC_DESCRIPTOR_POLICY")
+		_, err := NewConfig()
+		Expect(err).To(MatchError(ContainSubstring("METRIC_DESCRIPTOR_POLICY")))
+
+		os.Setenv("METRIC_DESCRIPTOR_POLICY", "recreate")
+		_, err = NewConfig()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects spool segments larger than the spool", func() {
+		os.Setenv("SPOOL_DIR", "/var/vcap/data/stackdriver-nozzle/spool")
+		os.Setenv("SPOOL_MAX_SIZE", "8")
+		defer os.Unsetenv("SPOOL_DIR")
+		defer os.Unsetenv("SPOOL_MAX_SIZE")
+		_, err := NewConfig()
+		Expect(err).To(MatchError(ContainSubstring("SPOOL_MAX_SIZE")))
+
+		os.Setenv("SPOOL_SEGMENT_SIZE", "4")
+		defer os.Unsetenv("SPOOL_SEGMENT_SIZE")
+		_, err = NewConfig()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("defaults the nozzle instance to NOZZLE_ID", func() {
+		os.Setenv("NOZZLE_ID", "nozzle-0")
+		defer os.Unsetenv("NOZZLE_ID")
+		c, err := NewConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.NozzleInstance).To(Equal("nozzle-0"))
+
+		os.Setenv("NOZZLE_INSTANCE", "bosh-instance-id")
+		defer os.Unsetenv("NOZZLE_INSTANCE")
+		c, err = NewConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.NozzleInstance).To(Equal("bosh-instance-id"))
+	})
+
+	It("requires a secret for counter sharding", func() {
+		os.Setenv("ENABLE_COUNTER_SHARDING", "true")
+		os.Setenv("COUNTER_SHARDING_SELF", "10.0.0.1")
+		os.Setenv("COUNTER_SHARDING_PEERS", "10.0.0.1,10.0.0.2")
+		defer os.Unsetenv("ENABLE_COUNTER_SHARDING")
+		defer os.Unsetenv("COUNTER_SHARDING_SELF")
+		defer os.Unsetenv("COUNTER_SHARDING_PEERS")
+		_, err := NewConfig()
+		Expect(err).To(MatchError(ContainSubstring("COUNTER_SHARDING_SECRET")))
+
+		os.Setenv("COUNTER_SHARDING_SECRET", "secret")
+		defer os.Unsetenv("COUNTER_SHARDING_SECRET")
+		_, err = NewConfig()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
 	DescribeTable("parses empty-but-valid JSON files without errors", func(data string) {
 		c, err := NewConfig()
 		Expect(err).To(BeNil())
@@ -150,4 +247,24 @@ var _ = Describe("Config", func() {
 		Expect(c.EventFilterJSON.Blacklist).To(HaveLen(2))
 		Expect(c.EventFilterJSON.Whitelist).To(HaveLen(1))
 	})
+
+	It("parses valid metrics pipeline JSON", func() {
+		c, err := NewConfig()
+		Expect(err).To(BeNil())
+		b := bytes.NewBufferString(`{"aggregations": [{"regexp": "cpuPercentage$", "labels": ["instanceIndex"], "aggregation": "max"}]}`)
+		Expect(c.parseMetricsPipelineJSON(b)).To(BeNil())
+		Expect(c.MetricsPipelineJSON.Aggregations).To(Equal([]MetricAggregationRule{
+			{Regexp: "cpuPercentage$", Labels: []string{"instanceIndex"}, Aggregation: "max"},
+		}))
+	})
+
+	It("parses metric window policies", func() {
+		c, err := NewConfig()
+		Expect(err).To(BeNil())
+		b := bytes.NewBufferString(`{"window_policies": [{"regexp": "latency$", "aggregation": "max"}]}`)
+		Expect(c.parseMetricsPipelineJSON(b)).To(BeNil())
+		Expect(c.MetricsPipelineJSON.WindowPolicies).To(Equal([]MetricWindowPolicy{
+			{Regexp: "latency$", Aggregation: "max"},
+		}))
+	})
 })
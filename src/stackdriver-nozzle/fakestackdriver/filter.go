@@ -0,0 +1,88 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fakestackdriver
+
+import (
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	filterAnd    = regexp.MustCompile(`\s+AND\s+`)
+	filterClause = regexp.MustCompile(`^\s*([\w.]+)\s*=\s*(?:"([^"]*)"|starts_with\(\s*"([^"]*)"\s*\))\s*$`)
+)
+
+// A filter is the subset of the Stackdriver filter language made of
+// `field = "value"` and `field = starts_with("prefix")` clauses joined by AND.
+type filter []clause
+
+type clause struct {
+	field  string
+	value  string
+	prefix bool
+}
+
+func parseFilter(s string) (filter, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var f filter
+	for _, part := range filterAnd.Split(strings.TrimSpace(s), -1) {
+		m := filterClause.FindStringSubmatchIndex(part)
+		if m == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported filter %q", s)
+		}
+		field := part[m[2]:m[3]]
+		if m[6] >= 0 {
+			f = append(f, clause{field: field, value: part[m[6]:m[7]], prefix: true})
+		} else {
+			f = append(f, clause{field: field, value: part[m[4]:m[5]]})
+		}
+	}
+	return f, nil
+}
+
+// matches reports whether every clause matches the value field returns for
+// its field; missing fields never match.
+func (f filter) matches(field func(name string) (string, bool)) bool {
+	for _, c := range f {
+		v, ok := field(c.field)
+		if !ok {
+			return false
+		}
+		if c.prefix && !strings.HasPrefix(v, c.value) || !c.prefix && v != c.value {
+			return false
+		}
+	}
+	return true
+}
+
+// labelField looks up `<prefix>.label.<key>` or `<prefix>.labels.<key>` in
+// labels.
+func labelField(name, prefix string, labels map[string]string) (string, bool) {
+	for _, p := range []string{prefix + ".label.", prefix + ".labels."} {
+		if strings.HasPrefix(name, p) {
+			v, ok := labels[strings.TrimPrefix(name, p)]
+			return v, ok
+		}
+	}
+	return "", false
+}
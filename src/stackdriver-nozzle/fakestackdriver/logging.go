@@ -0,0 +1,146 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fakestackdriver
+
+import (
+	"context"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+	logging "google.golang.org/genproto/googleapis/logging/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// LogEntries returns the stored log entries, in the order they were written.
+func (s *Server) LogEntries() []*logging.LogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []*logging.LogEntry
+	for _, e := range s.logEntries {
+		result = append(result, proto.Clone(e).(*logging.LogEntry))
+	}
+	return result
+}
+
+// loggingService implements logging.LoggingServiceV2Server on a Server.
+type loggingService struct {
+	*Server
+}
+
+func (s *loggingService) DeleteLog(context.Context, *logging.DeleteLogRequest) (*empty.Empty, error) {
+	return nil, status.Error(codes.Unimplemented, "not implemented by fakestackdriver")
+}
+
+func (s *loggingService) ListMonitoredResourceDescriptors(context.Context, *logging.ListMonitoredResourceDescriptorsRequest) (*logging.ListMonitoredResourceDescriptorsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "not implemented by fakestackdriver")
+}
+
+func (s *loggingService) ListLogs(context.Context, *logging.ListLogsRequest) (*logging.ListLogsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "not implemented by fakestackdriver")
+}
+
+// WriteLogEntries stores the entries of a request, completed with its log
+// name, resource and labels.
+func (s *loggingService) WriteLogEntries(ctx context.Context, req *logging.WriteLogEntriesRequest) (*logging.WriteLogEntriesResponse, error) {
+	var entries []*logging.LogEntry
+	for _, e := range req.Entries {
+		e = proto.Clone(e).(*logging.LogEntry)
+		if e.LogName == "" {
+			e.LogName = req.LogName
+		}
+		if e.Resource == nil {
+			e.Resource = req.Resource
+		}
+		if len(req.Labels) > 0 {
+			labels := map[string]string{}
+			for k, v := range req.Labels {
+				labels[k] = v
+			}
+			for k, v := range e.Labels {
+				labels[k] = v
+			}
+			e.Labels = labels
+		}
+		if e.LogName == "" || e.Resource == nil {
+			return nil, status.Error(codes.InvalidArgument, "Log entries must have a log name and a resource.")
+		}
+		entries = append(entries, e)
+	}
+	if req.DryRun {
+		return &logging.WriteLogEntriesResponse{}, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logEntries = append(s.logEntries, entries...)
+	return &logging.WriteLogEntriesResponse{}, nil
+}
+
+func (s *loggingService) ListLogEntries(ctx context.Context, req *logging.ListLogEntriesRequest) (*logging.ListLogEntriesResponse, error) {
+	f, err := parseFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matching []*logging.LogEntry
+	for _, e := range s.logEntries {
+		if inResources(e.LogName, req.ResourceNames) && f.matches(entryField(e)) {
+			matching = append(matching, proto.Clone(e).(*logging.LogEntry))
+		}
+	}
+	low, high, next, err := page(len(matching), req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	return &logging.ListLogEntriesResponse{Entries: matching[low:high], NextPageToken: next}, nil
+}
+
+func inResources(logName string, resourceNames []string) bool {
+	for _, r := range resourceNames {
+		if strings.HasPrefix(logName, r+"/") {
+			return true
+		}
+	}
+	return len(resourceNames) == 0
+}
+
+func entryField(e *logging.LogEntry) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		switch name {
+		case "logName":
+			return e.LogName, true
+		case "severity":
+			return e.Severity.String(), true
+		case "resource.type":
+			return e.Resource.Type, true
+		}
+		if v, ok := labelField(name, "resource", e.Resource.Labels); ok {
+			return v, true
+		}
+		if strings.HasPrefix(name, "labels.") {
+			v, ok := e.Labels[strings.TrimPrefix(name, "labels.")]
+			return v, ok
+		}
+		return "", false
+	}
+}
@@ -0,0 +1,401 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fakestackdriver
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/genproto/googleapis/api/label"
+	"google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// series is a stored time series. Its header has no points; points are
+// newest first, as the API returns them.
+type series struct {
+	header *monitoring.TimeSeries
+	points []*monitoring.Point
+}
+
+// MetricDescriptors returns the stored metric descriptors, by type.
+func (s *Server) MetricDescriptors() []*metric.MetricDescriptor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedDescriptors()
+}
+
+// TimeSeries returns the stored time series, with all their points, in the
+// order they were first written.
+func (s *Server) TimeSeries() []*monitoring.TimeSeries {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []*monitoring.TimeSeries
+	for _, key := range s.seriesOrder {
+		sr := s.series[key]
+		ts := proto.Clone(sr.header).(*monitoring.TimeSeries)
+		for _, p := range sr.points {
+			ts.Points = append(ts.Points, proto.Clone(p).(*monitoring.Point))
+		}
+		result = append(result, ts)
+	}
+	return result
+}
+
+func (s *Server) sortedDescriptors() []*metric.MetricDescriptor {
+	var result []*metric.MetricDescriptor
+	for _, d := range s.descriptors {
+		result = append(result, proto.Clone(d).(*metric.MetricDescriptor))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Type < result[j].Type })
+	return result
+}
+
+// metricService implements monitoring.MetricServiceServer on a Server.
+type metricService struct {
+	*Server
+}
+
+func (s *metricService) ListMonitoredResourceDescriptors(context.Context, *monitoring.ListMonitoredResourceDescriptorsRequest) (*monitoring.ListMonitoredResourceDescriptorsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "not implemented by fakestackdriver")
+}
+
+func (s *metricService) GetMonitoredResourceDescriptor(context.Context, *monitoring.GetMonitoredResourceDescriptorRequest) (*monitoredres.MonitoredResourceDescriptor, error) {
+	return nil, status.Error(codes.Unimplemented, "not implemented by fakestackdriver")
+}
+
+func (s *metricService) ListMetricDescriptors(ctx context.Context, req *monitoring.ListMetricDescriptorsRequest) (*monitoring.ListMetricDescriptorsResponse, error) {
+	f, err := parseFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matching []*metric.MetricDescriptor
+	for _, d := range s.sortedDescriptors() {
+		if strings.HasPrefix(d.Name, req.Name+"/") && f.matches(descriptorField(d)) {
+			matching = append(matching, d)
+		}
+	}
+	low, high, next, err := page(len(matching), req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	return &monitoring.ListMetricDescriptorsResponse{MetricDescriptors: matching[low:high], NextPageToken: next}, nil
+}
+
+func (s *metricService) GetMetricDescriptor(ctx context.Context, req *monitoring.GetMetricDescriptorRequest) (*metric.MetricDescriptor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.descriptors[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Could not find descriptor for metric '%s'.", req.Name)
+	}
+	return proto.Clone(d).(*metric.MetricDescriptor), nil
+}
+
+func (s *metricService) CreateMetricDescriptor(ctx context.Context, req *monitoring.CreateMetricDescriptorRequest) (*metric.MetricDescriptor, error) {
+	d := req.MetricDescriptor
+	switch {
+	case d == nil || d.Type == "":
+		return nil, status.Error(codes.InvalidArgument, "Field metricDescriptor.type is required.")
+	case d.MetricKind == metric.MetricDescriptor_METRIC_KIND_UNSPECIFIED:
+		return nil, status.Error(codes.InvalidArgument, "Field metricDescriptor.metricKind is required.")
+	case d.ValueType == metric.MetricDescriptor_VALUE_TYPE_UNSPECIFIED:
+		return nil, status.Error(codes.InvalidArgument, "Field metricDescriptor.valueType is required.")
+	}
+
+	d = proto.Clone(d).(*metric.MetricDescriptor)
+	d.Name = descriptorName(req.Name, d.Type)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.descriptors[d.Name] = d
+	delete(s.autoDescriptors, d.Name)
+	return proto.Clone(d).(*metric.MetricDescriptor), nil
+}
+
+func (s *metricService) DeleteMetricDescriptor(ctx context.Context, req *monitoring.DeleteMetricDescriptorRequest) (*empty.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.descriptors[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Could not find descriptor for metric '%s'.", req.Name)
+	}
+	delete(s.descriptors, req.Name)
+	delete(s.autoDescriptors, req.Name)
+
+	// Deleting a descriptor deletes its data.
+	var order []string
+	for _, key := range s.seriesOrder {
+		if s.series[key].header.Metric.Type == d.Type {
+			delete(s.series, key)
+		} else {
+			order = append(order, key)
+		}
+	}
+	s.seriesOrder = order
+	return &empty.Empty{}, nil
+}
+
+func (s *metricService) ListTimeSeries(ctx context.Context, req *monitoring.ListTimeSeriesRequest) (*monitoring.ListTimeSeriesResponse, error) {
+	if req.Filter == "" {
+		return nil, status.Error(codes.InvalidArgument, "Field filter is required.")
+	}
+	if req.Interval == nil || req.Interval.EndTime == nil {
+		return nil, status.Error(codes.InvalidArgument, "Field interval.endTime is required.")
+	}
+	f, err := parseFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	end := timeOf(req.Interval.EndTime)
+	start := end
+	if req.Interval.StartTime != nil {
+		start = timeOf(req.Interval.StartTime)
+	}
+	inInterval := func(p *monitoring.Point) bool {
+		t := timeOf(p.Interval.EndTime)
+		return !t.After(end) && (t.After(start) || t.Equal(start) && start.Equal(end))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matching []*monitoring.TimeSeries
+	for _, key := range s.seriesOrder {
+		sr := s.series[key]
+		if !f.matches(seriesField(sr.header)) {
+			continue
+		}
+		ts := proto.Clone(sr.header).(*monitoring.TimeSeries)
+		var found bool
+		for _, p := range sr.points {
+			if inInterval(p) {
+				found = true
+				if req.View != monitoring.ListTimeSeriesRequest_HEADERS {
+					ts.Points = append(ts.Points, proto.Clone(p).(*monitoring.Point))
+				}
+			}
+		}
+		if found {
+			matching = append(matching, ts)
+		}
+	}
+	low, high, next, err := page(len(matching), req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	return &monitoring.ListTimeSeriesResponse{TimeSeries: matching[low:high], NextPageToken: next}, nil
+}
+
+// CreateTimeSeries writes the valid time series of a request, and like the
+// real API fails with an error describing all the invalid ones.
+func (s *metricService) CreateTimeSeries(ctx context.Context, req *monitoring.CreateTimeSeriesRequest) (*empty.Empty, error) {
+	if len(req.TimeSeries) > maxTimeSeriesPerRequest {
+		return nil, status.Errorf(codes.InvalidArgument, "Field timeSeries had an invalid value: A maximum of %d TimeSeries can be written in a single request.", maxTimeSeriesPerRequest)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []string
+	seen := map[string]bool{}
+	for i, ts := range req.TimeSeries {
+		if err := s.writeTimeSeries(req.Name, ts, seen); err != "" {
+			errs = append(errs, fmt.Sprintf("%s: timeSeries[%d]", err, i))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "One or more TimeSeries could not be written: %s", strings.Join(errs, "; "))
+	}
+	return &empty.Empty{}, nil
+}
+
+// writeTimeSeries stores ts, creating its descriptor if needed, or returns why
+// it is invalid.
+func (s *Server) writeTimeSeries(project string, ts *monitoring.TimeSeries, seen map[string]bool) string {
+	if ts.Metric == nil || ts.Metric.Type == "" {
+		return "Field metric.type is required."
+	}
+	if len(ts.Points) != 1 {
+		return "Field points had an invalid value: Only one point can be written per TimeSeries per request."
+	}
+	point := ts.Points[0]
+	if point.Interval == nil || point.Interval.EndTime == nil {
+		return "Field points[0].interval.endTime is required."
+	}
+	valueType := valueTypeOf(point.Value)
+	if valueType == metric.MetricDescriptor_VALUE_TYPE_UNSPECIFIED {
+		return "Field points[0].value is required."
+	}
+
+	key := seriesKey(ts)
+	if seen[key] {
+		return "Field timeSeries had an invalid value: Duplicate TimeSeries encountered. Only one point can be written per TimeSeries per request."
+	}
+	seen[key] = true
+
+	name := descriptorName(project, ts.Metric.Type)
+	d, ok := s.descriptors[name]
+	if !ok {
+		// Like Stackdriver, create descriptors for metrics written without one.
+		d = &metric.MetricDescriptor{Name: name, Type: ts.Metric.Type, MetricKind: ts.MetricKind, ValueType: valueType}
+		if d.MetricKind == metric.MetricDescriptor_METRIC_KIND_UNSPECIFIED {
+			d.MetricKind = metric.MetricDescriptor_GAUGE
+		}
+		for k := range ts.Metric.Labels {
+			d.Labels = append(d.Labels, labelDescriptor(k))
+		}
+		sort.Slice(d.Labels, func(i, j int) bool { return d.Labels[i].Key < d.Labels[j].Key })
+		s.descriptors[name] = d
+		s.autoDescriptors[name] = true
+	}
+	if ts.MetricKind != metric.MetricDescriptor_METRIC_KIND_UNSPECIFIED && ts.MetricKind != d.MetricKind {
+		return fmt.Sprintf("Field metricKind had an invalid value of %q: must match the metric descriptor kind %q.", ts.MetricKind, d.MetricKind)
+	}
+	if valueType != d.ValueType {
+		return fmt.Sprintf("Field points[0].value had an invalid value of %q: must match the metric descriptor value type %q.", valueType, d.ValueType)
+	}
+	known := map[string]bool{}
+	for _, l := range d.Labels {
+		known[l.Key] = true
+	}
+	for k, v := range ts.Metric.Labels {
+		if !known[k] && s.autoDescriptors[name] {
+			// Automatically created descriptors gain new labels.
+			d.Labels = append(d.Labels, labelDescriptor(k))
+		} else if !known[k] {
+			return fmt.Sprintf("Field metric.labels[%s] had an invalid value of %q: Unrecognized metric label.", k, v)
+		}
+	}
+
+	sr, ok := s.series[key]
+	if !ok {
+		header := proto.Clone(ts).(*monitoring.TimeSeries)
+		header.Points = nil
+		header.MetricKind = d.MetricKind
+		header.ValueType = d.ValueType
+		sr = &series{header: header}
+		s.series[key] = sr
+		s.seriesOrder = append(s.seriesOrder, key)
+	} else if !timeOf(point.Interval.EndTime).After(timeOf(sr.points[0].Interval.EndTime)) {
+		return "Points must be written in order. One or more of the points specified had an older start time than the most recent point."
+	}
+	sr.points = append([]*monitoring.Point{proto.Clone(point).(*monitoring.Point)}, sr.points...)
+	return ""
+}
+
+func descriptorName(project, metricType string) string {
+	return path.Join(project, "metricDescriptors", metricType)
+}
+
+func labelDescriptor(key string) *label.LabelDescriptor {
+	return &label.LabelDescriptor{Key: key, ValueType: label.LabelDescriptor_STRING}
+}
+
+func valueTypeOf(v *monitoring.TypedValue) metric.MetricDescriptor_ValueType {
+	if v == nil {
+		return metric.MetricDescriptor_VALUE_TYPE_UNSPECIFIED
+	}
+	switch v.Value.(type) {
+	case *monitoring.TypedValue_BoolValue:
+		return metric.MetricDescriptor_BOOL
+	case *monitoring.TypedValue_Int64Value:
+		return metric.MetricDescriptor_INT64
+	case *monitoring.TypedValue_DoubleValue:
+		return metric.MetricDescriptor_DOUBLE
+	case *monitoring.TypedValue_StringValue:
+		return metric.MetricDescriptor_STRING
+	case *monitoring.TypedValue_DistributionValue:
+		return metric.MetricDescriptor_DISTRIBUTION
+	}
+	return metric.MetricDescriptor_VALUE_TYPE_UNSPECIFIED
+}
+
+// seriesKey identifies a time series by its metric and resource.
+func seriesKey(ts *monitoring.TimeSeries) string {
+	key := ts.Metric.Type + flatten(ts.Metric.Labels)
+	if ts.Resource != nil {
+		key += "|" + ts.Resource.Type + flatten(ts.Resource.Labels)
+	}
+	return key
+}
+
+func flatten(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, ",%q=%q", k, labels[k])
+	}
+	return b.String()
+}
+
+func descriptorField(d *metric.MetricDescriptor) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		if name == "metric.type" {
+			return d.Type, true
+		}
+		return "", false
+	}
+}
+
+func seriesField(ts *monitoring.TimeSeries) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		switch name {
+		case "metric.type":
+			return ts.Metric.Type, true
+		case "resource.type":
+			if ts.Resource == nil {
+				return "", false
+			}
+			return ts.Resource.Type, true
+		}
+		if v, ok := labelField(name, "metric", ts.Metric.Labels); ok {
+			return v, true
+		}
+		if ts.Resource != nil {
+			return labelField(name, "resource", ts.Resource.Labels)
+		}
+		return "", false
+	}
+}
+
+func timeOf(ts *timestamp.Timestamp) time.Time {
+	return time.Unix(ts.Seconds, int64(ts.Nanos))
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fakestackdriver is an in-memory implementation of the Stackdriver
+// Monitoring MetricService and Logging LoggingServiceV2 gRPC APIs, for tests
+// that exercise the real Stackdriver clients without network access.
+//
+// The fake keeps everything it is sent and can be queried through the API
+// (with a subset of the filter language) or directly. Errors and latency can
+// be injected per method.
+package fakestackdriver
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/api/metric"
+	logging "google.golang.org/genproto/googleapis/logging/v2"
+	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Full names of the methods errors and latency can be injected into.
+const (
+	CreateTimeSeries       = "/google.monitoring.v3.MetricService/CreateTimeSeries"
+	ListTimeSeries         = "/google.monitoring.v3.MetricService/ListTimeSeries"
+	CreateMetricDescriptor = "/google.monitoring.v3.MetricService/CreateMetricDescriptor"
+	GetMetricDescriptor    = "/google.monitoring.v3.MetricService/GetMetricDescriptor"
+	ListMetricDescriptors  = "/google.monitoring.v3.MetricService/ListMetricDescriptors"
+	DeleteMetricDescriptor = "/google.monitoring.v3.MetricService/DeleteMetricDescriptor"
+	WriteLogEntries        = "/google.logging.v2.LoggingServiceV2/WriteLogEntries"
+	ListLogEntries         = "/google.logging.v2.LoggingServiceV2/ListLogEntries"
+)
+
+// Errors as returned by Stackdriver, for use with FailNext.
+var (
+	ErrQuotaExceeded   = status.Error(codes.ResourceExhausted, "Quota exceeded for quota metric 'Time series ingestion requests' and limit 'Time series ingestion requests per minute' of service 'monitoring.googleapis.com'.")
+	ErrOutOfOrder      = status.Error(codes.InvalidArgument, "One or more TimeSeries could not be written: Points must be written in order. One or more of the points specified had an older start time than the most recent point.: timeSeries[0]")
+	ErrInvalidArgument = status.Error(codes.InvalidArgument, "Request contains an invalid argument.")
+	ErrUnavailable     = status.Error(codes.Unavailable, "The service is currently unavailable.")
+)
+
+// maxTimeSeriesPerRequest is the Stackdriver limit on CreateTimeSeries.
+const maxTimeSeriesPerRequest = 200
+
+type fault struct {
+	err   error
+	times int
+}
+
+// Server is a fake Stackdriver API server.
+type Server struct {
+	grpcServer *grpc.Server
+	listener   net.Listener
+
+	mu              sync.Mutex // protects everything below
+	descriptors     map[string]*metric.MetricDescriptor
+	autoDescriptors map[string]bool // names of descriptors created by writing time series
+	series          map[string]*series
+	seriesOrder     []string
+	logEntries      []*logging.LogEntry
+	requests        map[string]int
+	faults          map[string][]*fault
+	latency         map[string]time.Duration
+}
+
+// NewServer starts a Server on a free localhost port.
+func NewServer() (*Server, error) {
+	return Listen("127.0.0.1:0")
+}
+
+// Listen starts a Server listening on addr.
+func Listen(addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{listener: listener}
+	s.Reset()
+	s.grpcServer = grpc.NewServer(grpc.UnaryInterceptor(s.intercept))
+	monitoring.RegisterMetricServiceServer(s.grpcServer, &metricService{s})
+	logging.RegisterLoggingServiceV2Server(s.grpcServer, &loggingService{s})
+	go s.grpcServer.Serve(listener)
+	return s, nil
+}
+
+// Addr is the host:port the Server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Stop stops the Server, closing open connections.
+func (s *Server) Stop() {
+	s.grpcServer.Stop()
+}
+
+// Reset forgets all stored data, request counts, faults and latencies.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.descriptors = map[string]*metric.MetricDescriptor{}
+	s.autoDescriptors = map[string]bool{}
+	s.series = map[string]*series{}
+	s.seriesOrder = nil
+	s.logEntries = nil
+	s.requests = map[string]int{}
+	s.faults = map[string][]*fault{}
+	s.latency = map[string]time.Duration{}
+}
+
+// FailNext makes the next `times` calls of method fail with err, after any
+// errors injected before.
+func (s *Server) FailNext(method string, err error, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[method] = append(s.faults[method], &fault{err: err, times: times})
+}
+
+// SetLatency delays every call of method by d.
+func (s *Server) SetLatency(method string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency[method] = d
+}
+
+// Requests is the number of calls of method received, including failed ones.
+func (s *Server) Requests(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method]
+}
+
+func (s *Server) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	s.mu.Lock()
+	s.requests[info.FullMethod]++
+	latency := s.latency[info.FullMethod]
+	var err error
+	if faults := s.faults[info.FullMethod]; len(faults) > 0 {
+		err = faults[0].err
+		if faults[0].times--; faults[0].times <= 0 {
+			s.faults[info.FullMethod] = faults[1:]
+		}
+	}
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// page returns the bounds of the page of n results selected by a request's
+// page size and token, and the token of the next page.
+func page(n int, pageSize int32, pageToken string) (low, high int, next string, err error) {
+	if pageToken != "" {
+		if low, err = strconv.Atoi(pageToken); err != nil || low < 0 || low > n {
+			return 0, 0, "", status.Errorf(codes.InvalidArgument, "invalid page token %q", pageToken)
+		}
+	}
+	high = n
+	if pageSize > 0 && low+int(pageSize) < n {
+		high = low + int(pageSize)
+		next = strconv.Itoa(high)
+	}
+	return low, high, next, nil
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fakestackdriver
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/genproto/googleapis/api/label"
+	"google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	logging "google.golang.org/genproto/googleapis/logging/v2"
+	monitoring "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const project = "projects/my-project"
+
+func gauge(metricType string, labels map[string]string, seconds int64, value float64) *monitoring.TimeSeries {
+	return &monitoring.TimeSeries{
+		Metric: &metric.Metric{Type: metricType, Labels: labels},
+		Points: []*monitoring.Point{{
+			Interval: &monitoring.TimeInterval{EndTime: &timestamp.Timestamp{Seconds: seconds}},
+			Value:    &monitoring.TypedValue{Value: &monitoring.TypedValue_DoubleValue{DoubleValue: value}},
+		}},
+	}
+}
+
+var _ = Describe("Server", func() {
+	var (
+		ctx        context.Context
+		subject    *Server
+		conn       *grpc.ClientConn
+		metrics    monitoring.MetricServiceClient
+		logEntries logging.LoggingServiceV2Client
+	)
+
+	write := func(series ...*monitoring.TimeSeries) error {
+		_, err := metrics.CreateTimeSeries(ctx, &monitoring.CreateTimeSeriesRequest{Name: project, TimeSeries: series})
+		return err
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		var err error
+		subject, err = NewServer()
+		Expect(err).NotTo(HaveOccurred())
+		conn, err = grpc.Dial(subject.Addr(), grpc.WithInsecure())
+		Expect(err).NotTo(HaveOccurred())
+		metrics = monitoring.NewMetricServiceClient(conn)
+		logEntries = logging.NewLoggingServiceV2Client(conn)
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		subject.Stop()
+	})
+
+	Context("time series", func() {
+		It("stores points and creates missing descriptors", func() {
+			Expect(write(gauge("custom.googleapis.com/a", map[string]string{"job": "router"}, 10, 1))).To(Succeed())
+			Expect(write(gauge("custom.googleapis.com/a", map[string]string{"job": "router"}, 20, 2))).To(Succeed())
+
+			series := subject.TimeSeries()
+			Expect(series).To(HaveLen(1))
+			Expect(series[0].MetricKind).To(Equal(metric.MetricDescriptor_GAUGE))
+			Expect(series[0].Points).To(HaveLen(2))
+			Expect(series[0].Points[0].Value.GetDoubleValue()).To(Equal(2.0), "newest point first")
+
+			descriptors := subject.MetricDescriptors()
+			Expect(descriptors).To(HaveLen(1))
+			Expect(descriptors[0].Name).To(Equal(project + "/metricDescriptors/custom.googleapis.com/a"))
+			Expect(descriptors[0].ValueType).To(Equal(metric.MetricDescriptor_DOUBLE))
+			Expect(descriptors[0].Labels).To(ConsistOf(&label.LabelDescriptor{Key: "job", ValueType: label.LabelDescriptor_STRING}))
+		})
+
+		It("rejects out of order points while writing the rest of the request", func() {
+			Expect(write(gauge("custom.googleapis.com/a", nil, 20, 1))).To(Succeed())
+
+			err := write(gauge("custom.googleapis.com/a", nil, 10, 2), gauge("custom.googleapis.com/b", nil, 10, 3))
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+			Expect(err.Error()).To(ContainSubstring("Points must be written in order"))
+			Expect(err.Error()).To(ContainSubstring("timeSeries[0]"))
+			Expect(subject.TimeSeries()).To(HaveLen(2))
+		})
+
+		It("rejects labels missing from created descriptors", func() {
+			_, err := metrics.CreateMetricDescriptor(ctx, &monitoring.CreateMetricDescriptorRequest{
+				Name: project,
+				MetricDescriptor: &metric.MetricDescriptor{
+					Type:       "custom.googleapis.com/a",
+					MetricKind: metric.MetricDescriptor_GAUGE,
+					ValueType:  metric.MetricDescriptor_DOUBLE,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = write(gauge("custom.googleapis.com/a", map[string]string{"job": "router"}, 10, 1))
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+			Expect(err.Error()).To(ContainSubstring("Unrecognized metric label"))
+		})
+
+		It("rejects more than 200 time series per request", func() {
+			var series []*monitoring.TimeSeries
+			for i := 0; i < 201; i++ {
+				series = append(series, gauge("custom.googleapis.com/a", map[string]string{"i": string(rune('a' + i))}, 10, 1))
+			}
+			Expect(status.Code(write(series...))).To(Equal(codes.InvalidArgument))
+		})
+
+		It("lists time series matching a filter and interval", func() {
+			Expect(write(gauge("custom.googleapis.com/a", map[string]string{"job": "router"}, 10, 1))).To(Succeed())
+			Expect(write(gauge("custom.googleapis.com/a", map[string]string{"job": "router"}, 20, 2))).To(Succeed())
+			Expect(write(gauge("custom.googleapis.com/a", map[string]string{"job": "cell"}, 10, 3))).To(Succeed())
+			Expect(write(gauge("custom.googleapis.com/b", nil, 10, 4))).To(Succeed())
+
+			resp, err := metrics.ListTimeSeries(ctx, &monitoring.ListTimeSeriesRequest{
+				Name:     project,
+				Filter:   `metric.type = "custom.googleapis.com/a" AND metric.label.job = starts_with("rou")`,
+				Interval: &monitoring.TimeInterval{StartTime: &timestamp.Timestamp{Seconds: 15}, EndTime: &timestamp.Timestamp{Seconds: 30}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.TimeSeries).To(HaveLen(1))
+			Expect(resp.TimeSeries[0].Points).To(HaveLen(1))
+			Expect(resp.TimeSeries[0].Points[0].Value.GetDoubleValue()).To(Equal(2.0))
+
+			_, err = metrics.ListTimeSeries(ctx, &monitoring.ListTimeSeriesRequest{Name: project, Filter: `metric.type > 1`, Interval: resp.TimeSeries[0].Points[0].Interval})
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		})
+	})
+
+	It("pages through metric descriptors", func() {
+		Expect(write(
+			gauge("custom.googleapis.com/a", nil, 10, 1),
+			gauge("custom.googleapis.com/b", nil, 10, 1),
+			gauge("custom.googleapis.com/c", nil, 10, 1),
+			gauge("other.googleapis.com/d", nil, 10, 1),
+		)).To(Succeed())
+
+		var types []string
+		req := &monitoring.ListMetricDescriptorsRequest{Name: project, Filter: `metric.type = starts_with("custom.googleapis.com/")`, PageSize: 2}
+		for {
+			resp, err := metrics.ListMetricDescriptors(ctx, req)
+			Expect(err).NotTo(HaveOccurred())
+			for _, d := range resp.MetricDescriptors {
+				types = append(types, d.Type)
+			}
+			if resp.NextPageToken == "" {
+				break
+			}
+			req.PageToken = resp.NextPageToken
+		}
+		Expect(types).To(Equal([]string{"custom.googleapis.com/a", "custom.googleapis.com/b", "custom.googleapis.com/c"}))
+
+		_, err := metrics.DeleteMetricDescriptor(ctx, &monitoring.DeleteMetricDescriptorRequest{Name: project + "/metricDescriptors/custom.googleapis.com/a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(subject.MetricDescriptors()).To(HaveLen(3))
+		Expect(subject.TimeSeries()).To(HaveLen(3))
+	})
+
+	It("stores and lists log entries", func() {
+		_, err := logEntries.WriteLogEntries(ctx, &logging.WriteLogEntriesRequest{
+			LogName:  project + "/logs/cf_logs",
+			Resource: &monitoredres.MonitoredResource{Type: "global"},
+			Labels:   map[string]string{"foundation": "cf"},
+			Entries: []*logging.LogEntry{
+				{Labels: map[string]string{"job": "router"}},
+				{Labels: map[string]string{"job": "cell"}},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(subject.LogEntries()).To(HaveLen(2))
+		Expect(subject.LogEntries()[0].Labels).To(Equal(map[string]string{"foundation": "cf", "job": "router"}))
+
+		resp, err := logEntries.ListLogEntries(ctx, &logging.ListLogEntriesRequest{ResourceNames: []string{project}, Filter: `labels.job = "cell"`})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Entries).To(HaveLen(1))
+		Expect(resp.Entries[0].LogName).To(Equal(project + "/logs/cf_logs"))
+	})
+
+	Context("faults", func() {
+		It("fails calls with injected errors", func() {
+			subject.FailNext(CreateTimeSeries, ErrQuotaExceeded, 2)
+			subject.FailNext(CreateTimeSeries, ErrUnavailable, 1)
+
+			Expect(status.Code(write(gauge("custom.googleapis.com/a", nil, 10, 1)))).To(Equal(codes.ResourceExhausted))
+			Expect(status.Code(write(gauge("custom.googleapis.com/a", nil, 10, 1)))).To(Equal(codes.ResourceExhausted))
+			Expect(status.Code(write(gauge("custom.googleapis.com/a", nil, 10, 1)))).To(Equal(codes.Unavailable))
+			Expect(write(gauge("custom.googleapis.com/a", nil, 10, 1))).To(Succeed())
+			Expect(subject.Requests(CreateTimeSeries)).To(Equal(4))
+			Expect(subject.TimeSeries()).To(HaveLen(1))
+		})
+
+		It("delays calls", func() {
+			subject.SetLatency(CreateTimeSeries, time.Hour)
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancel()
+
+			Expect(status.Code(write(gauge("custom.googleapis.com/a", nil, 10, 1)))).To(Equal(codes.DeadlineExceeded))
+			Expect(subject.TimeSeries()).To(BeEmpty())
+		})
+	})
+})
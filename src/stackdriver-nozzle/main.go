@@ -28,17 +28,22 @@ import (
 )
 
 func main() {
+	cfg, err := config.NewConfig()
+
 	logger := lager.NewLogger("stackdriver-nozzle")
-	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.DEBUG))
-	logger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.ERROR))
+	if err == nil && cfg.DryRun && cfg.DryRunFile == "" {
+		// Stdout is reserved for the dry-run output.
+		logger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.DEBUG))
+	} else {
+		logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.DEBUG))
+		logger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.ERROR))
+	}
 
-	cfg, err := config.NewConfig()
 	if err != nil {
 		logger.Fatal("config", err)
 	}
 
-	a := app.New(cfg, logger)
-
 	ctx := context.Background()
+	a := app.New(ctx, cfg, logger)
 	app.Run(ctx, a)
 }
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metricspipeline
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/stackdriver"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
+)
+
+var (
+	metricsAggregatedCount *telemetry.Counter
+)
+
+func init() {
+	metricsAggregatedCount = telemetry.NewCounter(telemetry.Nozzle, "metrics.aggregated.count")
+}
+
+type aggregation func(values []float64) float64
+
+var aggregations = map[string]aggregation{
+	"sum": func(values []float64) float64 {
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+	"mean": func(values []float64) float64 {
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	},
+	"max": func(values []float64) float64 {
+		max := math.Inf(-1)
+		for _, v := range values {
+			max = math.Max(max, v)
+		}
+		return max
+	},
+	"min": func(values []float64) float64 {
+		min := math.Inf(1)
+		for _, v := range values {
+			min = math.Min(min, v)
+		}
+		return min
+	},
+	"count": func(values []float64) float64 {
+		return float64(len(values))
+	},
+}
+
+// An AggregationRule describes how to roll up metrics with a matching name.
+type AggregationRule struct {
+	name        *regexp.Regexp
+	labels      map[string]bool
+	aggregation string
+}
+
+// NewAggregationRule compiles a rule that aggregates metrics whose name
+// matches nameRegexp across the given label keys.
+func NewAggregationRule(nameRegexp string, labels []string, aggregation string) (*AggregationRule, error) {
+	if _, ok := aggregations[aggregation]; !ok {
+		return nil, fmt.Errorf("unknown aggregation %q", aggregation)
+	}
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("no labels to aggregate across")
+	}
+	re, err := regexp.Compile(nameRegexp)
+	if err != nil {
+		return nil, err
+	}
+	rule := &AggregationRule{name: re, labels: map[string]bool{}, aggregation: aggregation}
+	for _, l := range labels {
+		rule.labels[l] = true
+	}
+	return rule, nil
+}
+
+type aggregationGroup struct {
+	metric    *messages.Metric
+	aggregate aggregation
+	values    []float64
+}
+
+type aggregator struct {
+	rules   []*AggregationRule
+	adapter stackdriver.MetricAdapter
+}
+
+// NewAggregator provides a MetricAdapter that rolls up gauge metrics matching
+// one of the rules across the rule's label keys before passing them on. Each
+// aggregate is reported as <metric name>.<aggregation>, e.g.
+// firehose/rep.cpuPercentage.max, and the input series are dropped.
+//
+// It is meant to sit behind a MetricsBuffer, so that each input series
+// contributes its latest value from the buffer window. Cumulative metrics are
+// passed through unchanged, since their start times differ between series.
+func NewAggregator(rules []*AggregationRule, adapter stackdriver.MetricAdapter) stackdriver.MetricAdapter {
+	return &aggregator{rules: rules, adapter: adapter}
+}
+
+func (a *aggregator) PostMetrics(metrics []*messages.Metric) {
+	var out []*messages.Metric
+	groups := map[string]*aggregationGroup{}
+	var order []string
+
+	for _, metric := range metrics {
+		rule := a.match(metric)
+		if rule == nil {
+			out = append(out, metric)
+			continue
+		}
+		metricsAggregatedCount.Increment()
+
+		aggregate := &messages.Metric{
+			Name:   metric.Name + "." + rule.aggregation,
+			Labels: map[string]string{},
+			Unit:   metric.Unit,
+			Type:   metric.Type,
+		}
+		for k, v := range metric.Labels {
+			if !rule.labels[k] {
+				aggregate.Labels[k] = v
+			}
+		}
+		if rule.aggregation == "count" {
+			aggregate.Unit = "1"
+		}
+
+		hash := aggregate.Hash()
+		group, ok := groups[hash]
+		if !ok {
+			group = &aggregationGroup{metric: aggregate, aggregate: aggregations[rule.aggregation]}
+			groups[hash] = group
+			order = append(order, hash)
+		}
+		group.values = append(group.values, metric.Value)
+		if metric.EventTime.After(group.metric.EventTime) {
+			group.metric.EventTime = metric.EventTime
+			group.metric.StartTime = metric.EventTime
+		}
+	}
+
+	for _, hash := range order {
+		group := groups[hash]
+		group.metric.Value = group.aggregate(group.values)
+		out = append(out, group.metric)
+	}
+	a.adapter.PostMetrics(out)
+}
+
+func (a *aggregator) match(metric *messages.Metric) *AggregationRule {
+	if metric.IsCumulative() {
+		return nil
+	}
+	for _, rule := range a.rules {
+		if rule.name.MatchString(metric.Name) {
+			return rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metricspipeline
+
+import (
+	"time"
+
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/mocks"
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
+)
+
+var _ = Describe("aggregator", func() {
+	var (
+		metricAdapter *mocks.MetricAdapter
+		now           time.Time
+	)
+
+	BeforeEach(func() {
+		metricAdapter = &mocks.MetricAdapter{}
+		now = time.Now()
+	})
+
+	instance := func(app, index string, value float64, eventTime time.Time) *messages.Metric {
+		return &messages.Metric{
+			Name:      "firehose/rep.cpuPercentage",
+			Labels:    map[string]string{"applicationPath": app, "instanceIndex": index},
+			Value:     value,
+			EventTime: eventTime,
+			StartTime: eventTime,
+			Type:      events.Envelope_ContainerMetric,
+		}
+	}
+
+	DescribeTable("aggregates across labels",
+		func(aggregation string, expected float64) {
+			rule, err := NewAggregationRule(`^firehose/rep\.cpuPercentage$`, []string{"instanceIndex"}, aggregation)
+			Expect(err).NotTo(HaveOccurred())
+			subject := NewAggregator([]*AggregationRule{rule}, metricAdapter)
+
+			subject.PostMetrics([]*messages.Metric{
+				instance("/o/s/a", "0", 10, now),
+				instance("/o/s/a", "1", 30, now.Add(time.Second)),
+				instance("/o/s/a", "2", 20, now),
+			})
+
+			Expect(metricAdapter.GetPostedMetrics()).To(ConsistOf(PointTo(MatchFields(IgnoreExtras, Fields{
+				"Name":      Equal("firehose/rep.cpuPercentage." + aggregation),
+				"Labels":    Equal(map[string]string{"applicationPath": "/o/s/a"}),
+				"Value":     Equal(expected),
+				"EventTime": Equal(now.Add(time.Second)),
+				"StartTime": Equal(now.Add(time.Second)),
+				"Type":      Equal(events.Envelope_ContainerMetric),
+			}))))
+		},
+		Entry("sum", "sum", 60.0),
+		Entry("mean", "mean", 20.0),
+		Entry("max", "max", 30.0),
+		Entry("min", "min", 10.0),
+		Entry("count", "count", 3.0),
+	)
+
+	It("keeps separate groups and passes through unmatched metrics", func() {
+		rule, err := NewAggregationRule(`cpuPercentage$`, []string{"instanceIndex"}, "sum")
+		Expect(err).NotTo(HaveOccurred())
+		subject := NewAggregator([]*AggregationRule{rule}, metricAdapter)
+
+		other := &messages.Metric{Name: "firehose/rep.memoryBytes", Value: 42, Labels: map[string]string{"instanceIndex": "0"}}
+		counter := &messages.Metric{Name: "firehose/rep.cpuPercentage", IntValue: 7, Type: events.Envelope_CounterEvent}
+		subject.PostMetrics([]*messages.Metric{
+			instance("/o/s/a", "0", 1, now),
+			instance("/o/s/b", "0", 2, now),
+			instance("/o/s/a", "1", 3, now),
+			other,
+			counter,
+		})
+
+		posted := metricAdapter.GetPostedMetrics()
+		Expect(posted).To(HaveLen(4))
+		Expect(posted).To(ContainElement(other))
+		Expect(posted).To(ContainElement(counter))
+		Expect(posted).To(ContainElement(PointTo(MatchFields(IgnoreExtras, Fields{
+			"Labels": Equal(map[string]string{"applicationPath": "/o/s/a"}),
+			"Value":  Equal(4.0),
+		}))))
+		Expect(posted).To(ContainElement(PointTo(MatchFields(IgnoreExtras, Fields{
+			"Labels": Equal(map[string]string{"applicationPath": "/o/s/b"}),
+			"Value":  Equal(2.0),
+		}))))
+	})
+
+	It("rejects invalid rules", func() {
+		_, err := NewAggregationRule(".*", []string{"instanceIndex"}, "median")
+		Expect(err).To(HaveOccurred())
+		_, err = NewAggregationRule(".*", nil, "sum")
+		Expect(err).To(HaveOccurred())
+		_, err = NewAggregationRule("$[}", []string{"instanceIndex"}, "sum")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -19,6 +19,7 @@ package metricspipeline
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"sync"
 	"time"
 
@@ -29,32 +30,124 @@ import (
 )
 
 var (
-	eventsSampledCount *telemetry.Counter
+	eventsSampledCount    *telemetry.Counter
+	eventsAggregatedCount *telemetry.Counter
 )
 
 func init() {
 	eventsSampledCount = telemetry.NewCounter(telemetry.Nozzle, "metrics.firehose_events.sampled.count")
+	eventsAggregatedCount = telemetry.NewCounter(telemetry.Nozzle, "metrics.firehose_events.window_aggregated.count")
+}
+
+// lastValue is the default window policy, which keeps the newest point.
+const lastValue = "last"
+
+// A WindowPolicy selects how the points of a metric with a matching name are
+// combined over a buffer window.
+type WindowPolicy struct {
+	name        *regexp.Regexp
+	aggregation string
+}
+
+// NewWindowPolicy compiles a policy applying aggregation ("last", "sum",
+// "mean", "max", "min" or "count") to the points of each gauge series whose
+// name matches nameRegexp.
+func NewWindowPolicy(nameRegexp string, aggregation string) (*WindowPolicy, error) {
+	if _, ok := aggregations[aggregation]; !ok && aggregation != lastValue {
+		return nil, fmt.Errorf("unknown aggregation %q", aggregation)
+	}
+	re, err := regexp.Compile(nameRegexp)
+	if err != nil {
+		return nil, err
+	}
+	return &WindowPolicy{name: re, aggregation: aggregation}, nil
+}
+
+// bufferedSeries accumulates the points of one series in a window.
+type bufferedSeries struct {
+	metric      *messages.Metric // newest point, or the extreme point for max and min
+	aggregation string
+	latest      time.Time
+	count       int
+	sum         float64
+}
+
+func (s *bufferedSeries) add(metric *messages.Metric) {
+	s.count++
+	s.sum += metric.Value
+	if metric.EventTime.After(s.latest) {
+		s.latest = metric.EventTime
+	}
+
+	var replace bool
+	switch s.aggregation {
+	case "max":
+		replace = metric.Value > s.metric.Value
+	case "min":
+		replace = metric.Value < s.metric.Value
+	default:
+		// Firehose messages are not guaranteed to be received in
+		// timestamp order, so only overwrite the sampled metric
+		// if the event is newer.
+		replace = metric.EventTime.After(s.metric.EventTime)
+	}
+	if replace {
+		s.metric = metric
+	}
+}
+
+// result returns the point reported for the window. Stackdriver requires gauge
+// points to cover a single point in time: max and min are reported at the time
+// of the extreme point, the other aggregations at the time of the newest point.
+// Sums and counts mean something else than the metric's points, so they are
+// reported as "<name>.sum" and "<name>.count" instead of under its name.
+func (s *bufferedSeries) result() *messages.Metric {
+	switch s.aggregation {
+	case lastValue, "max", "min":
+		return s.metric
+	}
+
+	metric := *s.metric
+	metric.EventTime = s.latest
+	metric.StartTime = s.latest
+	switch s.aggregation {
+	case "sum":
+		metric.Name += ".sum"
+		metric.Value = s.sum
+	case "mean":
+		metric.Value = s.sum / float64(s.count)
+	case "count":
+		metric.Name += ".count"
+		metric.Value = float64(s.count)
+		metric.Unit = "1"
+	}
+	return &metric
 }
 
 type autoCulledMetricsBuffer struct {
-	adapter stackdriver.MetricAdapter
-	ticker  *time.Ticker
-	ctx     context.Context
-	logger  lager.Logger
+	adapter  stackdriver.MetricAdapter
+	ticker   *time.Ticker
+	ctx      context.Context
+	logger   lager.Logger
+	policies []*WindowPolicy
 
 	metricsMu sync.Mutex // Guard metrics
-	metrics   map[string]*messages.Metric
+	metrics   map[string]*bufferedSeries
 }
 
 // NewAutoCulledMetricsBuffer provides a MetricsBuffer that will cull like metrics over the defined frequency.
 // A like metric is defined as a metric with the same stackdriver.Metric.Hash()
-func NewAutoCulledMetricsBuffer(ctx context.Context, logger lager.Logger, frequency time.Duration, adapter stackdriver.MetricAdapter) MetricsBuffer {
+//
+// By default the newest point of each series is kept. Gauges matching one of the policies (the first match applies)
+// are instead combined as the policy specifies; cumulative metrics always keep their newest point.
+func NewAutoCulledMetricsBuffer(ctx context.Context, logger lager.Logger, frequency time.Duration, policies []*WindowPolicy, adapter stackdriver.MetricAdapter) MetricsBuffer {
 	mb := &autoCulledMetricsBuffer{
-		adapter: adapter,
-		metrics: make(map[string]*messages.Metric),
-		ctx:     ctx,
-		logger:  logger,
-		ticker:  time.NewTicker(frequency),
+		adapter:  adapter,
+		metrics:  make(map[string]*bufferedSeries),
+		ctx:      ctx,
+		logger:   logger,
+		ticker:   time.NewTicker(frequency),
+		policies: policies,
 	}
 	mb.start()
 	return mb
@@ -66,19 +159,36 @@ func (mb *autoCulledMetricsBuffer) PostMetrics(metrics []*messages.Metric) {
 
 	for _, metric := range metrics {
 		hash := metric.Hash()
-		old, exists := mb.metrics[hash]
+		series, exists := mb.metrics[hash]
 		if !exists {
-			mb.metrics[hash] = metric
-		} else {
-			eventsSampledCount.Increment()
-			if metric.EventTime.After(old.EventTime) {
-				// Firehose messages are not guaranteed to be received in
-				// timestamp order, so only overwrite the sampled metric
-				// if the event is newer.
-				mb.metrics[hash] = metric
+			mb.metrics[hash] = &bufferedSeries{
+				metric:      metric,
+				aggregation: mb.aggregation(metric),
+				latest:      metric.EventTime,
+				count:       1,
+				sum:         metric.Value,
 			}
+			continue
+		}
+		if series.aggregation == lastValue {
+			eventsSampledCount.Increment()
+		} else {
+			eventsAggregatedCount.Increment()
+		}
+		series.add(metric)
+	}
+}
+
+func (mb *autoCulledMetricsBuffer) aggregation(metric *messages.Metric) string {
+	if metric.IsCumulative() {
+		return lastValue
+	}
+	for _, policy := range mb.policies {
+		if policy.name.MatchString(metric.Name) {
+			return policy.aggregation
 		}
 	}
+	return lastValue
 }
 
 func (mb *autoCulledMetricsBuffer) IsEmpty() bool {
@@ -96,10 +206,10 @@ func (mb *autoCulledMetricsBuffer) flushInternalBuffer() []*messages.Metric {
 
 	metrics := make([]*messages.Metric, 0, len(mb.metrics))
 	for _, v := range mb.metrics {
-		metrics = append(metrics, v)
+		metrics = append(metrics, v.result())
 	}
 
-	mb.metrics = make(map[string]*messages.Metric)
+	mb.metrics = make(map[string]*bufferedSeries)
 
 	return metrics
 }
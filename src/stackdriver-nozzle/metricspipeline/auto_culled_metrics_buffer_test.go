@@ -23,6 +23,7 @@ import (
 
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/mocks"
+	"github.com/cloudfoundry/sonde-go/events"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -37,10 +38,11 @@ var _ = Describe("autoCulledMetricsBuffer", func() {
 		metricAdapter = &mocks.MetricAdapter{}
 		logger = &mocks.MockLogger{}
 		eventsSampledCount.Set(0)
+		eventsAggregatedCount.Set(0)
 	})
 
 	It("culls duplicate metrics", func() {
-		subject := NewAutoCulledMetricsBuffer(context.Background(), logger, 100*time.Millisecond, metricAdapter)
+		subject := NewAutoCulledMetricsBuffer(context.Background(), logger, 100*time.Millisecond, nil, metricAdapter)
 
 		subject.PostMetrics([]*messages.Metric{
 			{
@@ -93,7 +95,7 @@ var _ = Describe("autoCulledMetricsBuffer", func() {
 	})
 
 	It("culls multiple duplicates, keeping the latest", func() {
-		subject := NewAutoCulledMetricsBuffer(context.Background(), logger, 100*time.Millisecond, metricAdapter)
+		subject := NewAutoCulledMetricsBuffer(context.Background(), logger, 100*time.Millisecond, nil, metricAdapter)
 		subject.PostMetrics([]*messages.Metric{
 			{
 				Labels:    map[string]string{"d1": "a"},
@@ -151,7 +153,7 @@ var _ = Describe("autoCulledMetricsBuffer", func() {
 
 	It("it buffers metrics for the expected duration before flushing", func() {
 		d := 500 * time.Millisecond
-		subject := NewAutoCulledMetricsBuffer(context.Background(), logger, d, metricAdapter)
+		subject := NewAutoCulledMetricsBuffer(context.Background(), logger, d, nil, metricAdapter)
 
 		subject.PostMetrics([]*messages.Metric{
 			{
@@ -172,7 +174,7 @@ var _ = Describe("autoCulledMetricsBuffer", func() {
 	It("it flushes metrics when the context is canceled", func() {
 		d := 500 * time.Second
 		ctx, cancel := context.WithCancel(context.Background())
-		subject := NewAutoCulledMetricsBuffer(ctx, logger, d, metricAdapter)
+		subject := NewAutoCulledMetricsBuffer(ctx, logger, d, nil, metricAdapter)
 
 		subject.PostMetrics([]*messages.Metric{
 			{
@@ -190,6 +192,83 @@ var _ = Describe("autoCulledMetricsBuffer", func() {
 		Eventually(metricAdapter.GetPostedMetrics).Should(HaveLen(2))
 	})
 
+	Describe("with window policies", func() {
+		var subject MetricsBuffer
+
+		points := func(name string, values ...float64) []*messages.Metric {
+			var metrics []*messages.Metric
+			for i, v := range values {
+				t := time.Unix(1234567890+int64(i), 0)
+				metrics = append(metrics, &messages.Metric{Name: name, Value: v, EventTime: t, StartTime: t})
+			}
+			return metrics
+		}
+
+		posted := func() map[string]*messages.Metric {
+			byName := map[string]*messages.Metric{}
+			for _, m := range metricAdapter.GetPostedMetrics() {
+				byName[m.Name] = m
+			}
+			return byName
+		}
+
+		BeforeEach(func() {
+			var policies []*WindowPolicy
+			for _, aggregation := range []string{"max", "min", "mean", "sum", "count", "last"} {
+				policy, err := NewWindowPolicy("^"+aggregation+"$", aggregation)
+				Expect(err).NotTo(HaveOccurred())
+				policies = append(policies, policy)
+			}
+			subject = NewAutoCulledMetricsBuffer(context.Background(), logger, 100*time.Millisecond, policies, metricAdapter)
+		})
+
+		It("rejects unknown aggregations", func() {
+			_, err := NewWindowPolicy("foo", "median")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("combines the points of a window", func() {
+			for _, name := range []string{"max", "min", "mean", "sum", "count", "last", "default"} {
+				subject.PostMetrics(points(name, 3, 9, 1, 7))
+			}
+			Eventually(metricAdapter.GetPostedMetrics).Should(HaveLen(7))
+
+			metrics := posted()
+			newest := time.Unix(1234567893, 0)
+			expected := map[string]struct {
+				value float64
+				time  time.Time
+			}{
+				"max":         {9, time.Unix(1234567891, 0)},
+				"min":         {1, time.Unix(1234567892, 0)},
+				"mean":        {5, newest},
+				"sum.sum":     {20, newest},
+				"count.count": {4, newest},
+				"last":        {7, newest},
+				"default":     {7, newest},
+			}
+			for name, e := range expected {
+				Expect(metrics[name].Value).To(Equal(e.value), name)
+				Expect(metrics[name].EventTime).To(Equal(e.time), name)
+				Expect(metrics[name].StartTime).To(Equal(e.time), name)
+			}
+			Expect(metrics["count.count"].Unit).To(Equal("1"))
+			Expect(eventsSampledCount.IntValue()).To(Equal(6))
+			Expect(eventsAggregatedCount.IntValue()).To(Equal(15))
+		})
+
+		It("keeps the newest point of cumulative metrics", func() {
+			metrics := points("sum", 3, 9)
+			for _, m := range metrics {
+				m.Type = events.Envelope_CounterEvent
+				m.IntValue = int64(m.Value)
+			}
+			subject.PostMetrics(metrics)
+			Eventually(metricAdapter.GetPostedMetrics).Should(HaveLen(1))
+			Expect(posted()["sum"].IntValue).To(BeNumerically("==", 9))
+		})
+	})
+
 	Describe("with a slow MetricAdapter", func() {
 		var (
 			metricPosted chan interface{}
@@ -204,7 +283,7 @@ var _ = Describe("autoCulledMetricsBuffer", func() {
 				return nil
 			}
 
-			subject = NewAutoCulledMetricsBuffer(context.Background(), logger, 1*time.Millisecond, metricAdapter)
+			subject = NewAutoCulledMetricsBuffer(context.Background(), logger, 1*time.Millisecond, nil, metricAdapter)
 		})
 
 		It("doesn't block new metrics during flush", func() {
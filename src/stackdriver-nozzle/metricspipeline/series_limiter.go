@@ -0,0 +1,208 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metricspipeline
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/stackdriver"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
+)
+
+// OverflowLabelValue replaces every label value of a series that is collapsed
+// because its metric exceeded a series limit.
+const OverflowLabelValue = "__overflow__"
+
+// maxLimitedNames caps the number of metric names series limits are counted
+// for in telemetry; series of other metric names are counted under "other".
+const maxLimitedNames = 100
+
+var (
+	seriesLimited *telemetry.CounterMap
+)
+
+func init() {
+	seriesLimited = telemetry.NewCounterMap(telemetry.Nozzle, "metrics.series.limited", "metric_name", "limit")
+}
+
+type activeSeries struct {
+	hash     string
+	name     string
+	lastSeen time.Time
+}
+
+type seriesLimiter struct {
+	adapter    stackdriver.MetricAdapter
+	logger     lager.Logger
+	maxSeries  int
+	maxPerName int
+	ttl        time.Duration
+	collapse   bool
+	now        func() time.Time
+	mu         sync.Mutex // protects the fields below
+	lru        *list.List // of *activeSeries, most recently seen first
+	series     map[string]*list.Element
+	perName    map[string]int
+	// When each metric name last hit a limit was logged; swept every ttl.
+	reported map[string]time.Time
+	swept    time.Time
+	// Metric names limited series are counted for, at most maxNames.
+	counted  map[string]bool
+	maxNames int
+}
+
+// NewSeriesLimiter provides a MetricAdapter that caps the number of distinct
+// series (as determined by messages.Metric.Hash) passed on to adapter, both
+// in total (maxSeries) and per metric name (maxPerName). A limit of zero
+// disables that cap.
+//
+// A series stays active while it is seen at least once every ttl; active
+// series are kept in LRU order so idle ones can be released cheaply. New
+// series over a limit are dropped, or if collapse is set, reported with every
+// label value replaced by OverflowLabelValue. Cumulative series are always
+// dropped, since collapsing them would break their monotonicity.
+//
+// Metric names that hit a limit are logged at most once every ttl. Series
+// over a limit are counted in telemetry by metric name and by the limit
+// ("total" or "per_name") they hit.
+func NewSeriesLimiter(logger lager.Logger, maxSeries, maxPerName int, ttl time.Duration, collapse bool, adapter stackdriver.MetricAdapter) stackdriver.MetricAdapter {
+	return &seriesLimiter{
+		adapter:    adapter,
+		logger:     logger,
+		maxSeries:  maxSeries,
+		maxPerName: maxPerName,
+		ttl:        ttl,
+		collapse:   collapse,
+		now:        time.Now,
+		lru:        list.New(),
+		series:     map[string]*list.Element{},
+		perName:    map[string]int{},
+		reported:   map[string]time.Time{},
+		counted:    map[string]bool{},
+		maxNames:   maxLimitedNames,
+	}
+}
+
+func (sl *seriesLimiter) PostMetrics(metrics []*messages.Metric) {
+	allowed := make([]*messages.Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		if m := sl.admit(metric); m != nil {
+			allowed = append(allowed, m)
+		}
+	}
+	if len(allowed) > 0 {
+		sl.adapter.PostMetrics(allowed)
+	}
+}
+
+// admit returns the metric to pass on for an incoming metric, or nil if it
+// should be dropped.
+func (sl *seriesLimiter) admit(metric *messages.Metric) *messages.Metric {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	now := sl.now()
+	hash := metric.Hash()
+	if e, ok := sl.series[hash]; ok {
+		e.Value.(*activeSeries).lastSeen = now
+		sl.lru.MoveToFront(e)
+		return metric
+	}
+
+	sl.releaseIdle(now)
+	limit := ""
+	if sl.maxSeries > 0 && sl.lru.Len() >= sl.maxSeries {
+		limit = "total"
+	} else if sl.maxPerName > 0 && sl.perName[metric.Name] >= sl.maxPerName {
+		limit = "per_name"
+	}
+	if limit == "" {
+		sl.series[hash] = sl.lru.PushFront(&activeSeries{hash: hash, name: metric.Name, lastSeen: now})
+		sl.perName[metric.Name]++
+		return metric
+	}
+
+	sl.limited(metric.Name, limit, now)
+	if !sl.collapse || metric.IsCumulative() {
+		return nil
+	}
+	collapsed := *metric
+	collapsed.Labels = make(map[string]string, len(metric.Labels))
+	for k := range metric.Labels {
+		collapsed.Labels[k] = OverflowLabelValue
+	}
+	return &collapsed
+}
+
+// releaseIdle forgets series that have not been seen for the ttl.
+func (sl *seriesLimiter) releaseIdle(now time.Time) {
+	for e := sl.lru.Back(); e != nil; e = sl.lru.Back() {
+		s := e.Value.(*activeSeries)
+		if now.Sub(s.lastSeen) <= sl.ttl {
+			return
+		}
+		sl.lru.Remove(e)
+		delete(sl.series, s.hash)
+		sl.perName[s.name]--
+		if sl.perName[s.name] <= 0 {
+			delete(sl.perName, s.name)
+		}
+	}
+}
+
+func (sl *seriesLimiter) limited(name, limit string, now time.Time) {
+	counted := name
+	if !sl.counted[name] {
+		if len(sl.counted) < sl.maxNames {
+			sl.counted[name] = true
+		} else {
+			counted = "other"
+		}
+	}
+	seriesLimited.MustCounter(counted, limit).Increment()
+
+	if now.Sub(sl.swept) >= sl.ttl {
+		for n, at := range sl.reported {
+			if now.Sub(at) >= sl.ttl {
+				delete(sl.reported, n)
+			}
+		}
+		sl.swept = now
+	}
+	if _, ok := sl.reported[name]; ok {
+		return
+	}
+	sl.reported[name] = now
+	sl.logger.Info("seriesLimiter", lager.Data{
+		"info":        "series limit reached, new series will be " + sl.action(),
+		"metric_name": name,
+		"limit":       limit,
+		"series":      sl.perName[name],
+		"total":       sl.lru.Len(),
+	})
+}
+
+func (sl *seriesLimiter) action() string {
+	if sl.collapse {
+		return "collapsed"
+	}
+	return "dropped"
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metricspipeline
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/mocks"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("seriesLimiter", func() {
+	var (
+		metricAdapter *mocks.MetricAdapter
+		logger        *mocks.MockLogger
+		now           time.Time
+	)
+
+	BeforeEach(func() {
+		metricAdapter = &mocks.MetricAdapter{}
+		logger = &mocks.MockLogger{}
+		now = time.Now()
+		seriesLimited.Init()
+	})
+
+	series := func(name string, ids ...int) []*messages.Metric {
+		var metrics []*messages.Metric
+		for _, id := range ids {
+			metrics = append(metrics, &messages.Metric{
+				Name:   name,
+				Labels: map[string]string{"tags": fmt.Sprintf("request_id=%d", id)},
+				Type:   events.Envelope_ValueMetric,
+			})
+		}
+		return metrics
+	}
+
+	newSubject := func(maxSeries, maxPerName int, collapse bool) *seriesLimiter {
+		sl := NewSeriesLimiter(logger, maxSeries, maxPerName, time.Minute, collapse, metricAdapter).(*seriesLimiter)
+		sl.now = func() time.Time { return now }
+		return sl
+	}
+
+	limitedCount := func(name, limit string) int {
+		if ctr, ok := seriesLimited.Get(messages.Flatten(map[string]string{"metric_name": name, "limit": limit})).(*telemetry.Counter); ok {
+			return ctr.IntValue()
+		}
+		return 0
+	}
+
+	It("drops new series over the per-name limit", func() {
+		subject := newSubject(0, 2, false)
+
+		subject.PostMetrics(series("noisy", 1, 2, 3, 4))
+		subject.PostMetrics(series("quiet", 1))
+		// Already active series are still accepted.
+		subject.PostMetrics(series("noisy", 1))
+
+		Expect(metricAdapter.GetPostedMetrics()).To(HaveLen(4))
+		Expect(limitedCount("noisy", "per_name")).To(Equal(2))
+		Expect(limitedCount("quiet", "per_name")).To(Equal(0))
+		Expect(logger.Logs()).To(HaveLen(1))
+		Expect(logger.LastLog().Datas[0]["metric_name"]).To(Equal("noisy"))
+	})
+
+	It("drops new series over the global limit", func() {
+		subject := newSubject(3, 0, false)
+
+		subject.PostMetrics(series("a", 1, 2))
+		subject.PostMetrics(series("b", 1, 2))
+
+		Expect(metricAdapter.GetPostedMetrics()).To(Equal(append(series("a", 1, 2), series("b", 1)...)))
+		Expect(limitedCount("b", "total")).To(Equal(1))
+	})
+
+	It("collapses gauges over the limit into an overflow series", func() {
+		subject := newSubject(0, 1, true)
+
+		subject.PostMetrics(series("noisy", 1, 2))
+		counter := series("noisy", 3)[0]
+		counter.Type = events.Envelope_CounterEvent
+		subject.PostMetrics([]*messages.Metric{counter})
+
+		posted := metricAdapter.GetPostedMetrics()
+		Expect(posted).To(HaveLen(2))
+		Expect(posted[1].Labels).To(Equal(map[string]string{"tags": OverflowLabelValue}))
+		Expect(limitedCount("noisy", "per_name")).To(Equal(2))
+	})
+
+	It("releases series that have been idle for the ttl", func() {
+		subject := newSubject(0, 1, false)
+
+		subject.PostMetrics(series("m", 1))
+		now = now.Add(2 * time.Minute)
+		subject.PostMetrics(series("m", 2))
+		subject.PostMetrics(series("m", 3))
+
+		Expect(metricAdapter.GetPostedMetrics()).To(Equal(series("m", 1, 2)))
+	})
+
+	It("logs each metric name over a limit at most once every ttl", func() {
+		subject := newSubject(1, 0, false)
+
+		subject.PostMetrics(series("a", 1))
+		for i := 0; i < 10; i++ {
+			subject.PostMetrics(series(fmt.Sprintf("b%d", i), 1))
+		}
+		subject.PostMetrics(series("b0", 2))
+		Expect(logger.Logs()).To(HaveLen(10))
+		Expect(subject.reported).To(HaveLen(10))
+
+		now = now.Add(30 * time.Second)
+		subject.PostMetrics(series("a", 1))
+		now = now.Add(45 * time.Second)
+		subject.PostMetrics(series("b0", 3))
+		Expect(logger.Logs()).To(HaveLen(11))
+		Expect(subject.reported).To(HaveLen(1))
+		Expect(limitedCount("b0", "total")).To(Equal(3))
+	})
+
+	It("counts limited series of too many metric names as other", func() {
+		subject := newSubject(1, 0, false)
+		subject.maxNames = 2
+
+		subject.PostMetrics(series("a", 1))
+		for _, name := range []string{"b", "c", "d", "e", "b"} {
+			subject.PostMetrics(series(name, 1))
+		}
+
+		Expect(limitedCount("b", "total")).To(Equal(2))
+		Expect(limitedCount("c", "total")).To(Equal(1))
+		Expect(limitedCount("other", "total")).To(Equal(2))
+		Expect(limitedCount("d", "total")).To(Equal(0))
+		Expect(subject.counted).To(HaveLen(2))
+	})
+})
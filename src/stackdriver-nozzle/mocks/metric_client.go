@@ -28,6 +28,7 @@ type MockClient struct {
 	MetricReqs     []*monitoring.CreateTimeSeriesRequest
 	TimeSeries     []*monitoring.TimeSeries
 	DescriptorReqs []*monitoring.CreateMetricDescriptorRequest
+	DeleteReqs     []*monitoring.DeleteMetricDescriptorRequest
 	ListErr        error
 
 	CreateMetricDescriptorFn func(req *monitoring.CreateMetricDescriptorRequest) error
@@ -60,6 +61,14 @@ func (mc *MockClient) CreateMetricDescriptor(request *monitoring.CreateMetricDes
 	return nil
 }
 
+func (mc *MockClient) DeleteMetricDescriptor(request *monitoring.DeleteMetricDescriptorRequest) error {
+	mc.Mutex.Lock()
+	mc.DeleteReqs = append(mc.DeleteReqs, request)
+	mc.Mutex.Unlock()
+
+	return nil
+}
+
 func (mc *MockClient) ListMetricDescriptors(request *monitoring.ListMetricDescriptorsRequest) ([]*metric.MetricDescriptor, error) {
 	if mc.ListMetricDescriptorFn != nil {
 		return mc.ListMetricDescriptorFn(request)
@@ -69,6 +78,12 @@ func (mc *MockClient) ListMetricDescriptors(request *monitoring.ListMetricDescri
 		return nil, mc.ListErr
 	}
 	return []*metric.MetricDescriptor{
-		{Name: "anExistingMetric"},
+		{
+			Name:       "projects/my-awesome-project/metricDescriptors/custom.googleapis.com/anExistingMetric",
+			Type:       "custom.googleapis.com/anExistingMetric",
+			MetricKind: metric.MetricDescriptor_GAUGE,
+			ValueType:  metric.MetricDescriptor_DOUBLE,
+			Unit:       "{lalala}",
+		},
 	}, nil
 }
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nozzle
+
+import (
+	"strings"
+
+	"cloud.google.com/go/logging"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/cloudfoundry"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// CAPI metadata annotations that app teams can set on their apps (or on a
+// space or org, with the usual precedence) to control what the nozzle ships.
+const (
+	// AnnotationLogs set to "disabled" stops logs of the app being sent.
+	AnnotationLogs = "stackdriver.nozzle/logs"
+	// AnnotationMetrics set to "disabled" stops metrics of the app being sent.
+	AnnotationMetrics = "stackdriver.nozzle/metrics"
+	// AnnotationMinSeverity is the lowest Stackdriver Logging severity, e.g.
+	// "WARNING", of app logs that are sent.
+	AnnotationMinSeverity = "stackdriver.nozzle/min-severity"
+)
+
+var (
+	appControlsDroppedLogs    *telemetry.Counter
+	appControlsDroppedMetrics *telemetry.Counter
+)
+
+func init() {
+	appControlsDroppedLogs = telemetry.NewCounter(telemetry.Nozzle, "app_controls.dropped_logs")
+	appControlsDroppedMetrics = telemetry.NewCounter(telemetry.Nozzle, "app_controls.dropped_metrics")
+}
+
+// AppControls applies the per-app settings of the stackdriver.nozzle/*
+// annotations. Annotations are read through the AppInfoRepository, so changes
+// take effect once the app's cached metadata is refreshed. A nil *AppControls
+// lets everything through.
+type AppControls struct {
+	appInfoRepository cloudfoundry.AppInfoRepository
+}
+
+// NewAppControls creates AppControls reading annotations from appInfoRepository.
+func NewAppControls(appInfoRepository cloudfoundry.AppInfoRepository) *AppControls {
+	return &AppControls{appInfoRepository: appInfoRepository}
+}
+
+// LogEnabled returns whether a log of the given severity should be sent for
+// the envelope.
+func (ac *AppControls) LogEnabled(envelope *events.Envelope, severity logging.Severity) bool {
+	annotations := ac.annotations(envelope)
+	if annotations == nil {
+		return true
+	}
+	if isDisabled(annotations[AnnotationLogs]) {
+		appControlsDroppedLogs.Increment()
+		return false
+	}
+	if min, ok := annotations[AnnotationMinSeverity]; ok && severity < logging.ParseSeverity(strings.TrimSpace(min)) {
+		appControlsDroppedLogs.Increment()
+		return false
+	}
+	return true
+}
+
+// MetricsEnabled returns whether metrics should be sent for the envelope.
+func (ac *AppControls) MetricsEnabled(envelope *events.Envelope) bool {
+	annotations := ac.annotations(envelope)
+	if annotations != nil && isDisabled(annotations[AnnotationMetrics]) {
+		appControlsDroppedMetrics.Increment()
+		return false
+	}
+	return true
+}
+
+func (ac *AppControls) annotations(envelope *events.Envelope) map[string]string {
+	if ac == nil {
+		return nil
+	}
+	appID := getApplicationID(envelope)
+	if appID == "" {
+		return nil
+	}
+	return ac.appInfoRepository.GetAppInfo(appID).Metadata.Annotations
+}
+
+func isDisabled(value string) bool {
+	return strings.EqualFold(strings.TrimSpace(value), "disabled")
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nozzle
+
+import (
+	"cloud.google.com/go/logging"
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/cloudfoundry"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/mocks"
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AppControls", func() {
+	var (
+		appInfoRepository *mocks.AppInfoRepository
+		subject           *AppControls
+		appGUID           = "f47ac10b-58cc-4372-a567-0e02b2c3d479"
+		logType           = events.Envelope_LogMessage
+		metricType        = events.Envelope_ContainerMetric
+		stdout            = events.LogMessage_OUT
+		stderr            = events.LogMessage_ERR
+	)
+
+	setAnnotations := func(annotations map[string]string) {
+		appInfoRepository.AppInfoMap[appGUID] = cloudfoundry.AppInfo{
+			AppName:  "MyApp",
+			Metadata: cloudfoundry.Metadata{Annotations: annotations},
+		}
+	}
+	logEnvelope := func(messageType events.LogMessage_MessageType) *events.Envelope {
+		return &events.Envelope{
+			EventType:  &logType,
+			LogMessage: &events.LogMessage{AppId: &appGUID, MessageType: &messageType, Message: []byte("hello")},
+		}
+	}
+	metricEnvelope := &events.Envelope{
+		EventType:       &metricType,
+		ContainerMetric: &events.ContainerMetric{ApplicationId: &appGUID},
+	}
+
+	BeforeEach(func() {
+		appInfoRepository = &mocks.AppInfoRepository{AppInfoMap: map[string]cloudfoundry.AppInfo{}}
+		subject = NewAppControls(appInfoRepository)
+		appControlsDroppedLogs.Set(0)
+		appControlsDroppedMetrics.Set(0)
+	})
+
+	It("lets everything through without annotations", func() {
+		Expect(subject.LogEnabled(logEnvelope(stdout), logging.Default)).To(BeTrue())
+		Expect(subject.MetricsEnabled(metricEnvelope)).To(BeTrue())
+
+		var none *AppControls
+		Expect(none.LogEnabled(logEnvelope(stdout), logging.Default)).To(BeTrue())
+		Expect(none.MetricsEnabled(metricEnvelope)).To(BeTrue())
+	})
+
+	It("drops logs and metrics of apps that disabled them", func() {
+		setAnnotations(map[string]string{AnnotationLogs: "Disabled"})
+		Expect(subject.LogEnabled(logEnvelope(stderr), logging.Error)).To(BeFalse())
+		Expect(subject.MetricsEnabled(metricEnvelope)).To(BeTrue())
+
+		setAnnotations(map[string]string{AnnotationMetrics: "disabled"})
+		Expect(subject.LogEnabled(logEnvelope(stderr), logging.Error)).To(BeTrue())
+		Expect(subject.MetricsEnabled(metricEnvelope)).To(BeFalse())
+
+		Expect(appControlsDroppedLogs.IntValue()).To(Equal(1))
+		Expect(appControlsDroppedMetrics.IntValue()).To(Equal(1))
+	})
+
+	It("drops logs below the minimum severity", func() {
+		setAnnotations(map[string]string{AnnotationMinSeverity: "warning"})
+		Expect(subject.LogEnabled(logEnvelope(stdout), logging.Default)).To(BeFalse())
+		Expect(subject.LogEnabled(logEnvelope(stderr), logging.Error)).To(BeTrue())
+	})
+
+	It("is applied by the log sink", func() {
+		setAnnotations(map[string]string{AnnotationMinSeverity: "ERROR"})
+		logAdapter := &mocks.LogAdapter{}
+		sink := NewLogSink(NewLabelMaker(appInfoRepository, foundation, AppLabelsPath, false, nil, false), subject, logAdapter, "", lager.NewLogger("test"))
+
+		sink.Receive(logEnvelope(stdout))
+		sink.Receive(logEnvelope(stderr))
+
+		Expect(logAdapter.PostedLogs).To(HaveLen(1))
+		Expect(logAdapter.PostedLogs[0].Severity).To(Equal(logging.Error))
+	})
+})
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nozzle
+
+import (
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const bytesPerGiB = 1 << 30
+
+// ContainerUtilization derives utilization gauges from ContainerMetric events,
+// so that alerting policies do not have to compute ratios of the raw gauges.
+//
+// memoryUtilization and diskUtilization are the fraction of the container's
+// quota in use, and memoryBytesFree and diskBytesFree the bytes left of it
+// (negative once a container exceeds its quota). cpuEntitlement is the CPU usage as a percentage of what the
+// container is entitled to, assuming each GiB of memory quota entitles an app
+// instance to a fixed percentage of a CPU core (which is how Diego allocates
+// CPU shares). It is only reported when that percentage is configured.
+type ContainerUtilization struct {
+	cpuEntitlementPerGiB float64
+}
+
+// NewContainerUtilization creates a ContainerUtilization. cpuEntitlementPerGiB
+// is the CPU percentage a container is entitled to per GiB of memory quota; if
+// zero, cpuEntitlement is not reported.
+func NewContainerUtilization(cpuEntitlementPerGiB float64) *ContainerUtilization {
+	return &ContainerUtilization{cpuEntitlementPerGiB: cpuEntitlementPerGiB}
+}
+
+// Metrics returns the derived gauges for a ContainerMetric. Gauges of a zero
+// quota are skipped, as the quota is then unknown.
+func (cu *ContainerUtilization) Metrics(metricPrefix string, containerMetric *events.ContainerMetric) []*messages.Metric {
+	var metrics []*messages.Metric
+
+	if quota := containerMetric.GetMemoryBytesQuota(); quota > 0 {
+		metrics = append(metrics, &messages.Metric{
+			Name:  metricPrefix + "memoryUtilization",
+			Value: float64(containerMetric.GetMemoryBytes()) / float64(quota),
+			Unit:  "1",
+		}, &messages.Metric{
+			Name:  metricPrefix + "memoryBytesFree",
+			Value: float64(quota) - float64(containerMetric.GetMemoryBytes()),
+			Unit:  "By",
+		})
+	}
+	if quota := containerMetric.GetDiskBytesQuota(); quota > 0 {
+		metrics = append(metrics, &messages.Metric{
+			Name:  metricPrefix + "diskUtilization",
+			Value: float64(containerMetric.GetDiskBytes()) / float64(quota),
+			Unit:  "1",
+		}, &messages.Metric{
+			Name:  metricPrefix + "diskBytesFree",
+			Value: float64(quota) - float64(containerMetric.GetDiskBytes()),
+			Unit:  "By",
+		})
+	}
+	if quota := containerMetric.GetMemoryBytesQuota(); quota > 0 && cu.cpuEntitlementPerGiB > 0 {
+		entitlement := cu.cpuEntitlementPerGiB * float64(quota) / bytesPerGiB
+		metrics = append(metrics, &messages.Metric{
+			Name:  metricPrefix + "cpuEntitlement",
+			Value: 100 * containerMetric.GetCpuPercentage() / entitlement,
+			Unit:  "%",
+		})
+	}
+
+	return metrics
+}
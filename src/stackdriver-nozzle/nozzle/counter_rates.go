@@ -0,0 +1,139 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nozzle
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
+)
+
+var ratesExpiredCount *telemetry.Counter
+
+func init() {
+	ratesExpiredCount = telemetry.NewCounter(telemetry.Nozzle, "metrics.rates.expired")
+}
+
+type rateData struct {
+	lastValue     uint64
+	lastSeenTime  time.Time
+	lastEventTime time.Time
+}
+
+// CounterRates derives per-second rate gauges from consecutive CounterEvent totals, for counters whose metric name
+// matches a regex. A rate is reported as <metric name>.rate, either alongside the counter's usual series or instead of
+// it.
+//
+// Like CounterTracker, CounterRates needs to see consecutive totals of a counter, so the first total seen for a counter
+// yields no rate, and a decrease of the total is interpreted as a counter reset (the new total is taken as the increase).
+// State for counters that have not been seen for the TTL is removed.
+type CounterRates struct {
+	re      *regexp.Regexp
+	replace bool
+	rates   map[string]*rateData
+	mu      sync.Mutex // protects `rates`
+	ttl     time.Duration
+	logger  lager.Logger
+}
+
+// NewCounterRates creates a CounterRates for counters with names matching nameRegex. If replace is set, matching
+// counters are only reported as rates.
+func NewCounterRates(ctx context.Context, nameRegex string, replace bool, ttl time.Duration, logger lager.Logger) (*CounterRates, error) {
+	re, err := regexp.Compile(nameRegex)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compile counter rate regex: %v", err)
+	}
+	r := &CounterRates{
+		re:      re,
+		replace: replace,
+		rates:   map[string]*rateData{},
+		ttl:     ttl,
+		logger:  logger,
+	}
+
+	expirePeriod := time.Duration(ttl.Nanoseconds() / 2)
+	if expirePeriod > maxExpirePeriod {
+		expirePeriod = maxExpirePeriod
+	}
+	ticker := time.NewTicker(expirePeriod)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				r.expire()
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return r, nil
+}
+
+// Matches returns whether a rate should be derived for the metric with the given name.
+func (r *CounterRates) Matches(metricName string) bool {
+	return r.re.MatchString(metricName)
+}
+
+// Update accepts a counter name (which, as for CounterTracker.Update, needs to identify the time series), the counter
+// total and its event time, and returns the per-second rate since the previous total. ok is false when there is no
+// rate to report: for the first total seen, and for totals that are not newer than the previous one.
+func (r *CounterRates) Update(name string, value uint64, eventTime time.Time) (rate float64, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, present := r.rates[name]
+	if !present {
+		r.rates[name] = &rateData{lastValue: value, lastSeenTime: time.Now(), lastEventTime: eventTime}
+		return 0, false
+	}
+	d.lastSeenTime = time.Now()
+	if !eventTime.After(d.lastEventTime) {
+		return 0, false
+	}
+
+	delta := value - d.lastValue
+	if d.lastValue > value {
+		// Counter has been reset.
+		delta = value
+	}
+	rate = float64(delta) / eventTime.Sub(d.lastEventTime).Seconds()
+	d.lastValue = value
+	d.lastEventTime = eventTime
+	return rate, true
+}
+
+func (r *CounterRates) expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for name, d := range r.rates {
+		if time.Since(d.lastSeenTime) > r.ttl {
+			r.logger.Info("CounterRates", lager.Data{
+				"info": "removing expired counter",
+				"name": name,
+			})
+			delete(r.rates, name)
+			ratesExpiredCount.Increment()
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nozzle
+
+import (
+	"context"
+	"time"
+
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CounterRates", func() {
+	var (
+		subject *CounterRates
+		ctx     context.Context
+		cancel  context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+		var err error
+		subject, err = NewCounterRates(ctx, "requests", false, 50*time.Millisecond, &mocks.MockLogger{})
+		Expect(err).NotTo(HaveOccurred())
+		ratesExpiredCount.Set(0)
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("rejects an invalid regex", func() {
+		_, err := NewCounterRates(ctx, "(", false, time.Minute, &mocks.MockLogger{})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("computes per-second rates and handles counter resets", func() {
+		baseTime := time.Now()
+		_, ok := subject.Update("requests", 100, baseTime)
+		Expect(ok).To(BeFalse())
+
+		rate, ok := subject.Update("requests", 150, baseTime.Add(500*time.Millisecond))
+		Expect(ok).To(BeTrue())
+		Expect(rate).To(BeNumerically("~", 100, 1e-9))
+
+		rate, ok = subject.Update("requests", 20, baseTime.Add(1500*time.Millisecond))
+		Expect(ok).To(BeTrue())
+		Expect(rate).To(BeNumerically("~", 20, 1e-9))
+	})
+
+	It("ignores totals that are not newer than the previous one", func() {
+		baseTime := time.Now()
+		subject.Update("requests", 100, baseTime)
+		_, ok := subject.Update("requests", 110, baseTime)
+		Expect(ok).To(BeFalse())
+
+		rate, ok := subject.Update("requests", 110, baseTime.Add(time.Second))
+		Expect(ok).To(BeTrue())
+		Expect(rate).To(BeNumerically("~", 10, 1e-9))
+	})
+
+	It("expires idle counters", func() {
+		subject.Update("requests", 100, time.Now())
+		Eventually(ratesExpiredCount.IntValue).Should(Equal(1))
+
+		_, ok := subject.Update("requests", 110, time.Now())
+		Expect(ok).To(BeFalse())
+	})
+})
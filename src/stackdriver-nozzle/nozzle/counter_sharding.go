@@ -0,0 +1,416 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nozzle
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
+)
+
+const (
+	// CounterShardingPath is the HTTP path on which nozzles accept counters
+	// forwarded by their peers.
+	CounterShardingPath = "/counters"
+
+	// Forwarded batches are signed with an HMAC-SHA256 of the shared secret
+	// over the timestamp and the body, so the secret itself is never sent.
+	timestampHeader = "X-Counter-Timestamp"
+	signatureHeader = "X-Counter-Signature"
+	// signatureMaxAge is how far a batch's timestamp may be from the
+	// receiver's clock, which limits how long a captured batch can be
+	// replayed.
+	signatureMaxAge = time.Minute
+
+	ringReplicas       = 128
+	forwardQueueSize   = 10000
+	forwardBatchSize   = 500
+	forwardBatchPeriod = time.Second
+	maxBatchBytes      = 4 << 20
+)
+
+var (
+	countersForwarded       *telemetry.Counter
+	countersForwardedIn     *telemetry.Counter
+	countersForwardDropped  *telemetry.Counter
+	counterForwardErrs      *telemetry.Counter
+	counterPeersRefreshErrs *telemetry.Counter
+)
+
+func init() {
+	countersForwarded = telemetry.NewCounter(telemetry.Nozzle, "metrics.counters.forwarded.sent")
+	countersForwardedIn = telemetry.NewCounter(telemetry.Nozzle, "metrics.counters.forwarded.received")
+	countersForwardDropped = telemetry.NewCounter(telemetry.Nozzle, "metrics.counters.forwarded.dropped")
+	counterForwardErrs = telemetry.NewCounter(telemetry.Nozzle, "metrics.counters.forwarded.errors")
+	counterPeersRefreshErrs = telemetry.NewCounter(telemetry.Nozzle, "metrics.counters.peers.errors")
+}
+
+// A forwardedCounter is a CounterEvent that has been translated by one nozzle
+// and is sent to the peer that owns its time series.
+type forwardedCounter struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Total     uint64            `json:"total"`
+	EventTime time.Time         `json:"event_time"`
+}
+
+// counterReceiver handles counters this nozzle owns.
+type counterReceiver interface {
+	receiveCounter(name string, labels map[string]string, total uint64, eventTime time.Time)
+}
+
+// hashRing implements consistent hashing of time series over a set of peers,
+// so that adding or removing a peer only moves a fraction of the series.
+type hashRing struct {
+	hashes []uint32
+	owners map[uint32]string
+}
+
+func newHashRing(peers []string) *hashRing {
+	r := &hashRing{owners: map[uint32]string{}}
+	for _, peer := range peers {
+		for i := 0; i < ringReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(peer + "#" + strconv.Itoa(i)))
+			r.hashes = append(r.hashes, h)
+			r.owners[h] = peer
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+func (r *hashRing) owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+type peerQueue struct {
+	counters chan *forwardedCounter
+	cancel   context.CancelFunc
+}
+
+// CounterSharding lets several nozzles report cumulative counters while each
+// counter's state lives in exactly one of them. Every time series is owned by
+// one peer, chosen by consistent hashing of messages.Metric.Hash(); a nozzle
+// that receives a CounterEvent for a series it does not own forwards it to the
+// owner over HTTP, where it is fed to the owner's CounterTracker.
+//
+// All peers need to agree on the peer list for a series to have a single
+// owner. When the list changes, moved series restart on their new owner,
+// which (like after a restart) discards their first point.
+//
+// Forwarded counters are signed but not encrypted, so they can be read, though
+// not forged, by anyone who can see the traffic between nozzles.
+type CounterSharding struct {
+	ctx        context.Context
+	secret     string
+	logger     lager.Logger
+	client     *http.Client
+	lookupHost func(host string) ([]string, error)
+
+	mu       sync.RWMutex // protects self, ring, queues and receiver
+	self     string
+	ring     *hashRing
+	queues   map[string]*peerQueue
+	receiver counterReceiver
+}
+
+// NewCounterSharding creates a CounterSharding for the peer with address self
+// (as it appears in the peer list). Peers authenticate each other with the
+// shared secret. Call SetPeers to provide the peer list.
+func NewCounterSharding(ctx context.Context, self, secret string, logger lager.Logger) *CounterSharding {
+	return &CounterSharding{
+		ctx:        ctx,
+		secret:     secret,
+		logger:     logger,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		lookupHost: net.LookupHost,
+		self:       self,
+		ring:       newHashRing([]string{self}),
+		queues:     map[string]*peerQueue{},
+	}
+}
+
+// SetPeers updates the set of peers, given as host:port addresses. If the
+// list does not include self it is added, so a nozzle always owns something.
+func (cs *CounterSharding) SetPeers(peers []string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	set := map[string]bool{cs.self: true}
+	for _, p := range peers {
+		set[p] = true
+	}
+	all := make([]string, 0, len(set))
+	for p := range set {
+		all = append(all, p)
+	}
+	sort.Strings(all)
+
+	cs.ring = newHashRing(all)
+	for peer, q := range cs.queues {
+		if !set[peer] {
+			q.cancel()
+			delete(cs.queues, peer)
+		}
+	}
+	for peer := range set {
+		if _, ok := cs.queues[peer]; ok || peer == cs.self {
+			continue
+		}
+		ctx, cancel := context.WithCancel(cs.ctx)
+		q := &peerQueue{counters: make(chan *forwardedCounter, forwardQueueSize), cancel: cancel}
+		cs.queues[peer] = q
+		go cs.forward(ctx, peer, q.counters)
+	}
+}
+
+// setSelf changes the address this nozzle is known by to its peers.
+func (cs *CounterSharding) setSelf(self string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.self = self
+	if q, ok := cs.queues[self]; ok {
+		q.cancel()
+		delete(cs.queues, self)
+	}
+}
+
+// setReceiver sets where counters forwarded by peers go. Until it is set, they
+// are refused.
+func (cs *CounterSharding) setReceiver(receiver counterReceiver) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.receiver = receiver
+}
+
+// route returns true if the series identified by hash is owned by this
+// nozzle. Otherwise the counter is queued for its owner.
+func (cs *CounterSharding) route(hash string, c *forwardedCounter) bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	owner := cs.ring.owner(hash)
+	if owner == cs.self {
+		return true
+	}
+	select {
+	case cs.queues[owner].counters <- c:
+	default:
+		countersForwardDropped.Increment()
+	}
+	return false
+}
+
+func (cs *CounterSharding) forward(ctx context.Context, peer string, counters <-chan *forwardedCounter) {
+	ticker := time.NewTicker(forwardBatchPeriod)
+	defer ticker.Stop()
+
+	var batch []*forwardedCounter
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := cs.post(peer, batch); err != nil {
+			counterForwardErrs.Increment()
+			countersForwardDropped.Add(int64(len(batch)))
+			cs.logger.Error("CounterSharding.forward", err, lager.Data{"peer": peer, "count": len(batch)})
+		} else {
+			countersForwarded.Add(int64(len(batch)))
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case c := <-counters:
+			batch = append(batch, c)
+			if len(batch) >= forwardBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case <-ctx.Done():
+			send()
+			return
+		}
+	}
+}
+
+func (cs *CounterSharding) post(peer string, batch []*forwardedCounter) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+peer+CounterShardingPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, hex.EncodeToString(cs.sign(timestamp, body)))
+	resp, err := cs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	return nil
+}
+
+// sign returns the HMAC of a batch body sent at timestamp.
+func (cs *CounterSharding) sign(timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(cs.secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// verify reports whether a batch body was signed with the shared secret at a
+// timestamp within signatureMaxAge of now.
+func (cs *CounterSharding) verify(timestamp, signature string, body []byte) bool {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > signatureMaxAge || age < -signatureMaxAge {
+		return false
+	}
+	mac, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(mac, cs.sign(timestamp, body))
+}
+
+// ServeHTTP accepts counters forwarded by peers that know the shared secret.
+// They are always handled locally, even if this nozzle's view of the peers
+// differs from the sender's, so counters are never forwarded twice.
+func (cs *CounterSharding) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !cs.verify(r.Header.Get(timestampHeader), r.Header.Get(signatureHeader), body) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var batch []*forwardedCounter
+	if err := json.Unmarshal(body, &batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cs.mu.RLock()
+	receiver := cs.receiver
+	cs.mu.RUnlock()
+	if receiver == nil {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	for _, c := range batch {
+		receiver.receiveCounter(c.Name, c.Labels, c.Total, c.EventTime)
+	}
+	countersForwardedIn.Add(int64(len(batch)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DiscoverPeersDNS periodically resolves name and sets the peers to the
+// resulting addresses with the given port. Peers know each other by those
+// addresses, so if self is a host name that resolves to one of them, this
+// nozzle is known by that address from then on.
+func (cs *CounterSharding) DiscoverPeersDNS(name string, port int, period time.Duration) {
+	cs.mu.RLock()
+	self := cs.self
+	cs.mu.RUnlock()
+	selfHost, _, err := net.SplitHostPort(self)
+	if err != nil {
+		selfHost = self
+	}
+
+	refresh := func() {
+		addrs, err := cs.lookupHost(name)
+		if err != nil {
+			counterPeersRefreshErrs.Increment()
+			cs.logger.Error("CounterSharding.DiscoverPeersDNS", err, lager.Data{"name": name})
+			return
+		}
+		selfAddrs, err := cs.lookupHost(selfHost)
+		if err != nil {
+			counterPeersRefreshErrs.Increment()
+			cs.logger.Error("CounterSharding.DiscoverPeersDNS", err, lager.Data{"name": selfHost})
+			return
+		}
+		isSelf := map[string]bool{}
+		for _, addr := range selfAddrs {
+			isSelf[addr] = true
+		}
+
+		peers := make([]string, len(addrs))
+		for i, addr := range addrs {
+			peers[i] = net.JoinHostPort(addr, strconv.Itoa(port))
+			if isSelf[addr] {
+				cs.setSelf(peers[i])
+			}
+		}
+		cs.SetPeers(peers)
+	}
+
+	refresh()
+	ticker := time.NewTicker(period)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				refresh()
+			case <-cs.ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
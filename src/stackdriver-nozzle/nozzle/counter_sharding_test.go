@@ -0,0 +1,217 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nozzle
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type mockCounterReceiver struct {
+	sync.Mutex
+	received []forwardedCounter
+}
+
+func (m *mockCounterReceiver) receiveCounter(name string, labels map[string]string, total uint64, eventTime time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	m.received = append(m.received, forwardedCounter{Name: name, Labels: labels, Total: total, EventTime: eventTime})
+}
+
+func (m *mockCounterReceiver) counters() []forwardedCounter {
+	m.Lock()
+	defer m.Unlock()
+	return append([]forwardedCounter(nil), m.received...)
+}
+
+var _ = Describe("CounterSharding", func() {
+	Context("hashRing", func() {
+		keys := make([]string, 1000)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("series-%d", i)
+		}
+
+		It("spreads series over all peers", func() {
+			ring := newHashRing([]string{"a:8081", "b:8081", "c:8081"})
+			owned := map[string]int{}
+			for _, key := range keys {
+				owned[ring.owner(key)]++
+			}
+			Expect(owned).To(HaveLen(3))
+			for _, count := range owned {
+				Expect(count).To(BeNumerically(">", 150))
+			}
+		})
+
+		It("only moves series of a removed peer", func() {
+			before := newHashRing([]string{"a:8081", "b:8081", "c:8081"})
+			after := newHashRing([]string{"a:8081", "b:8081"})
+			for _, key := range keys {
+				if owner := before.owner(key); owner != "c:8081" {
+					Expect(after.owner(key)).To(Equal(owner))
+				}
+			}
+		})
+	})
+
+	Context("forwarding", func() {
+		var (
+			ctx      context.Context
+			cancel   context.CancelFunc
+			receiver *mockCounterReceiver
+			server   *httptest.Server
+			peer     string
+			subject  *CounterSharding
+		)
+
+		BeforeEach(func() {
+			ctx, cancel = context.WithCancel(context.Background())
+			receiver = &mockCounterReceiver{}
+			remote := NewCounterSharding(ctx, "remote", "secret", &mocks.MockLogger{})
+			remote.setReceiver(receiver)
+			server = httptest.NewServer(remote)
+			peer = strings.TrimPrefix(server.URL, "http://")
+
+			subject = NewCounterSharding(ctx, "self:8081", "secret", &mocks.MockLogger{})
+			subject.SetPeers([]string{peer})
+		})
+
+		AfterEach(func() {
+			cancel()
+			server.Close()
+		})
+
+		It("forwards counters owned by a peer and keeps its own", func() {
+			eventTime := time.Now()
+			var local, forwarded []string
+			for i := 0; i < 20; i++ {
+				name := fmt.Sprintf("series-%d", i)
+				if subject.route(name, &forwardedCounter{Name: name, Total: uint64(i), EventTime: eventTime}) {
+					local = append(local, name)
+				} else {
+					forwarded = append(forwarded, name)
+				}
+			}
+			Expect(local).NotTo(BeEmpty())
+			Expect(forwarded).NotTo(BeEmpty())
+
+			Eventually(receiver.counters, 3*time.Second).Should(HaveLen(len(forwarded)))
+			for i, c := range receiver.counters() {
+				Expect(c.Name).To(Equal(forwarded[i]))
+				Expect(c.EventTime).To(BeTemporally("==", eventTime))
+			}
+		})
+
+		It("owns everything again once peers are gone", func() {
+			subject.SetPeers(nil)
+			for i := 0; i < 20; i++ {
+				name := fmt.Sprintf("series-%d", i)
+				Expect(subject.route(name, &forwardedCounter{Name: name})).To(BeTrue())
+			}
+		})
+
+		postAt := func(secret string, at time.Time, body string) int {
+			req, err := http.NewRequest(http.MethodPost, server.URL+CounterShardingPath, strings.NewReader(body))
+			Expect(err).NotTo(HaveOccurred())
+			timestamp := strconv.FormatInt(at.Unix(), 10)
+			signer := &CounterSharding{secret: secret}
+			req.Header.Set(timestampHeader, timestamp)
+			req.Header.Set(signatureHeader, hex.EncodeToString(signer.sign(timestamp, []byte(body))))
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		post := func(secret, body string) int {
+			return postAt(secret, time.Now(), body)
+		}
+
+		It("knows itself by its address among peers discovered by DNS", func() {
+			subject = NewCounterSharding(ctx, "nozzle-0:8081", "secret", &mocks.MockLogger{})
+			subject.lookupHost = func(host string) ([]string, error) {
+				switch host {
+				case "nozzles":
+					return []string{"10.0.0.1", "10.0.0.2"}, nil
+				case "nozzle-0":
+					return []string{"10.0.0.2"}, nil
+				}
+				return nil, fmt.Errorf("no such host %q", host)
+			}
+			subject.DiscoverPeersDNS("nozzles", 8081, time.Hour)
+
+			Expect(subject.self).To(Equal("10.0.0.2:8081"))
+			Expect(subject.queues).To(HaveLen(1))
+			Expect(subject.queues).To(HaveKey("10.0.0.1:8081"))
+			owners := map[string]bool{}
+			for _, owner := range subject.ring.owners {
+				owners[owner] = true
+			}
+			Expect(owners).To(Equal(map[string]bool{"10.0.0.1:8081": true, "10.0.0.2:8081": true}))
+		})
+
+		It("rejects malformed batches", func() {
+			Expect(post("secret", "{")).To(Equal(http.StatusBadRequest))
+			Expect(receiver.counters()).To(BeEmpty())
+		})
+
+		It("rejects peers without the secret", func() {
+			Expect(post("wrong", `[{"name":"series-0"}]`)).To(Equal(http.StatusUnauthorized))
+			Expect(receiver.counters()).To(BeEmpty())
+
+			resp, err := http.Post(server.URL+CounterShardingPath, "application/json", strings.NewReader(`[{"name":"series-0"}]`))
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("rejects batches signed too long ago", func() {
+			Expect(postAt("secret", time.Now().Add(-2*signatureMaxAge), `[{"name":"series-0"}]`)).To(Equal(http.StatusUnauthorized))
+			Expect(post("secret", `[{"name":"series-0"}]`)).To(Equal(http.StatusNoContent))
+			Expect(receiver.counters()).To(HaveLen(1))
+		})
+
+		It("does not send the secret", func() {
+			var headers http.Header
+			var body []byte
+			server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				headers = r.Header
+				body, _ = ioutil.ReadAll(r.Body)
+				w.WriteHeader(http.StatusNoContent)
+			})
+			Expect(subject.post(peer, []*forwardedCounter{{Name: "series-0"}})).To(Succeed())
+
+			for _, values := range headers {
+				for _, v := range values {
+					Expect(v).NotTo(ContainSubstring("secret"))
+				}
+			}
+			Expect(string(body)).NotTo(ContainSubstring("secret"))
+		})
+	})
+})
@@ -18,7 +18,6 @@ package nozzle
 
 import (
 	"context"
-	"expvar"
 	"math"
 	"sync"
 	"time"
@@ -37,7 +36,7 @@ func init() {
 
 type counterData struct {
 	startTime     time.Time
-	totalValue    *expvar.Int
+	totalValue    int64
 	lastValue     uint64
 	lastSeenTime  time.Time
 	lastEventTime time.Time
@@ -114,7 +113,7 @@ func (t *CounterTracker) Update(name string, value uint64, eventTime time.Time)
 
 	c, present := t.counters[name]
 	if !present {
-		c = t.newCounterData(name, eventTime)
+		c = t.newCounterData(eventTime)
 		t.counters[name] = c
 	} else {
 		var delta uint64
@@ -124,34 +123,24 @@ func (t *CounterTracker) Update(name string, value uint64, eventTime time.Time)
 		} else {
 			delta = value - c.lastValue
 		}
-		if uint64(c.totalValue.Value())+delta > math.MaxInt64 {
+		if uint64(c.totalValue)+delta > math.MaxInt64 {
 			// Accumulated value overflows int64, we need to reset the counter.
-			c.totalValue.Set(int64(delta))
+			c.totalValue = int64(delta)
 			c.startTime = c.lastEventTime
 		} else {
-			c.totalValue.Add(int64(delta))
+			c.totalValue += int64(delta)
 		}
 	}
 	c.lastValue = value
 	c.lastSeenTime = time.Now()
 	c.lastEventTime = eventTime
-	return c.totalValue.Value(), c.startTime
+	return c.totalValue, c.startTime
 }
 
-func (t *CounterTracker) newCounterData(name string, eventTime time.Time) *counterData {
-	var v *expvar.Int
-	existing := expvar.Get(name)
-	if existing != nil {
-		// There was a previous counter with this name; use it instead, but reset value to 0.
-		v = existing.(*expvar.Int)
-		v.Set(0)
-	} else {
-		v = expvar.NewInt(name)
-	}
+func (t *CounterTracker) newCounterData(eventTime time.Time) *counterData {
 	// Initialize counter state for a new counter.
 	return &counterData{
-		totalValue: v,
-		startTime:  eventTime,
+		startTime: eventTime,
 	}
 }
 
@@ -165,10 +154,8 @@ func (t *CounterTracker) expire() {
 				"info":    "removing expired counter",
 				"name":    name,
 				"counter": counter,
-				"value":   t.counters[name].totalValue.Value(),
+				"value":   counter.totalValue,
 			})
-			// Reset values to -1 to make expired counters visible in /debug/vars.
-			t.counters[name].totalValue.Set(-1)
 			delete(t.counters, name)
 			countersExpiredCount.Increment()
 		}
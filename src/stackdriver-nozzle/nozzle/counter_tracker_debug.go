@@ -0,0 +1,99 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nozzle
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// CounterTrackerDebugPath is the path on the debug server (see
+// config.DebugNozzle) that lists the counters held by the CounterTracker.
+const CounterTrackerDebugPath = "/debug/counters"
+
+type counterDebugInfo struct {
+	Name          string    `json:"name"`
+	StartTime     time.Time `json:"start_time"`
+	TotalValue    int64     `json:"total_value"`
+	LastValue     uint64    `json:"last_value"`
+	LastSeenTime  time.Time `json:"last_seen_time"`
+	LastEventTime time.Time `json:"last_event_time"`
+}
+
+type counterDebugResponse struct {
+	Live     int                 `json:"live"`
+	Matched  int                 `json:"matched"`
+	Counters []*counterDebugInfo `json:"counters"`
+}
+
+// ServeHTTP lists live counters sorted by name. The optional "match" query
+// parameter is a regular expression that counter names (metric name followed
+// by flattened labels) must match, and "limit" caps the number of counters
+// listed.
+func (t *CounterTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var match *regexp.Regexp
+	if expr := r.URL.Query().Get("match"); expr != "" {
+		var err error
+		if match, err = regexp.Compile(expr); err != nil {
+			http.Error(w, "invalid match: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := -1
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp := t.debugInfo(match)
+	sort.Slice(resp.Counters, func(i, j int) bool { return resp.Counters[i].Name < resp.Counters[j].Name })
+	if limit >= 0 && limit < len(resp.Counters) {
+		resp.Counters = resp.Counters[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (t *CounterTracker) debugInfo(match *regexp.Regexp) *counterDebugResponse {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	resp := &counterDebugResponse{Live: len(t.counters), Counters: []*counterDebugInfo{}}
+	for name, c := range t.counters {
+		if match != nil && !match.MatchString(name) {
+			continue
+		}
+		resp.Counters = append(resp.Counters, &counterDebugInfo{
+			Name:          name,
+			StartTime:     c.startTime,
+			TotalValue:    c.totalValue,
+			LastValue:     c.lastValue,
+			LastSeenTime:  c.lastSeenTime,
+			LastEventTime: c.lastEventTime,
+		})
+	}
+	resp.Matched = len(resp.Counters)
+	return resp
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nozzle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
+)
+
+const snapshotVersion = 1
+
+var (
+	snapshotErrs *telemetry.CounterMap
+
+	snapshotErrSave    *telemetry.Counter
+	snapshotErrCorrupt *telemetry.Counter
+	snapshotErrStale   *telemetry.Counter
+
+	snapshotsSaved   *telemetry.Counter
+	countersRestored *telemetry.Counter
+)
+
+func init() {
+	snapshotErrs = telemetry.NewCounterMap(telemetry.Nozzle, "metrics.counters.snapshot.errors", "error_type")
+
+	snapshotErrSave = snapshotErrs.MustCounter("save")
+	snapshotErrCorrupt = snapshotErrs.MustCounter("corrupt")
+	snapshotErrStale = snapshotErrs.MustCounter("stale")
+
+	snapshotsSaved = telemetry.NewCounter(telemetry.Nozzle, "metrics.counters.snapshot.saved")
+	countersRestored = telemetry.NewCounter(telemetry.Nozzle, "metrics.counters.restored")
+}
+
+var errStaleSnapshot = errors.New("snapshot is older than the counter TTL")
+
+type counterSnapshot struct {
+	StartTime     time.Time `json:"start_time"`
+	TotalValue    int64     `json:"total_value"`
+	LastValue     uint64    `json:"last_value"`
+	LastEventTime time.Time `json:"last_event_time"`
+}
+
+type trackerSnapshot struct {
+	Version  int                         `json:"version"`
+	SavedAt  time.Time                   `json:"saved_at"`
+	Checksum string                      `json:"checksum"`
+	Counters map[string]*counterSnapshot `json:"counters"`
+}
+
+func (s *trackerSnapshot) checksum() (string, error) {
+	data, err := json.Marshal(s.Counters)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// snapshot captures the current state of all tracked counters.
+func (t *CounterTracker) snapshot() *trackerSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := &trackerSnapshot{
+		Version:  snapshotVersion,
+		SavedAt:  time.Now(),
+		Counters: make(map[string]*counterSnapshot, len(t.counters)),
+	}
+	for name, c := range t.counters {
+		s.Counters[name] = &counterSnapshot{
+			StartTime:     c.startTime,
+			TotalValue:    c.totalValue,
+			LastValue:     c.lastValue,
+			LastEventTime: c.lastEventTime,
+		}
+	}
+	return s
+}
+
+// restore loads counter state from a snapshot. Counters are considered last
+// seen when the snapshot was saved, so they expire as if the nozzle had kept
+// running.
+func (t *CounterTracker) restore(s *trackerSnapshot) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	restored := 0
+	for name, cs := range s.Counters {
+		if _, present := t.counters[name]; present {
+			continue
+		}
+		c := t.newCounterData(cs.StartTime)
+		c.totalValue = cs.TotalValue
+		c.lastValue = cs.LastValue
+		c.lastEventTime = cs.LastEventTime
+		c.lastSeenTime = s.SavedAt
+		t.counters[name] = c
+		restored++
+	}
+	return restored
+}
+
+// SaveSnapshot atomically writes the tracker state to path.
+func (t *CounterTracker) SaveSnapshot(path string) error {
+	s := t.snapshot()
+	sum, err := s.checksum()
+	if err != nil {
+		return err
+	}
+	s.Checksum = sum
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot restores tracker state from a snapshot written by SaveSnapshot,
+// and returns the number of counters restored. A snapshot older than the
+// tracker's TTL is rejected, since its counters would already have expired.
+func (t *CounterTracker) LoadSnapshot(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	s := &trackerSnapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return 0, fmt.Errorf("corrupt snapshot: %v", err)
+	}
+	if s.Version != snapshotVersion {
+		return 0, fmt.Errorf("corrupt snapshot: unsupported version %d", s.Version)
+	}
+	sum, err := s.checksum()
+	if err != nil {
+		return 0, fmt.Errorf("corrupt snapshot: %v", err)
+	}
+	if sum != s.Checksum {
+		return 0, errors.New("corrupt snapshot: checksum mismatch")
+	}
+	if time.Since(s.SavedAt) > t.ttl {
+		return 0, errStaleSnapshot
+	}
+
+	return t.restore(s), nil
+}
+
+// PersistCounterTracker restores tracker state from the snapshot at path, if
+// there is a usable one, and then saves a new snapshot every period and once
+// more when ctx is done. Unusable snapshots are logged and ignored, so the
+// tracker starts from scratch as it would without persistence.
+func PersistCounterTracker(ctx context.Context, t *CounterTracker, path string, period time.Duration, logger lager.Logger) {
+	restored, err := t.LoadSnapshot(path)
+	switch {
+	case err == nil:
+		countersRestored.Add(int64(restored))
+		logger.Info("CounterTracker", lager.Data{"info": "restored counters from snapshot", "path": path, "count": restored})
+	case os.IsNotExist(err):
+	case err == errStaleSnapshot:
+		snapshotErrStale.Increment()
+		logger.Info("CounterTracker", lager.Data{"info": "ignoring stale snapshot", "path": path})
+	default:
+		snapshotErrCorrupt.Increment()
+		logger.Error("CounterTracker", err, lager.Data{"info": "ignoring unreadable snapshot", "path": path})
+	}
+
+	save := func() {
+		if err := t.SaveSnapshot(path); err != nil {
+			snapshotErrSave.Increment()
+			logger.Error("CounterTracker", err, lager.Data{"info": "saving snapshot failed", "path": path})
+			return
+		}
+		snapshotsSaved.Increment()
+	}
+
+	ticker := time.NewTicker(period)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				save()
+			case <-ctx.Done():
+				ticker.Stop()
+				save()
+				return
+			}
+		}
+	}()
+}
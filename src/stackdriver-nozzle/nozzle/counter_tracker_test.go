@@ -18,7 +18,15 @@ package nozzle
 
 import (
 	"context"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/mocks"
@@ -103,4 +111,142 @@ var _ = Describe("CounterTracker", func() {
 			}
 		}
 	})
+
+	It("does not publish counters as expvars", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		subject = NewCounterTracker(ctx, counterTTL, logger)
+
+		testCounterTracker(subject, "unpublished", time.Now(), []uint64{1, 2}, []int64{1})
+		Expect(expvar.Get("unpublished")).To(BeNil())
+	})
+
+	Context("debug endpoint", func() {
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+
+		BeforeEach(func() {
+			ctx, cancel = context.WithCancel(context.Background())
+			subject = NewCounterTracker(ctx, time.Minute, logger)
+			baseTime := time.Now()
+			testCounterTracker(subject, "a.requests,app=1", baseTime, []uint64{10, 15}, []int64{5})
+			testCounterTracker(subject, "a.requests,app=2", baseTime, []uint64{7}, nil)
+			testCounterTracker(subject, "b.errors", baseTime, []uint64{1, 3, 4}, []int64{2, 3})
+		})
+
+		AfterEach(func() {
+			cancel()
+		})
+
+		get := func(query string) (*httptest.ResponseRecorder, *counterDebugResponse) {
+			rec := httptest.NewRecorder()
+			subject.ServeHTTP(rec, httptest.NewRequest("GET", CounterTrackerDebugPath+query, nil))
+			resp := &counterDebugResponse{}
+			if rec.Code == http.StatusOK {
+				Expect(json.Unmarshal(rec.Body.Bytes(), resp)).To(Succeed())
+			}
+			return rec, resp
+		}
+
+		It("lists live counters", func() {
+			_, resp := get("")
+			Expect(resp.Live).To(Equal(3))
+			Expect(resp.Counters).To(HaveLen(3))
+			Expect(resp.Counters[2].Name).To(Equal("b.errors"))
+			Expect(resp.Counters[2].TotalValue).To(BeNumerically("==", 3))
+			Expect(resp.Counters[2].LastValue).To(BeNumerically("==", 4))
+			Expect(resp.Counters[2].LastSeenTime).To(BeTemporally("~", time.Now(), time.Second))
+		})
+
+		It("filters and limits counters", func() {
+			_, resp := get("?match=^a%5C.requests&limit=1")
+			Expect(resp.Live).To(Equal(3))
+			Expect(resp.Matched).To(Equal(2))
+			Expect(resp.Counters).To(HaveLen(1))
+			Expect(resp.Counters[0].Name).To(Equal("a.requests,app=1"))
+		})
+
+		It("rejects invalid parameters", func() {
+			rec, _ := get("?match=(")
+			Expect(rec.Code).To(Equal(http.StatusBadRequest))
+			rec, _ = get("?limit=-1")
+			Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("with snapshots", func() {
+		var (
+			dir  string
+			path string
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "counter-tracker")
+			Expect(err).NotTo(HaveOccurred())
+			path = filepath.Join(dir, "snapshot.json")
+			counterTTL = time.Minute
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("restores counters saved by a previous tracker", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			baseTime := time.Now()
+
+			subject = NewCounterTracker(ctx, counterTTL, logger)
+			testCounterTracker(subject, "snapshotted", baseTime, []uint64{10, 15, 25}, []int64{5, 15})
+			Expect(subject.SaveSnapshot(path)).To(Succeed())
+
+			restarted := NewCounterTracker(ctx, counterTTL, logger)
+			Expect(restarted.LoadSnapshot(path)).To(Equal(1))
+
+			// The counter continues where it left off, keeping its start time.
+			total, st := restarted.Update("snapshotted", 30, baseTime.Add(time.Second))
+			Expect(total).To(BeNumerically("==", 20))
+			Expect(st).To(BeTemporally("==", baseTime))
+		})
+
+		It("rejects stale snapshots", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			subject = NewCounterTracker(ctx, 50*time.Millisecond, logger)
+			subject.Update("stale", 10, time.Now())
+			Expect(subject.SaveSnapshot(path)).To(Succeed())
+			time.Sleep(100 * time.Millisecond)
+
+			restarted := NewCounterTracker(ctx, 50*time.Millisecond, logger)
+			_, err := restarted.LoadSnapshot(path)
+			Expect(err).To(Equal(errStaleSnapshot))
+		})
+
+		It("rejects corrupt snapshots", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			subject = NewCounterTracker(ctx, counterTTL, logger)
+			subject.Update("corrupt", 10, time.Now())
+			Expect(subject.SaveSnapshot(path)).To(Succeed())
+
+			data, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			tampered := strings.Replace(string(data), `"total_value":0`, `"total_value":9`, 1)
+			Expect(tampered).NotTo(Equal(string(data)))
+			Expect(ioutil.WriteFile(path, []byte(tampered), 0600)).To(Succeed())
+
+			restarted := NewCounterTracker(ctx, counterTTL, logger)
+			_, err = restarted.LoadSnapshot(path)
+			Expect(err).To(MatchError(ContainSubstring("checksum mismatch")))
+
+			Expect(ioutil.WriteFile(path, []byte("{not json"), 0600)).To(Succeed())
+			_, err = restarted.LoadSnapshot(path)
+			Expect(err).To(HaveOccurred())
+		})
+	})
 })
@@ -17,73 +17,199 @@
 package nozzle
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/stackdriver"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
-const httpPrefix telemetry.MetricPrefix = "app-http"
+const httpMetricPrefix = "app-http."
 
 var (
-	requestCount *telemetry.CounterMap
-	responseCode *telemetry.CounterMap
+	httpSeriesExpiredCount *telemetry.Counter
 
-	defaultLabels = []string{"job", "index", "applicationPath", "instanceIndex"}
+	httpLabelKeys = []string{"foundation", "job", "index", "applicationPath", "app_guid", "space_guid", "org_guid", "instanceIndex"}
 )
 
 func init() {
-	requestCount = telemetry.NewCounterMap(httpPrefix, "request_count",
-		defaultLabels...)
-	responseCode = telemetry.NewCounterMap(httpPrefix, "response_code",
-		append(defaultLabels, "code")...)
+	httpSeriesExpiredCount = telemetry.NewCounter(telemetry.Nozzle, "metrics.app_http.expired")
+}
+
+type httpCounter struct {
+	startTime     time.Time
+	value         int64
+	lastSeenTime  time.Time
+	lastEventTime time.Time
 }
 
 type httpSink struct {
-	logger     lager.Logger
-	labelMaker LabelMaker
+	pathPrefix    string
+	logger        lager.Logger
+	labelMaker    LabelMaker
+	controls      *AppControls
+	metricAdapter stackdriver.MetricAdapter
+	ttl           time.Duration
+	instanceLabel string
+
+	mu       sync.Mutex // protects `counters`
+	counters map[string]*httpCounter
 }
 
 // NewHTTPSink returns a Sink that can receive sonde HttpStartStop events
 // and generate per-application HTTP metrics from them.
-func NewHTTPSink(logger lager.Logger, labelMaker LabelMaker) Sink {
-	return &httpSink{
-		logger:     logger,
-		labelMaker: labelMaker,
+//
+// The metrics are cumulative counters sent to the provided MetricAdapter.
+// Series that have not seen a request for the given ttl are forgotten, so
+// counters for deleted applications eventually stop being reported.
+// Applications that opted out of metrics through their annotations are
+// skipped when controls is non-nil.
+//
+// Each nozzle only counts the requests it receives. If instanceLabel is set,
+// every series gets a "nozzle" label with its value, so that several nozzles
+// report separate counters instead of overwriting each other's.
+func NewHTTPSink(ctx context.Context, logger lager.Logger, pathPrefix string, labelMaker LabelMaker, controls *AppControls, metricAdapter stackdriver.MetricAdapter, ttl time.Duration, instanceLabel string) Sink {
+	sink := &httpSink{
+		pathPrefix:    pathPrefix,
+		logger:        logger,
+		labelMaker:    labelMaker,
+		controls:      controls,
+		metricAdapter: metricAdapter,
+		ttl:           ttl,
+		instanceLabel: instanceLabel,
+		counters:      map[string]*httpCounter{},
 	}
+
+	expirePeriod := time.Duration(ttl.Nanoseconds() / 2)
+	if expirePeriod > maxExpirePeriod {
+		expirePeriod = maxExpirePeriod
+	}
+	ticker := time.NewTicker(expirePeriod)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				sink.expire()
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return sink
 }
 
 func (sink *httpSink) Receive(envelope *events.Envelope) {
-	if envelope.GetEventType() != events.Envelope_HttpStartStop {
+	if envelope.GetEventType() != events.Envelope_HttpStartStop || !sink.controls.MetricsEnabled(envelope) {
 		return
 	}
 
 	labels := sink.labelMaker.MetricLabels(envelope, false)
-	if labels["applicationPath"] == "" {
+	if labels["applicationPath"] == "" && labels["app_guid"] == "" {
 		// We're only interested in HTTP traffic passing through the gorouters
 		// to known applications.
 		return
 	}
-	labelValues := defaultLabelValues(labels)
 
-	if rcc, err := requestCount.Counter(labelValues...); err == nil {
-		rcc.Increment()
-	} else {
-		sink.logger.Error("httpSink.Receive", fmt.Errorf("incrementing requestCount: %v", err))
+	timestamp := time.Duration(envelope.GetTimestamp())
+	eventTime := time.Unix(
+		int64(timestamp/time.Second),
+		int64(timestamp%time.Second),
+	)
+
+	hss := envelope.GetHttpStartStop()
+	requestLabels := httpLabels(labels)
+	requestLabels["method"] = hss.GetMethod().String()
+	requestLabels["statusClass"] = statusClass(hss.GetStatusCode())
+
+	responseLabels := httpLabels(labels)
+	responseLabels["code"] = fmt.Sprintf("%d", hss.GetStatusCode())
+
+	if sink.instanceLabel != "" {
+		requestLabels["nozzle"] = sink.instanceLabel
+		responseLabels["nozzle"] = sink.instanceLabel
+	}
+
+	sink.metricAdapter.PostMetrics([]*messages.Metric{
+		sink.increment("request_count", requestLabels, eventTime),
+		sink.increment("response_code", responseLabels, eventTime),
+	})
+}
+
+// increment adds one to the counter identified by name and labels, and returns
+// a cumulative metric carrying its new value.
+func (sink *httpSink) increment(name string, labels map[string]string, eventTime time.Time) *messages.Metric {
+	buf := bytes.Buffer{}
+	if sink.pathPrefix != "" {
+		buf.WriteString(sink.pathPrefix)
+		buf.WriteString("/")
 	}
-	code := fmt.Sprintf("%d", envelope.GetHttpStartStop().GetStatusCode())
-	if rcc, err := responseCode.Counter(append(labelValues, code)...); err == nil {
-		rcc.Increment()
-	} else {
-		sink.logger.Error("httpSink.Receive", fmt.Errorf("incrementing responseCode: %v", err))
+	buf.WriteString(httpMetricPrefix)
+	buf.WriteString(name)
+
+	metric := &messages.Metric{
+		Name:   buf.String(),
+		Labels: labels,
+		Type:   events.Envelope_CounterEvent,
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	hash := metric.Hash()
+	c, present := sink.counters[hash]
+	if !present {
+		// The counter was zero just before the first request we see, which
+		// also gives the first point the non-zero interval Stackdriver needs.
+		c = &httpCounter{startTime: eventTime.Add(-time.Millisecond)}
+		sink.counters[hash] = c
+	}
+	c.value++
+	c.lastSeenTime = time.Now()
+	// Events from several gorouters are not guaranteed to arrive in timestamp
+	// order; never move a counter's end time backwards.
+	if eventTime.After(c.lastEventTime) {
+		c.lastEventTime = eventTime
+	}
+
+	metric.IntValue = c.value
+	metric.StartTime = c.startTime
+	metric.EventTime = c.lastEventTime
+	return metric
+}
+
+func (sink *httpSink) expire() {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	for hash, counter := range sink.counters {
+		if time.Since(counter.lastSeenTime) > sink.ttl {
+			delete(sink.counters, hash)
+			httpSeriesExpiredCount.Increment()
+		}
 	}
 }
 
-func defaultLabelValues(labels map[string]string) []string {
-	labelValues := make([]string, len(defaultLabels))
-	for i, key := range defaultLabels {
-		labelValues[i] = labels[key]
+func httpLabels(labels map[string]string) map[string]string {
+	labelValues := make(map[string]string, len(httpLabelKeys)+3)
+	for _, key := range httpLabelKeys {
+		if v, ok := labels[key]; ok {
+			labelValues[key] = v
+		}
 	}
 	return labelValues
 }
+
+// statusClass buckets an HTTP status code into its class, e.g. 404 -> "4xx".
+func statusClass(code int32) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dxx", code/100)
+}
@@ -17,12 +17,13 @@
 package nozzle
 
 import (
+	"context"
 	"strconv"
+	"time"
 
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/cloudfoundry"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/mocks"
-	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/golang/protobuf/proto"
 	. "github.com/onsi/ginkgo"
@@ -60,47 +61,55 @@ func (ta testApp) Events(count int, code, instanceIndex int32) []*events.Envelop
 		ret[i] = &events.Envelope{
 			Origin:    proto.String("origin"),
 			EventType: events.Envelope_HttpStartStop.Enum(),
+			Timestamp: proto.Int64(time.Now().UnixNano()),
 			Job:       proto.String("router"),
 			Index:     proto.String(ta.Index()),
 			HttpStartStop: &events.HttpStartStop{
 				StatusCode:    &code,
 				InstanceIndex: &instanceIndex,
 				ApplicationId: ta.UUID(),
+				Method:        events.Method_GET.Enum(),
 			},
 		}
 	}
 	return ret
 }
 
-func (ta testApp) RequestCount(instanceIndex int) int {
-	key := messages.Flatten(map[string]string{
+func (ta testApp) labels(instanceIndex int) map[string]string {
+	return map[string]string{
+		"foundation":      "cf",
 		"job":             "router",
 		"index":           ta.Index(),
 		"applicationPath": makePath(ta.AppInfo()),
 		"instanceIndex":   strconv.Itoa(instanceIndex),
-	})
-	if ctr, ok := requestCount.Get(key).(*telemetry.Counter); ok {
-		return int(ctr.Value())
 	}
-	// Zero is a perfectly valid counter value, -1 not so much.
-	// Returning a separate error here is inconvenient.
-	return -1
 }
 
-func (ta testApp) ResponseCode(code, instanceIndex int) int {
-	key := messages.Flatten(map[string]string{
-		"job":             "router",
-		"index":           ta.Index(),
-		"applicationPath": makePath(ta.AppInfo()),
-		"instanceIndex":   strconv.Itoa(instanceIndex),
-		"code":            strconv.Itoa(code),
-	})
-	if ctr, ok := responseCode.Get(key).(*telemetry.Counter); ok {
-		return int(ctr.Value())
+// lastValue returns the value of the most recently posted point for a series.
+// Zero is a perfectly valid counter value, -1 not so much.
+// Returning a separate error here is inconvenient.
+func lastValue(posted []messages.Metric, name string, labels map[string]string) int {
+	hash := (&messages.Metric{Name: name, Labels: labels}).Hash()
+	value := -1
+	for _, m := range posted {
+		if m.Hash() == hash {
+			value = int(m.IntValue)
+		}
 	}
-	// Zero is a perfectly valid counter value, -1 not so much.
-	// Returning a separate error here is inconvenient.
-	return -1
+	return value
+}
+
+func (ta testApp) RequestCount(posted []messages.Metric, statusClass string, instanceIndex int) int {
+	labels := ta.labels(instanceIndex)
+	labels["method"] = "GET"
+	labels["statusClass"] = statusClass
+	return lastValue(posted, "firehose/app-http.request_count", labels)
+}
+
+func (ta testApp) ResponseCode(posted []messages.Metric, code, instanceIndex int) int {
+	labels := ta.labels(instanceIndex)
+	labels["code"] = strconv.Itoa(code)
+	return lastValue(posted, "firehose/app-http.response_code", labels)
 }
 
 var testApps = []testApp{
@@ -111,26 +120,36 @@ var testApps = []testApp{
 
 var _ = Describe("HttpSink", func() {
 	var (
-		subject    Sink
-		labelMaker LabelMaker
-		foundation = "cf"
-		air        = &mocks.AppInfoRepository{AppInfoMap: map[string]cloudfoundry.AppInfo{}}
+		subject      Sink
+		labelMaker   LabelMaker
+		metricBuffer *mocks.MetricsBuffer
+		ctx          context.Context
+		cancel       context.CancelFunc
+		foundation   = "cf"
+		air          = &mocks.AppInfoRepository{AppInfoMap: map[string]cloudfoundry.AppInfo{}}
 	)
 
 	BeforeEach(func() {
 		for _, app := range testApps {
 			air.AppInfoMap[app.GUID()] = app.AppInfo()
 		}
-		labelMaker = NewLabelMaker(air, foundation)
-		subject = NewHTTPSink(&mocks.MockLogger{}, labelMaker)
+		labelMaker = NewLabelMaker(air, foundation, AppLabelsPath, false, nil, false)
+		metricBuffer = &mocks.MetricsBuffer{}
+		ctx, cancel = context.WithCancel(context.Background())
+		subject = NewHTTPSink(ctx, &mocks.MockLogger{}, "firehose", labelMaker, nil, metricBuffer, time.Minute, "")
 	})
 
-	It("increments counters for requests", func() {
-		receive := func(es []*events.Envelope) {
-			for _, e := range es {
-				subject.Receive(e)
-			}
+	AfterEach(func() {
+		cancel()
+	})
+
+	receive := func(es []*events.Envelope) {
+		for _, e := range es {
+			subject.Receive(e)
 		}
+	}
+
+	It("increments counters for requests", func() {
 		// AppOne has 2 instances.
 		// The first serves 20 "200 OK" responses.
 		receive(testApps[0].Events(20, 200, 0))
@@ -148,23 +167,69 @@ var _ = Describe("HttpSink", func() {
 		// It serves 8 302 redirects.
 		receive(testApps[2].Events(8, 302, 0))
 
-		Expect(testApps[0].RequestCount(0)).To(Equal(20))
-		Expect(testApps[0].ResponseCode(200, 0)).To(Equal(20))
-		Expect(testApps[0].ResponseCode(500, 0)).To(Equal(-1))
+		posted := metricBuffer.PostedMetrics
 
-		Expect(testApps[0].RequestCount(1)).To(Equal(20))
-		Expect(testApps[0].ResponseCode(200, 1)).To(Equal(18))
-		Expect(testApps[0].ResponseCode(500, 1)).To(Equal(2))
+		Expect(testApps[0].RequestCount(posted, "2xx", 0)).To(Equal(20))
+		Expect(testApps[0].RequestCount(posted, "5xx", 0)).To(Equal(-1))
+		Expect(testApps[0].ResponseCode(posted, 200, 0)).To(Equal(20))
+		Expect(testApps[0].ResponseCode(posted, 500, 0)).To(Equal(-1))
+
+		Expect(testApps[0].RequestCount(posted, "2xx", 1)).To(Equal(18))
+		Expect(testApps[0].RequestCount(posted, "5xx", 1)).To(Equal(2))
+		Expect(testApps[0].ResponseCode(posted, 200, 1)).To(Equal(18))
+		Expect(testApps[0].ResponseCode(posted, 500, 1)).To(Equal(2))
+
+		Expect(testApps[0].RequestCount(posted, "2xx", 2)).To(Equal(-1))
+		Expect(testApps[0].ResponseCode(posted, 200, 2)).To(Equal(-1))
+
+		Expect(testApps[1].RequestCount(posted, "2xx", 0)).To(Equal(15))
+		Expect(testApps[1].RequestCount(posted, "4xx", 0)).To(Equal(10))
+		Expect(testApps[1].ResponseCode(posted, 200, 0)).To(Equal(15))
+		Expect(testApps[1].ResponseCode(posted, 401, 0)).To(Equal(3))
+		Expect(testApps[1].ResponseCode(posted, 404, 0)).To(Equal(7))
+
+		Expect(testApps[2].RequestCount(posted, "3xx", 0)).To(Equal(8))
+		Expect(testApps[2].ResponseCode(posted, 302, 0)).To(Equal(8))
+	})
+
+	It("reports cumulative metrics with a stable start time", func() {
+		receive(testApps[0].Events(3, 200, 0))
+
+		posted := metricBuffer.PostedMetrics
+		Expect(posted).To(HaveLen(6))
+		for _, m := range posted {
+			Expect(m.IsCumulative()).To(BeTrue())
+			Expect(m.StartTime.Before(m.EventTime)).To(BeTrue())
+			Expect(m.StartTime).To(Equal(posted[0].StartTime))
+		}
+	})
+
+	It("labels series with the nozzle instance", func() {
+		subject = NewHTTPSink(ctx, &mocks.MockLogger{}, "firehose", labelMaker, nil, metricBuffer, time.Minute, "nozzle-0")
+		receive(testApps[0].Events(1, 200, 0))
+
+		posted := metricBuffer.PostedMetrics
+		Expect(posted).To(HaveLen(2))
+		for _, m := range posted {
+			Expect(m.Labels).To(HaveKeyWithValue("nozzle", "nozzle-0"))
+		}
+	})
+
+	It("ignores requests to unknown applications", func() {
+		unknown := testApp{"Unknown", 0x1, 0x2}
+		receive(unknown.Events(5, 200, 0))
+
+		Expect(metricBuffer.PostedMetrics).To(BeEmpty())
+	})
 
-		Expect(testApps[0].RequestCount(2)).To(Equal(-1))
-		Expect(testApps[0].ResponseCode(200, 2)).To(Equal(-1))
+	It("expires series that have not been seen for the ttl", func() {
+		httpSeriesExpiredCount.Set(0)
+		subject = NewHTTPSink(ctx, &mocks.MockLogger{}, "firehose", labelMaker, nil, metricBuffer, 50*time.Millisecond, "")
 
-		Expect(testApps[1].RequestCount(0)).To(Equal(25))
-		Expect(testApps[1].ResponseCode(200, 0)).To(Equal(15))
-		Expect(testApps[1].ResponseCode(401, 0)).To(Equal(3))
-		Expect(testApps[1].ResponseCode(404, 0)).To(Equal(7))
+		receive(testApps[0].Events(5, 200, 0))
+		Eventually(httpSeriesExpiredCount.IntValue).Should(Equal(2))
 
-		Expect(testApps[2].RequestCount(0)).To(Equal(8))
-		Expect(testApps[2].ResponseCode(302, 0)).To(Equal(8))
+		receive(testApps[0].Events(1, 200, 0))
+		Expect(testApps[0].ResponseCode(metricBuffer.PostedMetrics, 200, 0)).To(Equal(1))
 	})
 })
@@ -32,16 +32,62 @@ type LabelMaker interface {
 	LogLabels(*events.Envelope) map[string]string
 }
 
-func NewLabelMaker(appInfoRepository cloudfoundry.AppInfoRepository, foundationName string) LabelMaker {
+// maxMetricLabels is the number of labels Stackdriver allows per custom metric.
+const maxMetricLabels = 10
+
+// An AppLabelScheme selects the labels that identify the application an
+// event belongs to.
+type AppLabelScheme string
+
+const (
+	// AppLabelsPath identifies applications by an "applicationPath" label
+	// made of org, space and app names, e.g. /system/autoscaling/autoscale.
+	AppLabelsPath AppLabelScheme = "path"
+	// AppLabelsPathAndGUID adds "app_guid", "space_guid" and "org_guid"
+	// labels to "applicationPath".
+	AppLabelsPathAndGUID AppLabelScheme = "path_and_guid"
+	// AppLabelsGUID identifies applications only by the GUID labels, so that
+	// renaming an app or recreating one with the same name does not merge or
+	// split its history.
+	AppLabelsGUID AppLabelScheme = "guid"
+)
+
+// ParseAppLabelScheme returns the AppLabelScheme with the given name.
+func ParseAppLabelScheme(name string) (AppLabelScheme, error) {
+	switch scheme := AppLabelScheme(name); scheme {
+	case AppLabelsPath, AppLabelsPathAndGUID, AppLabelsGUID:
+		return scheme, nil
+	}
+	return "", fmt.Errorf("unknown app label scheme %q", name)
+}
+
+// NewLabelMaker creates a LabelMaker. Metric labels identify apps according to
+// metricAppLabels; log labels always include "applicationPath", and also the
+// GUID labels if guidLogLabels is set. The CAPI metadata labels and
+// annotations of apps with keys in metadataKeys are added to log labels, and
+// also to metric labels if metadataMetricLabels is set.
+func NewLabelMaker(appInfoRepository cloudfoundry.AppInfoRepository, foundationName string, metricAppLabels AppLabelScheme, guidLogLabels bool, metadataKeys []string, metadataMetricLabels bool) LabelMaker {
+	logAppLabels := AppLabelsPath
+	if guidLogLabels {
+		logAppLabels = AppLabelsPathAndGUID
+	}
 	return &labelMaker{
-		appInfoRepository: appInfoRepository,
-		foundationName:    foundationName,
+		appInfoRepository:    appInfoRepository,
+		foundationName:       foundationName,
+		metricAppLabels:      metricAppLabels,
+		logAppLabels:         logAppLabels,
+		metadataKeys:         metadataKeys,
+		metadataMetricLabels: metadataMetricLabels,
 	}
 }
 
 type labelMaker struct {
-	appInfoRepository cloudfoundry.AppInfoRepository
-	foundationName    string
+	appInfoRepository    cloudfoundry.AppInfoRepository
+	foundationName       string
+	metricAppLabels      AppLabelScheme
+	logAppLabels         AppLabelScheme
+	metadataKeys         []string
+	metadataMetricLabels bool
 }
 
 type labelMap map[string]string
@@ -75,16 +121,26 @@ func (pm *pathMaker) String() string {
 // from them.
 //
 // Since SD only allows 10 custom labels per metric, we collapse application
-// metadata into a "path" representing the serving application, space, and org.
+// metadata into a "path" representing the serving application, space, and org
+// (or into GUID labels, depending on the AppLabelScheme).
 // We maintain vm and application instance indexes as separate labels so that
 // it is easy to aggregate across multiple instances.
 func (lm *labelMaker) MetricLabels(envelope *events.Envelope, addOrigin bool) map[string]string {
+	labels := lm.labels(envelope, addOrigin, lm.metricAppLabels)
+	if lm.metadataMetricLabels {
+		lm.addMetadata(labels, envelope, maxMetricLabels)
+	}
+
+	return labels
+}
+
+func (lm *labelMaker) labels(envelope *events.Envelope, addOrigin bool, appLabels AppLabelScheme) labelMap {
 	labels := labelMap{}
 
 	labels.setIfNotEmpty("foundation", lm.foundationName)
 	labels.setIfNotEmpty("job", envelope.GetJob())
 	labels.setIfNotEmpty("index", envelope.GetIndex())
-	labels.setIfNotEmpty("applicationPath", lm.getApplicationPath(envelope))
+	lm.addAppLabels(labels, envelope, appLabels)
 	labels.setIfNotEmpty("instanceIndex", getInstanceIndex(envelope))
 	labels.setIfNotEmpty("tags", getTags(envelope))
 	if addOrigin {
@@ -102,28 +158,86 @@ func (lm *labelMaker) MetricLabels(envelope *events.Envelope, addOrigin bool) ma
 // The limit of 10 custom labels does not (appear to) apply to SD logging,
 // so there's no risk to adding extra labels here.
 func (lm *labelMaker) LogLabels(envelope *events.Envelope) map[string]string {
-	labels := labelMap(lm.MetricLabels(envelope, true))
+	labels := lm.labels(envelope, true, lm.logAppLabels)
 	labels.setIfNotEmpty("eventType", envelope.GetEventType().String())
+	lm.addMetadata(labels, envelope, 0)
 	return labels
 }
 
-// getApplicationPath returns a path that uniquely identifies a
-// collection of instances of a given application running in an org + space.
-// The path hierarchy is /org/space/application, e.g.
-//     /system/autoscaling/autoscale
-func (lm *labelMaker) getApplicationPath(envelope *events.Envelope) string {
+// addMetadata copies the allowlisted CAPI metadata of the envelope's app into
+// labels, in the order of the allowlist. App labels take precedence over
+// annotations with the same key. Existing labels are never overwritten, and
+// if limit is positive no more labels are added once labels has limit entries.
+func (lm *labelMaker) addMetadata(labels labelMap, envelope *events.Envelope, limit int) {
+	if len(lm.metadataKeys) == 0 {
+		return
+	}
 	appID := getApplicationID(envelope)
 	if appID == "" {
-		return ""
+		return
+	}
+	metadata := lm.appInfoRepository.GetAppInfo(appID).Metadata
+
+	for _, key := range lm.metadataKeys {
+		if limit > 0 && len(labels) >= limit {
+			return
+		}
+		value, ok := metadata.Labels[key]
+		if !ok {
+			value = metadata.Annotations[key]
+		}
+		name := metadataLabelKey(key)
+		if _, exists := labels[name]; !exists {
+			labels.setIfNotEmpty(name, value)
+		}
+	}
+}
+
+// metadataLabelKey turns a CAPI metadata key, e.g. "example.com/cost-center",
+// into a valid Stackdriver label key, e.g. "example_com_cost_center".
+func metadataLabelKey(key string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(key) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	name := b.String()
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = "metadata_" + name
+	}
+	return name
+}
+
+// addAppLabels adds the labels identifying the application of the envelope,
+// according to scheme, if the application is known.
+func (lm *labelMaker) addAppLabels(labels labelMap, envelope *events.Envelope, scheme AppLabelScheme) {
+	appID := getApplicationID(envelope)
+	if appID == "" {
+		return
 	}
 	app := lm.appInfoRepository.GetAppInfo(appID)
 	if app.AppName == "" {
-		return ""
+		return
 	}
 
-	return makePath(app)
+	if scheme != AppLabelsGUID {
+		labels.setIfNotEmpty("applicationPath", makePath(app))
+	}
+	if scheme != AppLabelsPath {
+		labels.setIfNotEmpty("app_guid", appID)
+		labels.setIfNotEmpty("space_guid", app.SpaceGUID)
+		labels.setIfNotEmpty("org_guid", app.OrgGUID)
+	}
 }
 
+// makePath returns a path that uniquely identifies a collection of instances
+// of a given application running in an org + space. The path hierarchy is
+// /org/space/application, e.g.
+//
+//	/system/autoscaling/autoscale
 func makePath(app cloudfoundry.AppInfo) string {
 	path := pathMaker{}
 	path.addElement("org", app.OrgName)
@@ -35,7 +35,7 @@ var _ = Describe("LabelMaker", func() {
 	)
 
 	BeforeEach(func() {
-		subject = NewLabelMaker(cloudfoundry.NullAppInfoRepository(), foundation)
+		subject = NewLabelMaker(cloudfoundry.NullAppInfoRepository(), foundation, AppLabelsPath, false, nil, false)
 	})
 
 	It("makes labels from envelopes", func() {
@@ -129,7 +129,7 @@ var _ = Describe("LabelMaker", func() {
 				appInfoRepository = &mocks.AppInfoRepository{
 					AppInfoMap: map[string]cloudfoundry.AppInfo{},
 				}
-				subject = NewLabelMaker(appInfoRepository, foundation)
+				subject = NewLabelMaker(appInfoRepository, foundation, AppLabelsPath, false, nil, false)
 			})
 
 			Context("for a LogMessage", func() {
@@ -245,5 +245,143 @@ var _ = Describe("LabelMaker", func() {
 				})
 			})
 		})
+
+		Context("CAPI metadata", func() {
+			var (
+				appInfoRepository *mocks.AppInfoRepository
+				eventType         = events.Envelope_LogMessage
+				envelope          *events.Envelope
+				metadataKeys      = []string{"example.com/cost-center", "team", "contact", "missing"}
+			)
+
+			BeforeEach(func() {
+				appInfoRepository = &mocks.AppInfoRepository{
+					AppInfoMap: map[string]cloudfoundry.AppInfo{
+						appGUID: {
+							AppName:   "MyApp",
+							SpaceName: "MySpace",
+							OrgName:   "MyOrg",
+							Metadata: cloudfoundry.Metadata{
+								Labels:      map[string]string{"example.com/cost-center": "1234", "team": "payments"},
+								Annotations: map[string]string{"team": "ignored", "contact": "oncall@example.com"},
+							},
+						},
+					},
+				}
+				job := "diego_cell"
+				envelope = &events.Envelope{
+					EventType:  &eventType,
+					Job:        &job,
+					LogMessage: &events.LogMessage{AppId: &appGUID},
+				}
+			})
+
+			It("adds allowlisted metadata to log labels", func() {
+				subject = NewLabelMaker(appInfoRepository, foundation, AppLabelsPath, false, metadataKeys, false)
+
+				labels := subject.LogLabels(envelope)
+				Expect(labels).To(HaveKeyWithValue("example_com_cost_center", "1234"))
+				Expect(labels).To(HaveKeyWithValue("team", "payments"))
+				Expect(labels).To(HaveKeyWithValue("contact", "oncall@example.com"))
+				Expect(labels).NotTo(HaveKey("missing"))
+
+				Expect(subject.MetricLabels(envelope, false)).NotTo(HaveKey("team"))
+			})
+
+			It("adds metadata to metric labels up to the label limit", func() {
+				subject = NewLabelMaker(appInfoRepository, foundation, AppLabelsPath, false, metadataKeys, true)
+
+				labels := subject.MetricLabels(envelope, false)
+				Expect(labels).To(HaveKeyWithValue("team", "payments"))
+
+				index, origin := "0", "rep"
+				envelope.Index = &index
+				envelope.Origin = &origin
+				envelope.Tags = map[string]string{"a": "b"}
+				subject = NewLabelMaker(appInfoRepository, foundation, AppLabelsPath, false, append(metadataKeys, "k1", "k2", "k3", "k4"), true)
+				for _, k := range []string{"k1", "k2", "k3", "k4"} {
+					appInfoRepository.AppInfoMap[appGUID].Metadata.Labels[k] = "v"
+				}
+				Expect(subject.MetricLabels(envelope, true)).To(HaveLen(maxMetricLabels))
+			})
+
+			It("sanitizes metadata keys", func() {
+				Expect(metadataLabelKey("example.com/Cost-Center")).To(Equal("example_com_cost_center"))
+				Expect(metadataLabelKey("1st")).To(Equal("metadata_1st"))
+			})
+		})
+
+		Context("GUID labels", func() {
+			var (
+				appInfoRepository *mocks.AppInfoRepository
+				eventType         = events.Envelope_LogMessage
+				envelope          *events.Envelope
+			)
+
+			BeforeEach(func() {
+				appInfoRepository = &mocks.AppInfoRepository{
+					AppInfoMap: map[string]cloudfoundry.AppInfo{
+						appGUID: {
+							AppName:   "MyApp",
+							SpaceName: "MySpace",
+							SpaceGUID: "space-guid",
+							OrgName:   "MyOrg",
+							OrgGUID:   "org-guid",
+						},
+					},
+				}
+				envelope = &events.Envelope{
+					EventType:  &eventType,
+					LogMessage: &events.LogMessage{AppId: &appGUID},
+				}
+			})
+
+			It("labels metrics according to the scheme", func() {
+				subject = NewLabelMaker(appInfoRepository, foundation, AppLabelsPathAndGUID, false, nil, false)
+				Expect(subject.MetricLabels(envelope, false)).To(Equal(map[string]string{
+					"foundation":      foundation,
+					"applicationPath": "/MyOrg/MySpace/MyApp",
+					"app_guid":        appGUID,
+					"space_guid":      "space-guid",
+					"org_guid":        "org-guid",
+				}))
+
+				subject = NewLabelMaker(appInfoRepository, foundation, AppLabelsGUID, false, nil, false)
+				Expect(subject.MetricLabels(envelope, false)).To(Equal(map[string]string{
+					"foundation": foundation,
+					"app_guid":   appGUID,
+					"space_guid": "space-guid",
+					"org_guid":   "org-guid",
+				}))
+			})
+
+			It("keeps applicationPath in logs", func() {
+				subject = NewLabelMaker(appInfoRepository, foundation, AppLabelsGUID, false, nil, false)
+				labels := subject.LogLabels(envelope)
+				Expect(labels).To(HaveKeyWithValue("applicationPath", "/MyOrg/MySpace/MyApp"))
+				Expect(labels).NotTo(HaveKey("app_guid"))
+
+				subject = NewLabelMaker(appInfoRepository, foundation, AppLabelsPath, true, nil, false)
+				labels = subject.LogLabels(envelope)
+				Expect(labels).To(HaveKeyWithValue("applicationPath", "/MyOrg/MySpace/MyApp"))
+				Expect(labels).To(HaveKeyWithValue("app_guid", appGUID))
+				Expect(labels).To(HaveKeyWithValue("org_guid", "org-guid"))
+			})
+
+			It("does not add GUID labels for an unresolved app", func() {
+				subject = NewLabelMaker(appInfoRepository, foundation, AppLabelsGUID, true, nil, false)
+				delete(appInfoRepository.AppInfoMap, appGUID)
+				Expect(subject.LogLabels(envelope)).NotTo(HaveKey("app_guid"))
+			})
+
+			It("parses scheme names", func() {
+				scheme, err := ParseAppLabelScheme("path_and_guid")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(scheme).To(Equal(AppLabelsPathAndGUID))
+
+				_, err = ParseAppLabelScheme("name")
+				Expect(err).To(HaveOccurred())
+			})
+		})
 	})
 })
@@ -28,9 +28,11 @@ import (
 )
 
 // NewLogSink returns a Sink that can receive sonde Events, translate them and send them to a stackdriver.LogAdapter
-func NewLogSink(labelMaker LabelMaker, logAdapter stackdriver.LogAdapter, newlineToken string, logger lager.Logger) Sink {
+// Logs of apps that opted out through their annotations are dropped when controls is non-nil.
+func NewLogSink(labelMaker LabelMaker, controls *AppControls, logAdapter stackdriver.LogAdapter, newlineToken string, logger lager.Logger) Sink {
 	return &logSink{
 		labelMaker:   labelMaker,
+		controls:     controls,
 		logAdapter:   logAdapter,
 		newlineToken: newlineToken,
 		logger:       logger,
@@ -39,6 +41,7 @@ func NewLogSink(labelMaker LabelMaker, logAdapter stackdriver.LogAdapter, newlin
 
 type logSink struct {
 	labelMaker   LabelMaker
+	controls     *AppControls
 	logAdapter   stackdriver.LogAdapter
 	newlineToken string
 	logger       lager.Logger
@@ -51,6 +54,9 @@ func (ls *logSink) Receive(envelope *events.Envelope) {
 		// Quietly ignore the error and let other parts of the system handle the logging.
 		return
 	}
+	if !ls.controls.LogEnabled(envelope, envelopeSeverity(envelope)) {
+		return
+	}
 	log := ls.parseEnvelope(envelope)
 	ls.logAdapter.PostLog(&log)
 }
@@ -77,7 +83,7 @@ func (ls *logSink) parseEnvelope(envelope *events.Envelope) messages.Log {
 
 	payload["eventType"] = envelope.GetEventType().String()
 
-	severity := logging.Default
+	severity := envelopeSeverity(envelope)
 
 	// The json marshaling causes a loss in precision
 	if envelope.GetTimestamp() != 0 {
@@ -97,7 +103,6 @@ func (ls *logSink) parseEnvelope(envelope *events.Envelope) messages.Log {
 			// fields we pass to Stackdriver are camelCased. We arbitrarily chose
 			// to remain consistent with the protobuf.
 			logMessageMap["message_type"] = logMessage.GetMessageType().String()
-			severity = parseSeverity(logMessage.GetMessageType())
 
 			// Put the message payload where stackdriver expects it
 			payload["message"] = message
@@ -110,7 +115,6 @@ func (ls *logSink) parseEnvelope(envelope *events.Envelope) messages.Log {
 	case events.Envelope_Error:
 		errorMessage := envelope.GetError().GetMessage()
 		payload["message"] = errorMessage
-		severity = logging.Error
 	case events.Envelope_HttpStartStop:
 		httpStartStop := envelope.GetHttpStartStop()
 		httpStartStopMap, err := structToMap(httpStartStop)
@@ -149,6 +153,16 @@ func (ls *logSink) parseMessage(rawMessage []byte) string {
 	return message
 }
 
+func envelopeSeverity(envelope *events.Envelope) logging.Severity {
+	switch envelope.GetEventType() {
+	case events.Envelope_LogMessage:
+		return parseSeverity(envelope.GetLogMessage().GetMessageType())
+	case events.Envelope_Error:
+		return logging.Error
+	}
+	return logging.Default
+}
+
 func parseSeverity(messageType events.LogMessage_MessageType) logging.Severity {
 	if messageType == events.LogMessage_ERR {
 		return logging.Error
@@ -41,7 +41,7 @@ var _ = Describe("LogSink", func() {
 		logAdapter = &mocks.LogAdapter{}
 
 		newlineToken := ""
-		subject = NewLogSink(labelMaker, logAdapter, newlineToken, lager.NewLogger("test"))
+		subject = NewLogSink(labelMaker, nil, logAdapter, newlineToken, lager.NewLogger("test"))
 	})
 
 	It("passes fields through to the adapter", func() {
@@ -309,7 +309,7 @@ var _ = Describe("LogSink", func() {
 		})
 
 		It("translates newline tokens when one is passed in", func() {
-			subject = NewLogSink(labelMaker, logAdapter, "∴", lager.NewLogger("test"))
+			subject = NewLogSink(labelMaker, nil, logAdapter, "∴", lager.NewLogger("test"))
 
 			eventType := events.Envelope_LogMessage
 			messageType := events.LogMessage_OUT
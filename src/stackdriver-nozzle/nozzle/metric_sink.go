@@ -29,30 +29,50 @@ import (
 )
 
 // NewLogSink returns a Sink that can receive sonde Events, translate them and send them to a stackdriver.MetricAdapter
-func NewMetricSink(logger lager.Logger, pathPrefix string, labelMaker LabelMaker, metricAdapter stackdriver.MetricAdapter, ct *CounterTracker, unitParser UnitParser, runtimeMetricRegex string) (Sink, error) {
+// Derived container utilization metrics are only reported when cu is non-nil.
+// If cs is non-nil, cumulative counters owned by other nozzles are forwarded to them.
+// Rate gauges are derived from counters selected by cr, if it is non-nil.
+// Metrics of apps that opted out through their annotations are dropped when controls is non-nil.
+// If instanceLabel is set, gauges not about an app get a "nozzle" label with its value, so that nozzles receiving
+// envelopes of the same series write separate time series instead of each other's points out of order.
+func NewMetricSink(logger lager.Logger, pathPrefix string, labelMaker LabelMaker, controls *AppControls, metricAdapter stackdriver.MetricAdapter, ct *CounterTracker, cs *CounterSharding, cr *CounterRates, cu *ContainerUtilization, unitParser UnitParser, runtimeMetricRegex string, instanceLabel string) (Sink, error) {
 	r, err := regexp.Compile(runtimeMetricRegex)
 	if err != nil {
 		return nil, fmt.Errorf("cannot compile runtime metric regex: %v", err)
 	}
-	return &metricSink{
+	ms := &metricSink{
 		pathPrefix:      pathPrefix,
 		labelMaker:      labelMaker,
+		controls:        controls,
 		metricAdapter:   metricAdapter,
 		unitParser:      unitParser,
 		counterTracker:  ct,
+		sharding:        cs,
+		rates:           cr,
+		utilization:     cu,
 		logger:          logger,
 		runtimeMetricRe: r,
-	}, nil
+		instanceLabel:   instanceLabel,
+	}
+	if cs != nil {
+		cs.setReceiver(ms)
+	}
+	return ms, nil
 }
 
 type metricSink struct {
 	pathPrefix      string
 	labelMaker      LabelMaker
+	controls        *AppControls
 	metricAdapter   stackdriver.MetricAdapter
 	unitParser      UnitParser
 	counterTracker  *CounterTracker
+	sharding        *CounterSharding
+	rates           *CounterRates
+	utilization     *ContainerUtilization
 	logger          lager.Logger
 	runtimeMetricRe *regexp.Regexp
+	instanceLabel   string
 }
 
 // isRuntimeMetric determines whether a given metric is a runtime metric.
@@ -79,6 +99,9 @@ func (ms *metricSink) getPrefix(envelope *events.Envelope) string {
 }
 
 func (ms *metricSink) Receive(envelope *events.Envelope) {
+	if !ms.controls.MetricsEnabled(envelope) {
+		return
+	}
 	labels := ms.labelMaker.MetricLabels(envelope, ms.isRuntimeMetric(envelope))
 	metricPrefix := ms.getPrefix(envelope)
 	eventType := envelope.GetEventType()
@@ -111,6 +134,9 @@ func (ms *metricSink) Receive(envelope *events.Envelope) {
 			{Name: metricPrefix + "memoryBytes", Value: float64(containerMetric.GetMemoryBytes())},
 			{Name: metricPrefix + "memoryBytesQuota", Value: float64(containerMetric.GetMemoryBytesQuota())},
 		}
+		if ms.utilization != nil {
+			metrics = append(metrics, ms.utilization.Metrics(metricPrefix, containerMetric)...)
+		}
 		for _, metric := range metrics {
 			metric.Labels = labels
 			metric.Type = eventType
@@ -119,47 +145,118 @@ func (ms *metricSink) Receive(envelope *events.Envelope) {
 		}
 	case events.Envelope_CounterEvent:
 		counterEvent := envelope.GetCounterEvent()
+		name := metricPrefix + counterEvent.GetName()
+		if ms.sharding != nil && !ms.sharding.route((&messages.Metric{Name: name, Labels: labels}).Hash(),
+			&forwardedCounter{Name: name, Labels: labels, Total: counterEvent.GetTotal(), EventTime: eventTime}) {
+			// The counter is owned by another nozzle.
+			break
+		}
+		metrics = ms.counterMetrics(name, labels, counterEvent.GetDelta(), counterEvent.GetTotal(), eventTime)
+	default:
+		ms.logger.Error("metricSink.Receive", fmt.Errorf("unknown event type: %v", envelope.EventType))
+		return
+	}
+
+	if ms.instanceLabel != "" && getApplicationID(envelope) == "" {
+		ms.addInstanceLabel(metrics)
+	}
+	ms.metricAdapter.PostMetrics(metrics)
+}
+
+// addInstanceLabel adds the "nozzle" label to the gauges among metrics, as far as the label limit permits.
+// Cumulative counters are left alone: they are written by a single nozzle (see CounterSharding).
+func (ms *metricSink) addInstanceLabel(metrics []*messages.Metric) {
+	var labels map[string]string
+	for _, metric := range metrics {
+		if metric.IsCumulative() || len(metric.Labels) >= maxMetricLabels {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string, len(metric.Labels)+1)
+			for k, v := range metric.Labels {
+				labels[k] = v
+			}
+			labels["nozzle"] = ms.instanceLabel
+		}
+		metric.Labels = labels
+	}
+}
+
+// counterMetrics returns the metrics reported for a CounterEvent.
+func (ms *metricSink) counterMetrics(name string, labels map[string]string, delta, total uint64, eventTime time.Time) []*messages.Metric {
+	var metrics []*messages.Metric
+	rate := ms.rates != nil && ms.rates.Matches(name)
+	if !rate || !ms.rates.replace {
 		if ms.counterTracker == nil {
 			// When there is no counter tracker, report CounterEvent metrics as two gauges: 'delta' and 'total'.
 			metrics = []*messages.Metric{
 				{
-					Name:      fmt.Sprintf("%s%v.delta", metricPrefix, counterEvent.GetName()),
+					Name:      name + ".delta",
 					Labels:    labels,
 					Type:      events.Envelope_ValueMetric,
-					Value:     float64(counterEvent.GetDelta()),
+					Value:     float64(delta),
 					EventTime: eventTime,
 					StartTime: eventTime,
 				},
 				{
-					Name:      fmt.Sprintf("%s%v.total", metricPrefix, counterEvent.GetName()),
+					Name:      name + ".total",
 					Labels:    labels,
 					Type:      events.Envelope_ValueMetric,
-					Value:     float64(counterEvent.GetTotal()),
+					Value:     float64(total),
 					EventTime: eventTime,
 					StartTime: eventTime,
 				},
 			}
-		} else {
-			// Create a partial metric struct (lacking IntValue and StartTime) to allow determining metric.Hash (used as
-			// the counter name) based on metric name and labels.
-			metric := &messages.Metric{
-				Name:      metricPrefix + counterEvent.GetName(),
+		} else if metric := ms.cumulativeMetric(name, labels, total, eventTime); metric != nil {
+			metrics = append(metrics, metric)
+		}
+	}
+	if rate {
+		hash := (&messages.Metric{Name: name, Labels: labels}).Hash()
+		if value, ok := ms.rates.Update(hash, total, eventTime); ok {
+			metrics = append(metrics, &messages.Metric{
+				Name:      name + ".rate",
 				Labels:    labels,
-				Type:      eventType,
+				Type:      events.Envelope_ValueMetric,
+				Value:     value,
 				EventTime: eventTime,
-			}
-			total, st := ms.counterTracker.Update(metric.Hash(), counterEvent.GetTotal(), eventTime)
-			// Stackdriver expects non-zero time intervals, so only add a metric if event time is older than start time.
-			if eventTime.After(st) {
-				metric.StartTime = st
-				metric.IntValue = total
-				metrics = append(metrics, metric)
-			}
+				StartTime: eventTime,
+				Unit:      "1/s",
+			})
 		}
-	default:
-		ms.logger.Error("metricSink.Receive", fmt.Errorf("unknown event type: %v", envelope.EventType))
-		return
 	}
+	return metrics
+}
 
+// cumulativeMetric returns a cumulative metric for a counter total, or nil if there is nothing to report yet.
+func (ms *metricSink) cumulativeMetric(name string, labels map[string]string, total uint64, eventTime time.Time) *messages.Metric {
+	// Create a partial metric struct (lacking IntValue and StartTime) to allow determining metric.Hash (used as
+	// the counter name) based on metric name and labels.
+	metric := &messages.Metric{
+		Name:      name,
+		Labels:    labels,
+		Type:      events.Envelope_CounterEvent,
+		EventTime: eventTime,
+	}
+	value, st := ms.counterTracker.Update(metric.Hash(), total, eventTime)
+	// Stackdriver expects non-zero time intervals, so only add a metric if event time is older than start time.
+	if !eventTime.After(st) {
+		return nil
+	}
+	metric.StartTime = st
+	metric.IntValue = value
+	return metric
+}
+
+// receiveCounter handles a counter forwarded by a peer nozzle. It is never forwarded again.
+// Its metrics are labelled like those of counters received locally, which are never about an app.
+func (ms *metricSink) receiveCounter(name string, labels map[string]string, total uint64, eventTime time.Time) {
+	metrics := ms.counterMetrics(name, labels, 0, total, eventTime)
+	if len(metrics) == 0 {
+		return
+	}
+	if ms.instanceLabel != "" {
+		ms.addInstanceLabel(metrics)
+	}
 	ms.metricAdapter.PostMetrics(metrics)
 }
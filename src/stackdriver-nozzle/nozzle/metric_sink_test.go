@@ -53,12 +53,12 @@ var _ = Describe("MetricSink", func() {
 
 	BeforeEach(func() {
 		appInfoRepository := &mocks.AppInfoRepository{AppInfoMap: map[string]cloudfoundry.AppInfo{}}
-		labelMaker = NewLabelMaker(appInfoRepository, "foobar")
+		labelMaker = NewLabelMaker(appInfoRepository, "foobar", AppLabelsPath, false, nil, false)
 		metricBuffer = &mocks.MetricsBuffer{}
 		unitParser = &mockUnitParser{}
 		logger = &mocks.MockLogger{}
 
-		subject, err = NewMetricSink(logger, "firehose", labelMaker, metricBuffer, counterTracker, unitParser, "^runtimeMetric\\..*")
+		subject, err = NewMetricSink(logger, "firehose", labelMaker, nil, metricBuffer, counterTracker, nil, nil, nil, unitParser, "^runtimeMetric\\..*", "")
 		Expect(err).To(BeNil())
 	})
 
@@ -190,6 +190,66 @@ var _ = Describe("MetricSink", func() {
 		}))
 	})
 
+	Context("with derived container metrics enabled", func() {
+		BeforeEach(func() {
+			subject, err = NewMetricSink(logger, "firehose", labelMaker, nil, metricBuffer, counterTracker, nil, nil, NewContainerUtilization(50), unitParser, "^runtimeMetric\\..*", "")
+			Expect(err).To(BeNil())
+		})
+
+		receiveContainerMetric := func(containerMetric *events.ContainerMetric) {
+			origin := "origin"
+			metricType := events.Envelope_ContainerMetric
+			timeStamp := time.Now().UnixNano()
+			subject.Receive(&events.Envelope{
+				Origin:          &origin,
+				EventType:       &metricType,
+				ContainerMetric: containerMetric,
+				Timestamp:       &timeStamp,
+			})
+		}
+
+		It("creates utilization metrics", func() {
+			cpuPercentage := 12.5
+			diskBytes := uint64(256 << 20)
+			diskBytesQuota := uint64(1 << 30)
+			memoryBytes := uint64(384 << 20)
+			memoryBytesQuota := uint64(512 << 20)
+			receiveContainerMetric(&events.ContainerMetric{
+				CpuPercentage:    &cpuPercentage,
+				DiskBytes:        &diskBytes,
+				DiskBytesQuota:   &diskBytesQuota,
+				MemoryBytes:      &memoryBytes,
+				MemoryBytesQuota: &memoryBytesQuota,
+			})
+
+			metrics := metricBuffer.PostedMetrics
+			Expect(metrics).To(HaveLen(10))
+
+			eventName := func(element interface{}) string {
+				return element.(messages.Metric).Name
+			}
+			Expect(metrics).To(MatchElements(eventName, IgnoreExtras, Elements{
+				"firehose/origin.memoryUtilization": MatchFields(IgnoreExtras, Fields{"Type": Equal(events.Envelope_ContainerMetric), "Value": Equal(0.75), "Unit": Equal("1")}),
+				"firehose/origin.diskUtilization":   MatchFields(IgnoreExtras, Fields{"Type": Equal(events.Envelope_ContainerMetric), "Value": Equal(0.25), "Unit": Equal("1")}),
+				"firehose/origin.memoryBytesFree":   MatchFields(IgnoreExtras, Fields{"Type": Equal(events.Envelope_ContainerMetric), "Value": Equal(float64(128 << 20)), "Unit": Equal("By")}),
+				"firehose/origin.diskBytesFree":     MatchFields(IgnoreExtras, Fields{"Type": Equal(events.Envelope_ContainerMetric), "Value": Equal(float64(768 << 20)), "Unit": Equal("By")}),
+				// A 512MiB container is entitled to 25% of a core, and is using half of that.
+				"firehose/origin.cpuEntitlement": MatchFields(IgnoreExtras, Fields{"Type": Equal(events.Envelope_ContainerMetric), "Value": Equal(50.0), "Unit": Equal("%")}),
+			}))
+		})
+
+		It("skips utilization metrics without a quota", func() {
+			cpuPercentage := 12.5
+			memoryBytes := uint64(384 << 20)
+			receiveContainerMetric(&events.ContainerMetric{
+				CpuPercentage: &cpuPercentage,
+				MemoryBytes:   &memoryBytes,
+			})
+
+			Expect(metricBuffer.PostedMetrics).To(HaveLen(5))
+		})
+	})
+
 	It("creates total and delta metrics for CounterEvent", func() {
 		eventTime := time.Now()
 
@@ -246,7 +306,7 @@ var _ = Describe("MetricSink", func() {
 	Context("with CounterTracker enabled", func() {
 		BeforeEach(func() {
 			counterTracker = NewCounterTracker(context.TODO(), time.Duration(5)*time.Second, logger)
-			subject, err = NewMetricSink(logger, "firehose", labelMaker, metricBuffer, counterTracker, unitParser, "^runtimeMetric\\..*")
+			subject, err = NewMetricSink(logger, "firehose", labelMaker, nil, metricBuffer, counterTracker, nil, nil, nil, unitParser, "^runtimeMetric\\..*", "")
 			Expect(err).To(BeNil())
 		})
 
@@ -309,6 +369,193 @@ var _ = Describe("MetricSink", func() {
 		})
 	})
 
+	Context("with counter rates enabled", func() {
+		receiveCounters := func(name string, totals ...uint64) time.Time {
+			eventTime := time.Now()
+			eventType := events.Envelope_CounterEvent
+			origin := "origin"
+			for idx := range totals {
+				ts := eventTime.UnixNano() + int64(time.Second)*int64(idx) // Events are 1 second apart.
+				subject.Receive(&events.Envelope{
+					Origin:    &origin,
+					EventType: &eventType,
+					Timestamp: &ts,
+					CounterEvent: &events.CounterEvent{
+						Name:  &name,
+						Total: &totals[idx],
+					},
+				})
+			}
+			return eventTime
+		}
+
+		names := func() []string {
+			var names []string
+			for _, m := range metricBuffer.PostedMetrics {
+				names = append(names, m.Name)
+			}
+			return names
+		}
+
+		newSubject := func(replace bool) {
+			counterTracker = NewCounterTracker(context.TODO(), 5*time.Second, logger)
+			counterRates, err := NewCounterRates(context.TODO(), "\\.requests$", replace, 5*time.Second, logger)
+			Expect(err).NotTo(HaveOccurred())
+			subject, err = NewMetricSink(logger, "firehose", labelMaker, nil, metricBuffer, counterTracker, nil, counterRates, nil, unitParser, "^runtimeMetric\\..*", "")
+			Expect(err).To(BeNil())
+		}
+
+		It("reports rates alongside cumulative metrics", func() {
+			newSubject(false)
+			eventTime := receiveCounters("requests", 100, 110, 130, 5)
+
+			rates := []messages.Metric{}
+			for _, m := range metricBuffer.PostedMetrics {
+				if m.Name == "firehose/origin.requests.rate" {
+					rates = append(rates, m)
+				}
+			}
+			Expect(names()).To(ConsistOf(
+				"firehose/origin.requests", "firehose/origin.requests", "firehose/origin.requests",
+				"firehose/origin.requests.rate", "firehose/origin.requests.rate", "firehose/origin.requests.rate"))
+			// The last total is a counter reset.
+			for idx, rate := range []float64{10, 20, 5} {
+				Expect(rates[idx]).To(MatchFields(IgnoreExtras, Fields{
+					"Labels":    Equal(map[string]string{"foundation": "foobar"}),
+					"Value":     BeNumerically("~", rate, 1e-9),
+					"Unit":      Equal("1/s"),
+					"Type":      Equal(events.Envelope_ValueMetric),
+					"EventTime": BeTemporally("~", eventTime.Add(time.Duration(idx+1)*time.Second)),
+				}))
+			}
+		})
+
+		It("reports only rates when replacing counters", func() {
+			newSubject(true)
+			receiveCounters("requests", 100, 110, 130)
+			receiveCounters("errors", 1, 2)
+
+			Expect(names()).To(ConsistOf(
+				"firehose/origin.requests.rate", "firehose/origin.requests.rate", "firehose/origin.errors"))
+		})
+	})
+
+	Context("with an instance label", func() {
+		var tracker *CounterTracker
+
+		BeforeEach(func() {
+			tracker = nil
+		})
+
+		JustBeforeEach(func() {
+			subject, err = NewMetricSink(logger, "firehose", labelMaker, nil, metricBuffer, tracker, nil, nil, nil, unitParser, "^runtimeMetric\\..*", "nozzle-1")
+			Expect(err).To(BeNil())
+		})
+
+		labelsOf := func() []map[string]string {
+			var labels []map[string]string
+			for _, metric := range metricBuffer.PostedMetrics {
+				labels = append(labels, metric.Labels)
+			}
+			return labels
+		}
+
+		counterEvent := func(total uint64) *events.Envelope {
+			eventType := events.Envelope_CounterEvent
+			origin := "origin"
+			name := "counterName"
+			delta := uint64(1)
+			timeStamp := time.Now().UnixNano()
+			return &events.Envelope{
+				Origin:       &origin,
+				EventType:    &eventType,
+				CounterEvent: &events.CounterEvent{Name: &name, Delta: &delta, Total: &total},
+				Timestamp:    &timeStamp,
+			}
+		}
+
+		It("labels gauges with the nozzle", func() {
+			eventType := events.Envelope_ValueMetric
+			origin := "origin"
+			name := "valueMetricName"
+			value := 1.5
+			timeStamp := time.Now().UnixNano()
+			subject.Receive(&events.Envelope{
+				Origin:      &origin,
+				EventType:   &eventType,
+				ValueMetric: &events.ValueMetric{Name: &name, Value: &value},
+				Timestamp:   &timeStamp,
+			})
+			subject.Receive(counterEvent(10))
+
+			Expect(labelsOf()).To(Equal([]map[string]string{
+				{"foundation": "foobar", "nozzle": "nozzle-1"},
+				{"foundation": "foobar", "nozzle": "nozzle-1"},
+				{"foundation": "foobar", "nozzle": "nozzle-1"},
+			}))
+		})
+
+		It("leaves app metrics alone", func() {
+			eventType := events.Envelope_ContainerMetric
+			applicationID := "ee2aa52e-3c8a-4851-b505-0cb9fe24806e"
+			instanceIndex := int32(0)
+			timeStamp := time.Now().UnixNano()
+			subject.Receive(&events.Envelope{
+				EventType:       &eventType,
+				ContainerMetric: &events.ContainerMetric{ApplicationId: &applicationID, InstanceIndex: &instanceIndex},
+				Timestamp:       &timeStamp,
+			})
+
+			Expect(metricBuffer.PostedMetrics).To(HaveLen(5))
+			for _, labels := range labelsOf() {
+				Expect(labels).NotTo(HaveKey("nozzle"))
+			}
+		})
+
+		Context("with CounterTracker enabled", func() {
+			BeforeEach(func() {
+				tracker = NewCounterTracker(context.TODO(), 5*time.Second, logger)
+			})
+
+			It("leaves cumulative counters alone", func() {
+				subject.Receive(counterEvent(10))
+				time.Sleep(time.Millisecond)
+				subject.Receive(counterEvent(20))
+
+				Expect(metricBuffer.PostedMetrics).NotTo(BeEmpty())
+				for _, labels := range labelsOf() {
+					Expect(labels).NotTo(HaveKey("nozzle"))
+				}
+			})
+
+			It("labels rates of forwarded counters like those of local ones", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				rates, err := NewCounterRates(ctx, "counterName$", true, 5*time.Second, logger)
+				Expect(err).NotTo(HaveOccurred())
+				sharding := NewCounterSharding(ctx, "10.0.0.1:8081", "secret", logger)
+				sink, err := NewMetricSink(logger, "firehose", labelMaker, nil, metricBuffer, tracker, sharding, rates, nil, unitParser, "^runtimeMetric\\..*", "nozzle-1")
+				Expect(err).NotTo(HaveOccurred())
+
+				local := counterEvent(10)
+				sink.Receive(local)
+				eventTime := time.Unix(0, local.GetTimestamp())
+				// Forwarded by a peer that received the next envelope of the series.
+				sink.(*metricSink).receiveCounter("firehose/origin.counterName", map[string]string{"foundation": "foobar"}, 20, eventTime.Add(time.Second))
+				next := counterEvent(30)
+				ts := eventTime.Add(2 * time.Second).UnixNano()
+				next.Timestamp = &ts
+				sink.Receive(next)
+
+				Expect(metricBuffer.PostedMetrics).To(HaveLen(2))
+				for _, metric := range metricBuffer.PostedMetrics {
+					Expect(metric.Name).To(Equal("firehose/origin.counterName.rate"))
+					Expect(metric.Labels).To(Equal(map[string]string{"foundation": "foobar", "nozzle": "nozzle-1"}))
+				}
+			})
+		})
+	})
+
 	It("returns error when envelope contains unhandled event type", func() {
 		eventType := events.Envelope_HttpStartStop
 		envelope := &events.Envelope{
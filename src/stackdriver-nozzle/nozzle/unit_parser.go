@@ -19,70 +19,188 @@ package nozzle
 import (
 	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 const (
-	prefixRegex = "k|M|G|T|P|E|Z|Y|m|μ|n|p|f|a|z|y|Ki|Mi|Gi|Ti"
-	unitRegex   = "b|B|s|M|h|d"
+	prefixRegex = "k|M|G|T|P|E|Z|Y|m|μ|u|n|p|f|a|z|y|Ki|Mi|Gi|Ti|Pi|Ei|Zi|Yi"
+	unitRegex   = "bit|By|min|b|B|s|M|h|d"
+
+	// maxExponent bounds exponents, which are expanded into repeated components.
+	maxExponent = 9
 )
 
 /*
-Expression = Component { "." Component } { "/" Component } ;
+The unit parser translates loggregator units into the subset of UCUM accepted by
+Stackdriver (https://cloud.google.com/monitoring/api/ref_v3/rest/v3/projects.metricDescriptors#MetricDescriptor):
+
+Expression = Term { "/" Term } ;
+
+Term = Component { "." Component } ;
 
-Component = [ PREFIX ] UNIT [ Annotation ]
+Component = ( [ PREFIX ] UNIT | ALIAS ) [ EXPONENT ] [ Annotation ]
+          | "%" [ Annotation ]
           | Annotation
           | "1"
           ;
 
 Annotation = "{" NAME "}" ;
+
+EXPONENT is a signed integer, e.g. "s-1"; components with negative exponents
+are moved to the denominator and exponents are expanded, so "B.s-1" becomes
+"By/s" and "s2" becomes "s.s". ALIAS is one of the spelled out units used by
+loggregator sources (e.g. "bytes", "nanoseconds", "percentage" or "count"),
+matched case-insensitively. A component that does not parse is turned into an
+annotation, e.g. "req/s" becomes "{req}/s", and a unit that does not parse at
+all becomes a single annotation.
 */
 
 type UnitParser interface {
 	Parse(string) string
 }
 
+var unitAliases = map[string]string{
+	"bit":          "bit",
+	"bits":         "bit",
+	"byte":         "By",
+	"bytes":        "By",
+	"nanosecond":   "ns",
+	"nanoseconds":  "ns",
+	"microsecond":  "us",
+	"microseconds": "us",
+	"millisecond":  "ms",
+	"milliseconds": "ms",
+	"sec":          "s",
+	"secs":         "s",
+	"second":       "s",
+	"seconds":      "s",
+	"minute":       "min",
+	"minutes":      "min",
+	"hour":         "h",
+	"hours":        "h",
+	"day":          "d",
+	"days":         "d",
+	"percent":      "%",
+	"percentage":   "%",
+	"count":        "1",
+}
+
 func NewUnitParser() UnitParser {
-	componentRegex := regexp.MustCompile(fmt.Sprintf("^(%s)?(%s)$", prefixRegex, unitRegex))
+	componentRegex := regexp.MustCompile(fmt.Sprintf("^(?:(%s)?(%s)|([A-Za-z]+)|(%%)|(1))([+-]?[0-9]+)?(\\{[^{}]*\\})?$", prefixRegex, unitRegex))
 	annotationRegex := regexp.MustCompile("[{}]")
-	expressionRegex := regexp.MustCompile("^([^/]*)(/([^/]*))?$")
 
 	return &unitParser{
 		componentRegex:  componentRegex,
 		annotationRegex: annotationRegex,
-		expressionRegex: expressionRegex,
 	}
 }
 
 type unitParser struct {
 	componentRegex  *regexp.Regexp
 	annotationRegex *regexp.Regexp
-	expressionRegex *regexp.Regexp
 }
 
 func (up *unitParser) Parse(input string) string {
-	matches := up.expressionRegex.FindStringSubmatch(input)
-	if matches == nil {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return ""
+	}
+	if alias, ok := unitAliases[strings.ToLower(input)]; ok {
+		return alias
+	}
+	if strings.ContainsAny(input, " \t") {
 		return up.annotate(input)
 	}
 
-	numerator := up.parseComponent(matches[1])
-	if matches[2] == "" {
-		return numerator
+	var numerator, denominator []string
+	for i, term := range splitOutsideAnnotations(input, '/') {
+		for _, component := range splitOutsideAnnotations(term, '.') {
+			unit, exponent := up.parseComponent(component)
+			if i > 0 {
+				exponent = -exponent
+			}
+			for n := 0; n < exponent; n++ {
+				numerator = append(numerator, unit)
+			}
+			for n := 0; n < -exponent; n++ {
+				denominator = append(denominator, unit)
+			}
+		}
 	}
 
-	denominator := up.parseComponent(matches[3])
-	return fmt.Sprintf("%s/%s", numerator, denominator)
+	// A dimensionless component only matters if there is nothing else in the numerator.
+	units := numerator[:0]
+	for _, unit := range numerator {
+		if unit != "1" {
+			units = append(units, unit)
+		}
+	}
+	if len(units) == 0 {
+		units = []string{"1"}
+	}
+	result := strings.Join(units, ".")
+	for _, unit := range denominator {
+		if unit != "1" {
+			result += "/" + unit
+		}
+	}
+	return result
 }
 
-func (up *unitParser) parseComponent(input string) string {
+// parseComponent returns the translated unit of a component and its exponent.
+func (up *unitParser) parseComponent(input string) (string, int) {
 	matches := up.componentRegex.FindStringSubmatch(input)
 	if matches == nil {
-		return up.annotate(input)
+		return up.annotate(input), 1
+	}
+
+	var unit string
+	switch {
+	case matches[2] != "":
+		unit = prefixLookup(matches[1]) + unitLookup(matches[2])
+	case matches[3] != "":
+		alias, ok := unitAliases[strings.ToLower(matches[3])]
+		if !ok {
+			return up.annotate(input), 1
+		}
+		unit = alias
+	case matches[4] != "":
+		unit = "%"
+	default:
+		unit = "1"
 	}
 
-	prefix := prefixLookup(matches[1])
-	unit := unitLookup(matches[2])
-	return fmt.Sprintf("%s%s", prefix, unit)
+	exponent := 1
+	if matches[6] != "" {
+		exponent, _ = strconv.Atoi(matches[6])
+		if exponent == 0 || exponent > maxExponent || exponent < -maxExponent || unit == "1" || unit == "%" {
+			return up.annotate(input), 1
+		}
+	}
+	return unit + matches[7], exponent
+}
+
+// splitOutsideAnnotations splits input at each sep that is not part of an annotation.
+func splitOutsideAnnotations(input string, sep byte) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(input); i++ {
+		switch input[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case sep:
+			if depth == 0 {
+				parts = append(parts, input[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, input[start:])
 }
 
 // Not sure if this is faster than a map or not - if we
@@ -87,7 +87,6 @@ var _ = Describe("UnitParser", func() {
 			input  string
 			output string
 		}{
-			{"count", "{count}"},
 			{"invalid word", "{invalid word}"},
 			{"foo{bar}baz", "{foobarbaz}"},
 			{"oneb", "{oneb}"},
@@ -142,4 +141,53 @@ var _ = Describe("UnitParser", func() {
 			AssertUnitParsed(testCase.input, testCase.output)
 		}
 	})
+
+	It("translates loggregator unit aliases", func() {
+		testCases := []struct {
+			input  string
+			output string
+		}{
+			{"bytes", "By"},
+			{"Bytes", "By"},
+			{"nanoseconds", "ns"},
+			{"milliseconds", "ms"},
+			{"percentage", "%"},
+			{"percent", "%"},
+			{"count", "1"},
+			{"bytes/second", "By/s"},
+			{"", ""},
+		}
+
+		for _, testCase := range testCases {
+			AssertUnitParsed(testCase.input, testCase.output)
+		}
+	})
+
+	It("translates products, exponents and percentages", func() {
+		testCases := []struct {
+			input  string
+			output string
+		}{
+			{"B.s-1", "By/s"},
+			{"KiB/s", "KiBy/s"},
+			{"ms-1", "1/ms"},
+			{"s2", "s.s"},
+			{"By/s2", "By/s/s"},
+			{"bit.s/By", "bit.s/By"},
+			{"1/s", "1/s"},
+			{"1.By", "By"},
+			{"%", "%"},
+			{"%{cpu}", "%{cpu}"},
+			{"By{transmitted}/s", "By{transmitted}/s"},
+			{"{requests}/s", "{requests}/s"},
+			{"{req/s}", "{req/s}"},
+			{"s0", "{s0}"},
+			{"s99", "{s99}"},
+			{"%2", "{%2}"},
+		}
+
+		for _, testCase := range testCases {
+			AssertUnitParsed(testCase.input, testCase.output)
+		}
+	})
 })
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+)
+
+func attribute(kvs []*KeyValue, key string) *AnyValue {
+	for _, kv := range kvs {
+		if *kv.Key == key {
+			return kv.Value
+		}
+	}
+	return nil
+}
+
+var _ = Describe("OTLP adapters", func() {
+	var (
+		ctx       context.Context
+		cancel    context.CancelFunc
+		collector *fakeCollector
+		conn      *grpc.ClientConn
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+		collector = newFakeCollector()
+		var err error
+		conn, err = Dial(collector.addr, true)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		cancel()
+		conn.Close()
+		collector.server.Stop()
+	})
+
+	Context("LogAdapter", func() {
+		var subject *LogAdapter
+
+		BeforeEach(func() {
+			subject = NewLogAdapter(ctx, conn, 2, time.Hour, lager.NewLogger("test"))
+		})
+
+		It("exports log records with severity, body, attributes and resource labels", func() {
+			subject.PostLog(&messages.Log{
+				Payload: map[string]interface{}{
+					"message":    "hello",
+					"timestamp":  int64(1500000000000000000),
+					"eventType":  "LogMessage",
+					"logMessage": map[string]interface{}{"message_type": "ERR"},
+				},
+				Labels:   map[string]string{"applicationPath": "/org/space/app", "job": "diego_cell"},
+				Severity: logging.Error,
+			})
+			Expect(subject.Flush()).To(Succeed())
+
+			reqs := collector.logRequests()
+			Expect(reqs).To(HaveLen(1))
+			Expect(reqs[0].ResourceLogs).To(HaveLen(1))
+			rl := reqs[0].ResourceLogs[0]
+			Expect(*attribute(rl.Resource.Attributes, "applicationPath").StringValue).To(Equal("/org/space/app"))
+			Expect(*attribute(rl.Resource.Attributes, "job").StringValue).To(Equal("diego_cell"))
+
+			record := rl.ScopeLogs[0].LogRecords[0]
+			Expect(*record.SeverityNumber).To(Equal(int32(17)))
+			Expect(*record.SeverityText).To(Equal("ERROR"))
+			Expect(*record.TimeUnixNano).To(Equal(uint64(1500000000000000000)))
+			Expect(*record.Body.StringValue).To(Equal("hello"))
+			Expect(*attribute(record.Attributes, "eventType").StringValue).To(Equal("LogMessage"))
+			logMessage := attribute(record.Attributes, "logMessage").KvlistValue
+			Expect(*attribute(logMessage.Values, "message_type").StringValue).To(Equal("ERR"))
+		})
+
+		It("sends full batches without waiting for the batch duration", func() {
+			post := func(app string) {
+				subject.PostLog(&messages.Log{
+					Payload: map[string]interface{}{"message": app},
+					Labels:  map[string]string{"applicationPath": app},
+				})
+			}
+			post("a")
+			post("b")
+			Eventually(collector.logRequests).Should(HaveLen(1))
+			// Logs are grouped by label set.
+			Expect(collector.logRequests()[0].ResourceLogs).To(HaveLen(2))
+
+			post("a")
+			Consistently(collector.logRequests).Should(HaveLen(1))
+			Expect(subject.Flush()).To(Succeed())
+			Expect(collector.logRequests()).To(HaveLen(2))
+		})
+	})
+
+	Context("MetricAdapter", func() {
+		It("exports gauges and monotonic cumulative sums", func() {
+			subject := NewMetricAdapter(conn, 200, lager.NewLogger("test"))
+			start := time.Unix(1500000000, 0)
+			end := start.Add(time.Minute)
+			labels := map[string]string{"job": "router"}
+
+			subject.PostMetrics([]*messages.Metric{
+				{Name: "firehose/gorouter.latency", Value: 0, Unit: "ms", Labels: labels, EventTime: end, StartTime: end, Type: events.Envelope_ValueMetric},
+				{Name: "firehose/gorouter.total_requests", IntValue: 42, Labels: labels, EventTime: end, StartTime: start, Type: events.Envelope_CounterEvent},
+			})
+
+			reqs := collector.metricRequests()
+			Expect(reqs).To(HaveLen(1))
+			Expect(reqs[0].ResourceMetrics).To(HaveLen(1))
+			rm := reqs[0].ResourceMetrics[0]
+			Expect(*attribute(rm.Resource.Attributes, "job").StringValue).To(Equal("router"))
+			Expect(*rm.ScopeMetrics[0].Scope.Name).NotTo(BeEmpty())
+
+			metrics := rm.ScopeMetrics[0].Metrics
+			Expect(metrics).To(HaveLen(2))
+			Expect(*metrics[0].Name).To(Equal("firehose/gorouter.latency"))
+			Expect(*metrics[0].Unit).To(Equal("ms"))
+			Expect(metrics[0].Sum).To(BeNil())
+			gauge := metrics[0].Gauge.DataPoints[0]
+			Expect(gauge.AsDouble).NotTo(BeNil(), "zero values are sent")
+			Expect(*gauge.TimeUnixNano).To(Equal(uint64(end.UnixNano())))
+
+			Expect(metrics[1].Gauge).To(BeNil())
+			sum := metrics[1].Sum
+			Expect(*sum.IsMonotonic).To(BeTrue())
+			Expect(*sum.AggregationTemporality).To(Equal(int32(aggregationTemporalityCumulative)))
+			Expect(*sum.DataPoints[0].AsInt).To(Equal(int64(42)))
+			Expect(*sum.DataPoints[0].StartTimeUnixNano).To(Equal(uint64(start.UnixNano())))
+		})
+
+		It("splits large exports", func() {
+			subject := NewMetricAdapter(conn, 2, lager.NewLogger("test"))
+			var metrics []*messages.Metric
+			for i := 0; i < 5; i++ {
+				metrics = append(metrics, &messages.Metric{Name: "gauge", Value: float64(i), Labels: map[string]string{"index": fmt.Sprint(i)}})
+			}
+			subject.PostMetrics(metrics)
+			Expect(collector.metricRequests()).To(HaveLen(3))
+		})
+	})
+})
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package otlp exports the logs and metrics of the nozzle to an OpenTelemetry
+// collector over OTLP/gRPC, as an alternative to calling the Stackdriver APIs.
+package otlp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/version"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// exportTimeout bounds each Export call to the collector.
+const exportTimeout = 10 * time.Second
+
+var (
+	logsExportedCount    *telemetry.Counter
+	logsDroppedCount     *telemetry.Counter
+	metricsExportedCount *telemetry.Counter
+	exportErrorsCount    *telemetry.Counter
+)
+
+func init() {
+	logsExportedCount = telemetry.NewCounter(telemetry.Nozzle, "otlp.logs.exported")
+	logsDroppedCount = telemetry.NewCounter(telemetry.Nozzle, "otlp.logs.dropped")
+	metricsExportedCount = telemetry.NewCounter(telemetry.Nozzle, "otlp.metrics.exported")
+	exportErrorsCount = telemetry.NewCounter(telemetry.Nozzle, "otlp.export.errors")
+}
+
+// Dial connects to the OTLP/gRPC endpoint of a collector, e.g.
+// "localhost:4317". The connection uses TLS unless insecure is set.
+func Dial(endpoint string, insecure bool) (*grpc.ClientConn, error) {
+	opt := grpc.WithInsecure()
+	if !insecure {
+		opt = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+	}
+	conn, err := grpc.Dial(endpoint, opt)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to OTLP endpoint %q: %v", endpoint, err)
+	}
+	return conn, nil
+}
+
+// scope identifies the nozzle as the instrumentation scope of all data.
+func scope() *InstrumentationScope {
+	return &InstrumentationScope{Name: proto.String(version.Name), Version: proto.String(version.Release())}
+}
+
+// resource puts the CF labels of a log or metric on resource attributes.
+func resource(labels map[string]string) *Resource {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	r := &Resource{}
+	for _, k := range keys {
+		r.Attributes = append(r.Attributes, &KeyValue{Key: proto.String(k), Value: stringValue(labels[k])})
+	}
+	return r
+}
+
+func stringValue(s string) *AnyValue {
+	return &AnyValue{StringValue: proto.String(s)}
+}
+
+// anyValue converts a value decoded from JSON, as found in log payloads, to
+// an AnyValue. Other types are formatted as strings.
+func anyValue(v interface{}) *AnyValue {
+	switch v := v.(type) {
+	case string:
+		return stringValue(v)
+	case bool:
+		return &AnyValue{BoolValue: proto.Bool(v)}
+	case int64:
+		return &AnyValue{IntValue: proto.Int64(v)}
+	case int:
+		return &AnyValue{IntValue: proto.Int64(int64(v))}
+	case float64:
+		return &AnyValue{DoubleValue: proto.Float64(v)}
+	case []interface{}:
+		array := &ArrayValue{}
+		for _, e := range v {
+			array.Values = append(array.Values, anyValue(e))
+		}
+		return &AnyValue{ArrayValue: array}
+	case map[string]interface{}:
+		return &AnyValue{KvlistValue: &KeyValueList{Values: attributes(v)}}
+	case nil:
+		return &AnyValue{}
+	}
+	return stringValue(fmt.Sprint(v))
+}
+
+func attributes(m map[string]interface{}) []*KeyValue {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]*KeyValue, 0, len(m))
+	for _, k := range keys {
+		kvs = append(kvs, &KeyValue{Key: proto.String(k), Value: anyValue(m[k])})
+	}
+	return kvs
+}
+
+func unixNano(t time.Time) *uint64 {
+	if t.IsZero() {
+		return nil
+	}
+	return proto.Uint64(uint64(t.UnixNano()))
+}
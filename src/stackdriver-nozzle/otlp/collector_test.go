@@ -0,0 +1,92 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package otlp
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc"
+)
+
+// fakeCollector is an in-process OTLP/gRPC collector that records the
+// requests it receives.
+type fakeCollector struct {
+	server *grpc.Server
+	addr   string
+
+	mu      sync.Mutex
+	logs    []*ExportLogsServiceRequest
+	metrics []*ExportMetricsServiceRequest
+}
+
+func newFakeCollector() *fakeCollector {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	c := &fakeCollector{server: grpc.NewServer(), addr: lis.Addr().String()}
+	c.server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "opentelemetry.proto.collector.logs.v1.LogsService",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Export",
+			Handler: func(_ interface{}, _ context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &ExportLogsServiceRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				c.logs = append(c.logs, req)
+				return &ExportLogsServiceResponse{}, nil
+			},
+		}},
+	}, c)
+	c.server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "opentelemetry.proto.collector.metrics.v1.MetricsService",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Export",
+			Handler: func(_ interface{}, _ context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &ExportMetricsServiceRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				c.metrics = append(c.metrics, req)
+				return &ExportMetricsServiceResponse{}, nil
+			},
+		}},
+	}, c)
+	go c.server.Serve(lis)
+	return c
+}
+
+func (c *fakeCollector) logRequests() []*ExportLogsServiceRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*ExportLogsServiceRequest(nil), c.logs...)
+}
+
+func (c *fakeCollector) metricRequests() []*ExportMetricsServiceRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*ExportMetricsServiceRequest(nil), c.metrics...)
+}
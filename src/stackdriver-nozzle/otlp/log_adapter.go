@@ -0,0 +1,201 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package otlp
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// maxPendingBatches caps how many batches of logs are held while the collector
+// is slow or unavailable; further logs are dropped.
+const maxPendingBatches = 100
+
+// severityNumbers maps Stackdriver Logging severities to OTel SeverityNumbers.
+// Default maps to SEVERITY_NUMBER_UNSPECIFIED.
+var severityNumbers = map[logging.Severity]int32{
+	logging.Debug:     5,  // DEBUG
+	logging.Info:      9,  // INFO
+	logging.Notice:    10, // INFO2
+	logging.Warning:   13, // WARN
+	logging.Error:     17, // ERROR
+	logging.Critical:  21, // FATAL
+	logging.Alert:     22, // FATAL2
+	logging.Emergency: 23, // FATAL3
+}
+
+// LogAdapter is a stackdriver.LogAdapter that exports logs to an OpenTelemetry
+// collector. Logs are sent in batches of up to batchCount logs, at least every
+// batchDuration.
+//
+// A log's "message" payload field becomes the body of the log record, and the
+// other payload fields its attributes. Its labels become resource attributes.
+type LogAdapter struct {
+	conn       *grpc.ClientConn
+	batchCount int
+	logger     lager.Logger
+
+	mu      sync.Mutex // protects `pending`
+	pending []*messages.Log
+	full    chan struct{}
+
+	exportMu sync.Mutex // serializes exports
+}
+
+// NewLogAdapter creates a LogAdapter exporting to conn, until ctx is done.
+func NewLogAdapter(ctx context.Context, conn *grpc.ClientConn, batchCount int, batchDuration time.Duration, logger lager.Logger) *LogAdapter {
+	la := &LogAdapter{
+		conn:       conn,
+		batchCount: batchCount,
+		logger:     logger,
+		full:       make(chan struct{}, 1),
+	}
+
+	ticker := time.NewTicker(batchDuration)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+			case <-la.full:
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+			if err := la.Flush(); err != nil {
+				la.logger.Error("otlp.LogAdapter", err)
+			}
+		}
+	}()
+	return la
+}
+
+// PostLog queues a log for export.
+func (la *LogAdapter) PostLog(log *messages.Log) {
+	la.mu.Lock()
+	defer la.mu.Unlock()
+
+	if len(la.pending) >= maxPendingBatches*la.batchCount {
+		logsDroppedCount.Increment()
+		return
+	}
+	la.pending = append(la.pending, log)
+	if len(la.pending) >= la.batchCount {
+		select {
+		case la.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush exports all queued logs.
+func (la *LogAdapter) Flush() error {
+	la.exportMu.Lock()
+	defer la.exportMu.Unlock()
+
+	for {
+		la.mu.Lock()
+		n := len(la.pending)
+		if n > la.batchCount {
+			n = la.batchCount
+		}
+		batch := la.pending[:n:n]
+		la.pending = la.pending[n:]
+		la.mu.Unlock()
+
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := la.export(batch); err != nil {
+			return err
+		}
+	}
+}
+
+func (la *LogAdapter) export(batch []*messages.Log) error {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	err := la.conn.Invoke(ctx, exportLogsMethod, logsRequest(batch, time.Now()), &ExportLogsServiceResponse{})
+	if err != nil {
+		exportErrorsCount.Increment()
+		return err
+	}
+	logsExportedCount.Add(int64(len(batch)))
+	return nil
+}
+
+// logsRequest groups logs by their labels into one ResourceLogs per label set.
+func logsRequest(logs []*messages.Log, observed time.Time) *ExportLogsServiceRequest {
+	req := &ExportLogsServiceRequest{}
+	byResource := map[string]*ScopeLogs{}
+	for _, log := range logs {
+		key := messages.Flatten(log.Labels)
+		sl, ok := byResource[key]
+		if !ok {
+			sl = &ScopeLogs{Scope: scope()}
+			byResource[key] = sl
+			req.ResourceLogs = append(req.ResourceLogs, &ResourceLogs{
+				Resource:  resource(log.Labels),
+				ScopeLogs: []*ScopeLogs{sl},
+			})
+		}
+		sl.LogRecords = append(sl.LogRecords, logRecord(log, observed))
+	}
+	return req
+}
+
+func logRecord(log *messages.Log, observed time.Time) *LogRecord {
+	record := &LogRecord{
+		ObservedTimeUnixNano: unixNano(observed),
+		SeverityText:         proto.String(strings.ToUpper(log.Severity.String())),
+	}
+	if n, ok := severityNumbers[log.Severity]; ok {
+		record.SeverityNumber = proto.Int32(n)
+	}
+
+	payload, ok := log.Payload.(map[string]interface{})
+	if !ok {
+		record.Body = anyValue(log.Payload)
+		return record
+	}
+	attrs := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		switch k {
+		case "message":
+			record.Body = anyValue(v)
+		case "timestamp":
+			// Set by the log sink to the envelope timestamp in nanoseconds.
+			if ts, ok := v.(int64); ok {
+				record.TimeUnixNano = proto.Uint64(uint64(ts))
+				continue
+			}
+			attrs[k] = v
+		default:
+			attrs[k] = v
+		}
+	}
+	record.Attributes = attributes(attrs)
+	return record
+}
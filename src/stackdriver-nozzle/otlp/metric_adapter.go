@@ -0,0 +1,108 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package otlp
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// MetricAdapter is a stackdriver.MetricAdapter that exports metrics to an
+// OpenTelemetry collector, in requests of up to batchSize metrics.
+//
+// Cumulative metrics become monotonic cumulative sums, starting at their
+// StartTime (as tracked by the CounterTracker), and all others gauges.
+// Metric labels become resource attributes.
+type MetricAdapter struct {
+	conn      *grpc.ClientConn
+	batchSize int
+	logger    lager.Logger
+}
+
+// NewMetricAdapter creates a MetricAdapter exporting to conn.
+func NewMetricAdapter(conn *grpc.ClientConn, batchSize int, logger lager.Logger) *MetricAdapter {
+	return &MetricAdapter{conn: conn, batchSize: batchSize, logger: logger}
+}
+
+// PostMetrics exports metrics to the collector.
+func (ma *MetricAdapter) PostMetrics(metrics []*messages.Metric) {
+	for len(metrics) > 0 {
+		n := len(metrics)
+		if n > ma.batchSize {
+			n = ma.batchSize
+		}
+		batch := metrics[:n]
+		metrics = metrics[n:]
+
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		err := ma.conn.Invoke(ctx, exportMetricsMethod, metricsRequest(batch), &ExportMetricsServiceResponse{})
+		cancel()
+		if err != nil {
+			exportErrorsCount.Increment()
+			ma.logger.Error("otlp.MetricAdapter", err, lager.Data{"metrics": len(batch)})
+			continue
+		}
+		metricsExportedCount.Add(int64(len(batch)))
+	}
+}
+
+// metricsRequest groups metrics by their labels into one ResourceMetrics per
+// label set.
+func metricsRequest(metrics []*messages.Metric) *ExportMetricsServiceRequest {
+	req := &ExportMetricsServiceRequest{}
+	byResource := map[string]*ScopeMetrics{}
+	for _, m := range metrics {
+		key := messages.Flatten(m.Labels)
+		sm, ok := byResource[key]
+		if !ok {
+			sm = &ScopeMetrics{Scope: scope()}
+			byResource[key] = sm
+			req.ResourceMetrics = append(req.ResourceMetrics, &ResourceMetrics{
+				Resource:     resource(m.Labels),
+				ScopeMetrics: []*ScopeMetrics{sm},
+			})
+		}
+		sm.Metrics = append(sm.Metrics, metric(m))
+	}
+	return req
+}
+
+func metric(m *messages.Metric) *Metric {
+	metric := &Metric{Name: proto.String(m.Name)}
+	if m.Unit != "" {
+		metric.Unit = proto.String(m.Unit)
+	}
+
+	point := &NumberDataPoint{TimeUnixNano: unixNano(m.EventTime)}
+	if m.IsCumulative() {
+		point.StartTimeUnixNano = unixNano(m.StartTime)
+		point.AsInt = proto.Int64(m.IntValue)
+		metric.Sum = &Sum{
+			DataPoints:             []*NumberDataPoint{point},
+			AggregationTemporality: proto.Int32(aggregationTemporalityCumulative),
+			IsMonotonic:            proto.Bool(true),
+		}
+	} else {
+		point.AsDouble = proto.Float64(m.Value)
+		metric.Gauge = &Gauge{DataPoints: []*NumberDataPoint{point}}
+	}
+	return metric
+}
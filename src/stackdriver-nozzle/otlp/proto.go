@@ -0,0 +1,214 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package otlp
+
+import "github.com/golang/protobuf/proto"
+
+// This file declares the subset of the OTLP protocol
+// (github.com/open-telemetry/opentelemetry-proto, v1) that the exporters use.
+// The generated Go packages are not vendored, so the messages are written by
+// hand with the same field numbers and wire types. Scalar fields are pointers
+// (proto2 style) so that zero values are still sent, which keeps the oneof
+// fields of AnyValue and NumberDataPoint unambiguous on the wire.
+
+const (
+	exportLogsMethod    = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+	exportMetricsMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+	// aggregationTemporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+	aggregationTemporalityCumulative = 2
+)
+
+// opentelemetry.proto.common.v1
+
+type AnyValue struct {
+	StringValue *string       `protobuf:"bytes,1,opt,name=string_value"`
+	BoolValue   *bool         `protobuf:"varint,2,opt,name=bool_value"`
+	IntValue    *int64        `protobuf:"varint,3,opt,name=int_value"`
+	DoubleValue *float64      `protobuf:"fixed64,4,opt,name=double_value"`
+	ArrayValue  *ArrayValue   `protobuf:"bytes,5,opt,name=array_value"`
+	KvlistValue *KeyValueList `protobuf:"bytes,6,opt,name=kvlist_value"`
+}
+
+func (m *AnyValue) Reset()         { *m = AnyValue{} }
+func (m *AnyValue) String() string { return proto.CompactTextString(m) }
+func (*AnyValue) ProtoMessage()    {}
+
+type ArrayValue struct {
+	Values []*AnyValue `protobuf:"bytes,1,rep,name=values"`
+}
+
+func (m *ArrayValue) Reset()         { *m = ArrayValue{} }
+func (m *ArrayValue) String() string { return proto.CompactTextString(m) }
+func (*ArrayValue) ProtoMessage()    {}
+
+type KeyValueList struct {
+	Values []*KeyValue `protobuf:"bytes,1,rep,name=values"`
+}
+
+func (m *KeyValueList) Reset()         { *m = KeyValueList{} }
+func (m *KeyValueList) String() string { return proto.CompactTextString(m) }
+func (*KeyValueList) ProtoMessage()    {}
+
+type KeyValue struct {
+	Key   *string   `protobuf:"bytes,1,opt,name=key"`
+	Value *AnyValue `protobuf:"bytes,2,opt,name=value"`
+}
+
+func (m *KeyValue) Reset()         { *m = KeyValue{} }
+func (m *KeyValue) String() string { return proto.CompactTextString(m) }
+func (*KeyValue) ProtoMessage()    {}
+
+type InstrumentationScope struct {
+	Name    *string `protobuf:"bytes,1,opt,name=name"`
+	Version *string `protobuf:"bytes,2,opt,name=version"`
+}
+
+func (m *InstrumentationScope) Reset()         { *m = InstrumentationScope{} }
+func (m *InstrumentationScope) String() string { return proto.CompactTextString(m) }
+func (*InstrumentationScope) ProtoMessage()    {}
+
+// opentelemetry.proto.resource.v1
+
+type Resource struct {
+	Attributes []*KeyValue `protobuf:"bytes,1,rep,name=attributes"`
+}
+
+func (m *Resource) Reset()         { *m = Resource{} }
+func (m *Resource) String() string { return proto.CompactTextString(m) }
+func (*Resource) ProtoMessage()    {}
+
+// opentelemetry.proto.logs.v1 and opentelemetry.proto.collector.logs.v1
+
+type ExportLogsServiceRequest struct {
+	ResourceLogs []*ResourceLogs `protobuf:"bytes,1,rep,name=resource_logs"`
+}
+
+func (m *ExportLogsServiceRequest) Reset()         { *m = ExportLogsServiceRequest{} }
+func (m *ExportLogsServiceRequest) String() string { return proto.CompactTextString(m) }
+func (*ExportLogsServiceRequest) ProtoMessage()    {}
+
+type ExportLogsServiceResponse struct{}
+
+func (m *ExportLogsServiceResponse) Reset()         { *m = ExportLogsServiceResponse{} }
+func (m *ExportLogsServiceResponse) String() string { return proto.CompactTextString(m) }
+func (*ExportLogsServiceResponse) ProtoMessage()    {}
+
+type ResourceLogs struct {
+	Resource  *Resource    `protobuf:"bytes,1,opt,name=resource"`
+	ScopeLogs []*ScopeLogs `protobuf:"bytes,2,rep,name=scope_logs"`
+}
+
+func (m *ResourceLogs) Reset()         { *m = ResourceLogs{} }
+func (m *ResourceLogs) String() string { return proto.CompactTextString(m) }
+func (*ResourceLogs) ProtoMessage()    {}
+
+type ScopeLogs struct {
+	Scope      *InstrumentationScope `protobuf:"bytes,1,opt,name=scope"`
+	LogRecords []*LogRecord          `protobuf:"bytes,2,rep,name=log_records"`
+}
+
+func (m *ScopeLogs) Reset()         { *m = ScopeLogs{} }
+func (m *ScopeLogs) String() string { return proto.CompactTextString(m) }
+func (*ScopeLogs) ProtoMessage()    {}
+
+type LogRecord struct {
+	TimeUnixNano         *uint64     `protobuf:"fixed64,1,opt,name=time_unix_nano"`
+	SeverityNumber       *int32      `protobuf:"varint,2,opt,name=severity_number"`
+	SeverityText         *string     `protobuf:"bytes,3,opt,name=severity_text"`
+	Body                 *AnyValue   `protobuf:"bytes,5,opt,name=body"`
+	Attributes           []*KeyValue `protobuf:"bytes,6,rep,name=attributes"`
+	ObservedTimeUnixNano *uint64     `protobuf:"fixed64,11,opt,name=observed_time_unix_nano"`
+}
+
+func (m *LogRecord) Reset()         { *m = LogRecord{} }
+func (m *LogRecord) String() string { return proto.CompactTextString(m) }
+func (*LogRecord) ProtoMessage()    {}
+
+// opentelemetry.proto.metrics.v1 and opentelemetry.proto.collector.metrics.v1
+
+type ExportMetricsServiceRequest struct {
+	ResourceMetrics []*ResourceMetrics `protobuf:"bytes,1,rep,name=resource_metrics"`
+}
+
+func (m *ExportMetricsServiceRequest) Reset()         { *m = ExportMetricsServiceRequest{} }
+func (m *ExportMetricsServiceRequest) String() string { return proto.CompactTextString(m) }
+func (*ExportMetricsServiceRequest) ProtoMessage()    {}
+
+type ExportMetricsServiceResponse struct{}
+
+func (m *ExportMetricsServiceResponse) Reset()         { *m = ExportMetricsServiceResponse{} }
+func (m *ExportMetricsServiceResponse) String() string { return proto.CompactTextString(m) }
+func (*ExportMetricsServiceResponse) ProtoMessage()    {}
+
+type ResourceMetrics struct {
+	Resource     *Resource       `protobuf:"bytes,1,opt,name=resource"`
+	ScopeMetrics []*ScopeMetrics `protobuf:"bytes,2,rep,name=scope_metrics"`
+}
+
+func (m *ResourceMetrics) Reset()         { *m = ResourceMetrics{} }
+func (m *ResourceMetrics) String() string { return proto.CompactTextString(m) }
+func (*ResourceMetrics) ProtoMessage()    {}
+
+type ScopeMetrics struct {
+	Scope   *InstrumentationScope `protobuf:"bytes,1,opt,name=scope"`
+	Metrics []*Metric             `protobuf:"bytes,2,rep,name=metrics"`
+}
+
+func (m *ScopeMetrics) Reset()         { *m = ScopeMetrics{} }
+func (m *ScopeMetrics) String() string { return proto.CompactTextString(m) }
+func (*ScopeMetrics) ProtoMessage()    {}
+
+type Metric struct {
+	Name  *string `protobuf:"bytes,1,opt,name=name"`
+	Unit  *string `protobuf:"bytes,3,opt,name=unit"`
+	Gauge *Gauge  `protobuf:"bytes,5,opt,name=gauge"`
+	Sum   *Sum    `protobuf:"bytes,7,opt,name=sum"`
+}
+
+func (m *Metric) Reset()         { *m = Metric{} }
+func (m *Metric) String() string { return proto.CompactTextString(m) }
+func (*Metric) ProtoMessage()    {}
+
+type Gauge struct {
+	DataPoints []*NumberDataPoint `protobuf:"bytes,1,rep,name=data_points"`
+}
+
+func (m *Gauge) Reset()         { *m = Gauge{} }
+func (m *Gauge) String() string { return proto.CompactTextString(m) }
+func (*Gauge) ProtoMessage()    {}
+
+type Sum struct {
+	DataPoints             []*NumberDataPoint `protobuf:"bytes,1,rep,name=data_points"`
+	AggregationTemporality *int32             `protobuf:"varint,2,opt,name=aggregation_temporality"`
+	IsMonotonic            *bool              `protobuf:"varint,3,opt,name=is_monotonic"`
+}
+
+func (m *Sum) Reset()         { *m = Sum{} }
+func (m *Sum) String() string { return proto.CompactTextString(m) }
+func (*Sum) ProtoMessage()    {}
+
+type NumberDataPoint struct {
+	StartTimeUnixNano *uint64  `protobuf:"fixed64,2,opt,name=start_time_unix_nano"`
+	TimeUnixNano      *uint64  `protobuf:"fixed64,3,opt,name=time_unix_nano"`
+	AsDouble          *float64 `protobuf:"fixed64,4,opt,name=as_double"`
+	AsInt             *int64   `protobuf:"fixed64,6,opt,name=as_int"`
+}
+
+func (m *NumberDataPoint) Reset()         { *m = NumberDataPoint{} }
+func (m *NumberDataPoint) String() string { return proto.CompactTextString(m) }
+func (*NumberDataPoint) ProtoMessage()    {}
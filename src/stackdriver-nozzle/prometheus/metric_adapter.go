@@ -0,0 +1,279 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package prometheus serves the metrics of the nozzle for Prometheus to
+// scrape, as an alternative to sending them to Stackdriver Monitoring.
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
+)
+
+// MetricsPath is the path of the scrape endpoint.
+const MetricsPath = "/metrics"
+
+// maxExpirePeriod caps how long expired series keep being served.
+const maxExpirePeriod = time.Minute
+
+var (
+	seriesExpiredCount  *telemetry.Counter
+	typeConflictsCount  *telemetry.Counter
+	scrapeRequestsCount *telemetry.Counter
+)
+
+func init() {
+	seriesExpiredCount = telemetry.NewCounter(telemetry.Nozzle, "prometheus.series.expired")
+	typeConflictsCount = telemetry.NewCounter(telemetry.Nozzle, "prometheus.type_conflicts")
+	scrapeRequestsCount = telemetry.NewCounter(telemetry.Nozzle, "prometheus.scrapes")
+}
+
+type series struct {
+	value        string
+	lastSeenTime time.Time
+}
+
+type family struct {
+	name    string // original name of the first metric of the family
+	counter bool
+	series  map[string]*series // by rendered label set, e.g. {index="0",job="router"}
+}
+
+// MetricAdapter is a stackdriver.MetricAdapter that keeps the latest value of
+// every series it is given and serves them on MetricsPath in the Prometheus
+// text exposition format.
+//
+// Metric names and label keys are sanitized to the characters Prometheus
+// allows. Cumulative metrics become counters, with a "_total" suffix, and all
+// others gauges. Series that have not been posted for the TTL are dropped.
+type MetricAdapter struct {
+	mu       sync.Mutex // protects `families`
+	families map[string]*family
+	ttl      time.Duration
+	logger   lager.Logger
+}
+
+// NewMetricAdapter creates a MetricAdapter that expires series after ttl.
+func NewMetricAdapter(ctx context.Context, ttl time.Duration, logger lager.Logger) *MetricAdapter {
+	ma := &MetricAdapter{
+		families: map[string]*family{},
+		ttl:      ttl,
+		logger:   logger,
+	}
+
+	expirePeriod := time.Duration(ttl.Nanoseconds() / 2)
+	if expirePeriod > maxExpirePeriod {
+		expirePeriod = maxExpirePeriod
+	}
+	ticker := time.NewTicker(expirePeriod)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				ma.expire()
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return ma
+}
+
+// PostMetrics records the values of metrics.
+func (ma *MetricAdapter) PostMetrics(metrics []*messages.Metric) {
+	now := time.Now()
+
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+
+	for _, metric := range metrics {
+		name := MetricName(metric.Name)
+		if metric.IsCumulative() && !strings.HasSuffix(name, "_total") {
+			name += "_total"
+		}
+		f, ok := ma.families[name]
+		if !ok {
+			f = &family{name: metric.Name, counter: metric.IsCumulative(), series: map[string]*series{}}
+			ma.families[name] = f
+		} else if f.counter != metric.IsCumulative() {
+			// A family can only have one type.
+			typeConflictsCount.Increment()
+			continue
+		}
+
+		value := strconv.FormatFloat(metric.Value, 'g', -1, 64)
+		if metric.IsCumulative() {
+			value = strconv.FormatInt(metric.IntValue, 10)
+		}
+		labels := renderLabels(metric.Labels)
+		s, ok := f.series[labels]
+		if !ok {
+			s = &series{}
+			f.series[labels] = s
+		}
+		s.value = value
+		s.lastSeenTime = now
+	}
+}
+
+// ServeHTTP writes all live series, sorted by name and labels. They are
+// rendered before writing, so a slow scraper does not hold up PostMetrics.
+func (ma *MetricAdapter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scrapeRequestsCount.Increment()
+
+	var out bytes.Buffer
+	ma.render(&out)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := w.Write(out.Bytes()); err != nil {
+		ma.logger.Error("prometheus.ServeHTTP", err)
+	}
+}
+
+// render writes all live series to out in the Prometheus text format.
+func (ma *MetricAdapter) render(out *bytes.Buffer) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+
+	names := make([]string, 0, len(ma.families))
+	for name := range ma.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := ma.families[name]
+		metricType := "gauge"
+		if f.counter {
+			metricType = "counter"
+		}
+		out.WriteString("# HELP " + name + " stackdriver-nozzle metric " + escapeHelp(f.name) + "\n")
+		out.WriteString("# TYPE " + name + " " + metricType + "\n")
+
+		keys := make([]string, 0, len(f.series))
+		for labels := range f.series {
+			keys = append(keys, labels)
+		}
+		sort.Strings(keys)
+		for _, labels := range keys {
+			out.WriteString(name + labels + " " + f.series[labels].value + "\n")
+		}
+	}
+}
+
+func (ma *MetricAdapter) expire() {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+
+	for name, f := range ma.families {
+		for labels, s := range f.series {
+			if time.Since(s.lastSeenTime) > ma.ttl {
+				delete(f.series, labels)
+				seriesExpiredCount.Increment()
+			}
+		}
+		if len(f.series) == 0 {
+			delete(ma.families, name)
+		}
+	}
+}
+
+// MetricName turns a nozzle metric name, e.g. "firehose/gorouter.total_requests",
+// into a valid Prometheus metric name, e.g. "firehose_gorouter_total_requests".
+func MetricName(name string) string {
+	return sanitize(name, true)
+}
+
+// LabelName turns a label key into a valid Prometheus label name. Names
+// starting with "__" are reserved, so those get an extra prefix.
+func LabelName(key string) string {
+	name := sanitize(key, false)
+	if strings.HasPrefix(name, "__") {
+		name = "label" + name
+	}
+	return name
+}
+
+func sanitize(name string, allowColon bool) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':' && allowColon:
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+func renderLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	rendered := make(map[string]string, len(labels))
+	names := make([]string, 0, len(labels))
+	for k, v := range labels {
+		name := LabelName(k)
+		if _, ok := rendered[name]; !ok {
+			names = append(names, name)
+		}
+		rendered[name] = v
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(rendered[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
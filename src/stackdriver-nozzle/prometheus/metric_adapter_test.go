@@ -0,0 +1,124 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package prometheus
+
+import (
+	"context"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MetricAdapter", func() {
+	var (
+		ctx     context.Context
+		cancel  context.CancelFunc
+		subject *MetricAdapter
+	)
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		subject.ServeHTTP(w, httptest.NewRequest("GET", MetricsPath, nil))
+		Expect(w.Header().Get("Content-Type")).To(HavePrefix("text/plain; version=0.0.4"))
+		return w.Body.String()
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+		subject = NewMetricAdapter(ctx, time.Minute, lager.NewLogger("test"))
+		typeConflictsCount.Set(0)
+		seriesExpiredCount.Set(0)
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("serves gauges and counters", func() {
+		subject.PostMetrics([]*messages.Metric{
+			{Name: "firehose/gorouter.latency", Value: 1.5, Labels: map[string]string{"job": "router", "index": "0"}, Type: events.Envelope_ValueMetric},
+			{Name: "firehose/gorouter.total_requests", IntValue: 42, Labels: map[string]string{"job": "router"}, Type: events.Envelope_CounterEvent},
+		})
+		subject.PostMetrics([]*messages.Metric{
+			{Name: "firehose/gorouter.latency", Value: 2, Labels: map[string]string{"job": "router", "index": "0"}, Type: events.Envelope_ValueMetric},
+		})
+
+		Expect(scrape()).To(Equal(`# HELP firehose_gorouter_latency stackdriver-nozzle metric firehose/gorouter.latency
+# TYPE firehose_gorouter_latency gauge
+firehose_gorouter_latency{index="0",job="router"} 2
+# HELP firehose_gorouter_total_requests_total stackdriver-nozzle metric firehose/gorouter.total_requests
+# TYPE firehose_gorouter_total_requests_total counter
+firehose_gorouter_total_requests_total{job="router"} 42
+`))
+	})
+
+	It("sanitizes names and escapes label values", func() {
+		subject.PostMetrics([]*messages.Metric{
+			{Name: "1st-metric", Value: 1, Labels: map[string]string{"applicationPath": `/org/"space"/app\`, "__name__": "x", "a.b": "c"}, Type: events.Envelope_ValueMetric},
+		})
+		Expect(scrape()).To(ContainSubstring(`_1st_metric{a_b="c",applicationPath="/org/\"space\"/app\\",label__name__="x"} 1`))
+	})
+
+	It("keeps the first type of a metric name", func() {
+		subject.PostMetrics([]*messages.Metric{
+			{Name: "requests_total", IntValue: 1, Type: events.Envelope_CounterEvent},
+			{Name: "requests_total", Value: 2, Type: events.Envelope_ValueMetric},
+		})
+		Expect(scrape()).To(ContainSubstring("requests_total 1\n"))
+		Expect(typeConflictsCount.IntValue()).To(Equal(1))
+	})
+
+	It("expires stale series", func() {
+		subject = NewMetricAdapter(ctx, 10*time.Millisecond, lager.NewLogger("test"))
+		subject.PostMetrics([]*messages.Metric{{Name: "gauge", Value: 1, Type: events.Envelope_ValueMetric}})
+		Expect(scrape()).To(ContainSubstring("gauge 1"))
+
+		Eventually(scrape).Should(BeEmpty())
+		Expect(seriesExpiredCount.IntValue()).To(Equal(1))
+	})
+
+	It("accepts metrics while a scraper is slow to read", func() {
+		subject.PostMetrics([]*messages.Metric{{Name: "gauge", Value: 1, Type: events.Envelope_ValueMetric}})
+		w := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{})}
+		defer close(w.release)
+		go subject.ServeHTTP(w, httptest.NewRequest("GET", MetricsPath, nil))
+
+		posted := make(chan struct{})
+		go func() {
+			subject.PostMetrics([]*messages.Metric{{Name: "gauge", Value: 2, Type: events.Envelope_ValueMetric}})
+			close(posted)
+		}()
+		Eventually(posted).Should(BeClosed())
+	})
+})
+
+// blockingWriter is a ResponseWriter whose writes block until release is
+// closed, like a scraper that stopped reading.
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	<-w.release
+	return w.ResponseRecorder.Write(b)
+}
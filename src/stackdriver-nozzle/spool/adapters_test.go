@@ -0,0 +1,257 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package spool
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/mocks"
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errUnavailable = status.Error(codes.Unavailable, "The service is currently unavailable.")
+
+// fakeLogAdapter fails to flush while failing is set.
+type fakeLogAdapter struct {
+	mu      sync.Mutex
+	failing bool
+	pending []messages.Log
+	flushed []messages.Log
+}
+
+func (la *fakeLogAdapter) PostLog(log *messages.Log) {
+	la.mu.Lock()
+	defer la.mu.Unlock()
+	la.pending = append(la.pending, *log)
+}
+
+func (la *fakeLogAdapter) Flush() error {
+	la.mu.Lock()
+	defer la.mu.Unlock()
+	pending := la.pending
+	la.pending = nil
+	if la.failing {
+		// Like the Logging client, which only reports the text of errors.
+		return errors.New("saw 1 errors; last: " + errUnavailable.Error())
+	}
+	la.flushed = append(la.flushed, pending...)
+	return nil
+}
+
+func (la *fakeLogAdapter) setFailing(failing bool) {
+	la.mu.Lock()
+	defer la.mu.Unlock()
+	la.failing = failing
+}
+
+func (la *fakeLogAdapter) Flushed() []messages.Log {
+	la.mu.Lock()
+	defer la.mu.Unlock()
+	return append([]messages.Log(nil), la.flushed...)
+}
+
+// fakeMetricWriter fails with err, if set.
+type fakeMetricWriter struct {
+	mu      sync.Mutex
+	err     error
+	written [][]*messages.Metric
+}
+
+func (mw *fakeMetricWriter) PostMetrics(metrics []*messages.Metric) {
+	mw.WriteMetrics(metrics)
+}
+
+func (mw *fakeMetricWriter) WriteMetrics(metrics []*messages.Metric) error {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if mw.err != nil {
+		return mw.err
+	}
+	mw.written = append(mw.written, metrics)
+	return nil
+}
+
+func (mw *fakeMetricWriter) setErr(err error) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	mw.err = err
+}
+
+func (mw *fakeMetricWriter) Written() [][]*messages.Metric {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	return append([][]*messages.Metric(nil), mw.written...)
+}
+
+var _ = Describe("Spooling adapters", func() {
+	var (
+		dir    string
+		q      *Queue
+		ctx    context.Context
+		cancel context.CancelFunc
+		logger *mocks.MockLogger
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "spool")
+		Expect(err).NotTo(HaveOccurred())
+		q, err = Open(dir, 1<<20, 1<<16)
+		Expect(err).NotTo(HaveOccurred())
+		ctx, cancel = context.WithCancel(context.Background())
+		logger = &mocks.MockLogger{}
+	})
+
+	AfterEach(func() {
+		cancel()
+		q.Close()
+		os.RemoveAll(dir)
+	})
+
+	Context("logs", func() {
+		var next *fakeLogAdapter
+
+		BeforeEach(func() {
+			next = &fakeLogAdapter{}
+		})
+
+		It("delivers logs in order, preserving their payload", func() {
+			subject := NewLogAdapter(ctx, q, next, logger)
+			for i := int64(0); i < 3; i++ {
+				subject.PostLog(&messages.Log{
+					Payload:  map[string]interface{}{"timestamp": int64(1546300800000000001) + i, "ratio": 0.5, "tags": []interface{}{"a"}},
+					Labels:   map[string]string{"job": "router"},
+					Severity: logging.Warning,
+				})
+			}
+
+			Eventually(next.Flushed).Should(HaveLen(3))
+			logs := next.Flushed()
+			for i, log := range logs {
+				Expect(log.Payload).To(Equal(map[string]interface{}{"timestamp": int64(1546300800000000001) + int64(i), "ratio": 0.5, "tags": []interface{}{"a"}}))
+				Expect(log.Labels).To(Equal(map[string]string{"job": "router"}))
+				Expect(log.Severity).To(Equal(logging.Warning))
+			}
+			Eventually(logStats.depth.IntValue).Should(Equal(0))
+		})
+
+		It("redelivers logs until Stackdriver is available", func() {
+			retries := logStats.retries.IntValue()
+			next.setFailing(true)
+			subject := NewLogAdapter(ctx, q, next, logger)
+			subject.PostLog(&messages.Log{Payload: "first"})
+
+			Eventually(logStats.retries.IntValue).Should(BeNumerically(">", retries))
+			subject.PostLog(&messages.Log{Payload: "second"})
+			next.setFailing(false)
+
+			Eventually(next.Flushed, 5*time.Second).Should(HaveLen(2))
+			Expect(next.Flushed()[0].Payload).To(Equal("first"))
+			Expect(next.Flushed()[1].Payload).To(Equal("second"))
+		})
+
+		It("delivers logs spooled before a restart", func() {
+			next.setFailing(true)
+			restartCtx, stop := context.WithCancel(ctx)
+			subject := NewLogAdapter(restartCtx, q, next, logger)
+			subject.PostLog(&messages.Log{Payload: "before"})
+			Expect(subject.Flush()).To(Succeed())
+			stop()
+			Expect(q.Close()).To(Succeed())
+
+			var err error
+			q, err = Open(dir, 1<<20, 1<<16)
+			Expect(err).NotTo(HaveOccurred())
+			next = &fakeLogAdapter{}
+			NewLogAdapter(ctx, q, next, logger)
+
+			Eventually(next.Flushed).Should(HaveLen(1))
+			Expect(next.Flushed()[0].Payload).To(Equal("before"))
+		})
+	})
+
+	Context("metrics", func() {
+		var next *fakeMetricWriter
+
+		BeforeEach(func() {
+			next = &fakeMetricWriter{}
+		})
+
+		It("delivers batches of metrics in order, with all their fields", func() {
+			eventTime := time.Unix(1546300800, 5).UTC()
+			metric := &messages.Metric{
+				Name:      "requests",
+				Labels:    map[string]string{"job": "router"},
+				IntValue:  3,
+				EventTime: eventTime,
+				StartTime: eventTime.Add(-time.Minute),
+				Unit:      "1",
+				Type:      events.Envelope_CounterEvent,
+			}
+			subject := NewMetricAdapter(ctx, q, next, logger)
+			subject.PostMetrics([]*messages.Metric{metric})
+			subject.PostMetrics([]*messages.Metric{{Name: "gauge", Value: 1.5, EventTime: eventTime}})
+
+			Eventually(next.Written).Should(HaveLen(2))
+			written := next.Written()
+			Expect(written[0]).To(ConsistOf(metric))
+			Expect(written[1][0].Name).To(Equal("gauge"))
+			Expect(written[1][0].Value).To(Equal(1.5))
+		})
+
+		It("redelivers metrics until Stackdriver is available", func() {
+			retries := metricStats.retries.IntValue()
+			next.setErr(errUnavailable)
+			subject := NewMetricAdapter(ctx, q, next, logger)
+			subject.PostMetrics([]*messages.Metric{{Name: "a"}})
+			subject.PostMetrics([]*messages.Metric{{Name: "b"}})
+
+			Eventually(metricStats.retries.IntValue).Should(BeNumerically(">", retries))
+			Eventually(metricStats.depth.IntValue, 15*time.Second).Should(Equal(2))
+			Expect(metricStats.age.IntValue()).To(BeNumerically(">=", 0))
+			next.setErr(nil)
+
+			Eventually(next.Written, 5*time.Second).Should(HaveLen(2))
+			Expect(next.Written()[0][0].Name).To(Equal("a"))
+			Expect(next.Written()[1][0].Name).To(Equal("b"))
+		})
+
+		It("drops metrics while the spool is full", func() {
+			Expect(q.Close()).To(Succeed())
+			var err error
+			q, err = Open(dir, 64, 64)
+			Expect(err).NotTo(HaveOccurred())
+			dropped := metricStats.dropped.IntValue()
+			next.setErr(errUnavailable)
+
+			subject := NewMetricAdapter(ctx, q, next, logger)
+			subject.PostMetrics([]*messages.Metric{{Name: "a"}})
+			Expect(metricStats.dropped.IntValue()).To(Equal(dropped + 1))
+		})
+	})
+})
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package spool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/stackdriver"
+)
+
+// logBatch is how many spooled logs are posted before flushing them.
+const logBatch = 1000
+
+type logAdapter struct {
+	q      *Queue
+	logger lager.Logger
+}
+
+// NewLogAdapter returns a LogAdapter that appends logs to q, and replays them
+// to next until ctx is done. Flush syncs q to disk.
+func NewLogAdapter(ctx context.Context, q *Queue, next stackdriver.LogAdapter, logger lager.Logger) stackdriver.LogAdapter {
+	deliver := func(records []Record) error {
+		for _, r := range records {
+			log, err := decodeLog(r.Data)
+			if err != nil {
+				logStats.dropped.Increment()
+				logger.Error("spool.logs", err, lager.Data{"info": "Could not decode spooled log"})
+				continue
+			}
+			next.PostLog(log)
+		}
+		err := next.Flush()
+		if err != nil && !stackdriver.IsRetryable(err) {
+			logger.Error("spool.logs", err, lager.Data{"info": "Spooled logs were rejected"})
+			return nil
+		}
+		return err
+	}
+	go replay(ctx, q, logBatch, deliver, logStats, logger)
+
+	return &logAdapter{q: q, logger: logger}
+}
+
+func (la *logAdapter) PostLog(log *messages.Log) {
+	data, err := json.Marshal(log)
+	if err == nil {
+		err = la.q.Append(data)
+	}
+	if err != nil {
+		logStats.dropped.Increment()
+		if err != ErrFull {
+			la.logger.Error("spool.logs", err, lager.Data{"info": "Could not spool log"})
+		}
+		return
+	}
+	logStats.written.Increment()
+}
+
+func (la *logAdapter) Flush() error {
+	return la.q.Sync()
+}
+
+func decodeLog(data []byte) (*messages.Log, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	// Payloads hold int64 values, such as timestamps in nanoseconds, which
+	// do not survive being decoded as a float64.
+	d.UseNumber()
+	log := &messages.Log{}
+	if err := d.Decode(log); err != nil {
+		return nil, err
+	}
+	log.Payload = fromNumbers(log.Payload)
+	return log, nil
+}
+
+// fromNumbers replaces the json.Numbers in v with int64 values, or float64
+// values if they are not integers.
+func fromNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = fromNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = fromNumbers(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package spool
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/stackdriver"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// spooledMetric holds all the fields of a messages.Metric, some of which it
+// leaves out of its JSON form.
+type spooledMetric struct {
+	Name      string
+	Labels    map[string]string
+	Value     float64
+	IntValue  int64
+	EventTime time.Time
+	StartTime time.Time
+	Unit      string
+	Type      events.Envelope_EventType
+}
+
+type metricAdapter struct {
+	q      *Queue
+	logger lager.Logger
+}
+
+// NewMetricAdapter returns a MetricAdapter that appends each batch of metrics
+// to q, and replays them to next until ctx is done.
+//
+// Batches are replayed one at a time, as merging them could put two points of
+// a time series in one request. Points written again after a failure are
+// rejected by Stackdriver as out of order, which the MetricWriter absorbs.
+func NewMetricAdapter(ctx context.Context, q *Queue, next stackdriver.MetricWriter, logger lager.Logger) stackdriver.MetricAdapter {
+	deliver := func(records []Record) error {
+		for _, r := range records {
+			var spooled []spooledMetric
+			if err := json.Unmarshal(r.Data, &spooled); err != nil {
+				metricStats.dropped.Increment()
+				logger.Error("spool.metrics", err, lager.Data{"info": "Could not decode spooled metrics"})
+				continue
+			}
+			metrics := make([]*messages.Metric, len(spooled))
+			for i, m := range spooled {
+				metric := messages.Metric(m)
+				metrics[i] = &metric
+			}
+			if err := next.WriteMetrics(metrics); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	go replay(ctx, q, 1, deliver, metricStats, logger)
+
+	return &metricAdapter{q: q, logger: logger}
+}
+
+func (ma *metricAdapter) PostMetrics(metrics []*messages.Metric) {
+	if len(metrics) == 0 {
+		return
+	}
+	spooled := make([]spooledMetric, len(metrics))
+	for i, m := range metrics {
+		spooled[i] = spooledMetric(*m)
+	}
+
+	data, err := json.Marshal(spooled)
+	if err == nil {
+		err = ma.q.Append(data)
+	}
+	if err != nil {
+		metricStats.dropped.Increment()
+		if err != ErrFull {
+			ma.logger.Error("spool.metrics", err, lager.Data{"info": "Could not spool metrics"})
+		}
+		return
+	}
+	metricStats.written.Increment()
+}
@@ -0,0 +1,441 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrFull is returned by Queue.Append when a record would take the queue over
+// its size cap. The record is not written.
+var ErrFull = errors.New("spool is full")
+
+const (
+	segmentSuffix = ".seg"
+	cursorFile    = "cursor"
+
+	// A record is its length, the CRC-32C of its data and the time it was
+	// appended in nanoseconds since the epoch, followed by its data.
+	headerSize = 16
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A Record is an entry of a Queue.
+type Record struct {
+	Time time.Time
+	Data []byte
+}
+
+// A Cursor is the position after a batch of records returned by Queue.Read.
+type Cursor struct {
+	seq     uint64
+	offset  int64
+	records int
+	bytes   int64
+}
+
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// Queue is a write-ahead queue of records stored in segment files in a
+// directory. Records are read back in the order they were appended, and stay
+// on disk until they are acknowledged, so they survive restarts: a record is
+// read at least once.
+//
+// Segments are deleted once all their records are acknowledged. The queue
+// refuses new records rather than drop unacknowledged ones when its segments
+// would grow over a size cap.
+type Queue struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	mu sync.Mutex
+	// segments are ordered oldest first; records are appended to the last,
+	// and read starting from the cursor in the first.
+	segments []segment
+	w        *os.File
+	cursor   int64
+
+	pending      int
+	pendingBytes int64
+
+	ready chan struct{}
+}
+
+// Open opens the queue in dir, creating the directory if needed. The
+// segments of the queue are kept under maxBytes in total, and a new segment
+// is started once the last one reaches segmentBytes.
+func Open(dir string, maxBytes, segmentBytes int64) (*Queue, error) {
+	if segmentBytes <= 0 || maxBytes < segmentBytes {
+		return nil, fmt.Errorf("spool size %d must be at least the segment size %d, which must be positive", maxBytes, segmentBytes)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		ready:        make(chan struct{}, 1),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	if q.pending > 0 {
+		q.ready <- struct{}{}
+	}
+	return q, nil
+}
+
+// load finds the segments and cursor left by a previous process, truncating
+// records that were partially written when it stopped.
+func (q *Queue) load() error {
+	names, err := filepath.Glob(filepath.Join(q.dir, "*"+segmentSuffix))
+	if err != nil {
+		return err
+	}
+	var seqs []uint64
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), segmentSuffix), 10, 64)
+		if err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	cursorSeq, cursor := q.readCursor()
+	for _, seq := range seqs {
+		if seq < cursorSeq {
+			// Acknowledged before the segment could be deleted.
+			if err := os.Remove(q.segmentPath(seq)); err != nil {
+				return err
+			}
+			continue
+		}
+		start := int64(0)
+		if seq == cursorSeq {
+			start = cursor
+		}
+		size, records, bytes, err := q.scan(seq, start)
+		if err != nil {
+			return err
+		}
+		if len(q.segments) == 0 {
+			q.cursor = start
+			if start > size {
+				q.cursor = size
+			}
+		}
+		q.segments = append(q.segments, segment{seq: seq, size: size})
+		q.pending += records
+		q.pendingBytes += bytes
+	}
+
+	if len(q.segments) == 0 {
+		q.cursor = 0
+		return q.startSegment(cursorSeq + 1)
+	}
+	last := q.segments[len(q.segments)-1]
+	q.w, err = os.OpenFile(q.segmentPath(last.seq), os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// scan validates the records of a segment after start, truncating it after
+// the last valid one. It returns the resulting size of the segment, and the
+// number and size of the records after start.
+func (q *Queue) scan(seq uint64, start int64) (size int64, records int, bytes int64, err error) {
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_RDWR, 0644)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if start > info.Size() {
+		return info.Size(), 0, 0, nil
+	}
+
+	r := &segmentReader{r: f, offset: start, end: info.Size()}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return 0, 0, 0, err
+	}
+	for {
+		before := r.offset
+		if _, err := r.next(); err != nil {
+			if err == io.EOF {
+				return before, records, bytes, nil
+			}
+			return before, records, bytes, f.Truncate(before)
+		}
+		records++
+		bytes += r.offset - before
+	}
+}
+
+func (q *Queue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// readCursor returns the acknowledged position, or the start of the queue if
+// there is none.
+func (q *Queue) readCursor() (seq uint64, offset int64) {
+	b, err := ioutil.ReadFile(filepath.Join(q.dir, cursorFile))
+	if err != nil || len(b) != 16 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint64(b), int64(binary.BigEndian.Uint64(b[8:]))
+}
+
+func (q *Queue) writeCursor(seq uint64, offset int64) error {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, seq)
+	binary.BigEndian.PutUint64(b[8:], uint64(offset))
+
+	path := filepath.Join(q.dir, cursorFile)
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (q *Queue) startSegment(seq uint64) error {
+	if q.w != nil {
+		if err := q.w.Sync(); err != nil {
+			return err
+		}
+		if err := q.w.Close(); err != nil {
+			return err
+		}
+	}
+	w, err := os.OpenFile(q.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	q.w = w
+	q.segments = append(q.segments, segment{seq: seq})
+	return nil
+}
+
+func (q *Queue) size() int64 {
+	var size int64
+	for _, s := range q.segments {
+		size += s.size
+	}
+	return size
+}
+
+// Append adds a record with data to the end of the queue.
+func (q *Queue) Append(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := int64(headerSize + len(data))
+	if q.size()+n > q.maxBytes {
+		return ErrFull
+	}
+	if last := q.segments[len(q.segments)-1]; last.size > 0 && last.size+n > q.segmentBytes {
+		if err := q.startSegment(last.seq + 1); err != nil {
+			return err
+		}
+	}
+
+	b := make([]byte, n)
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	binary.BigEndian.PutUint32(b[4:], crc32.Checksum(data, crcTable))
+	binary.BigEndian.PutUint64(b[8:], uint64(time.Now().UnixNano()))
+	copy(b[headerSize:], data)
+	last := &q.segments[len(q.segments)-1]
+	if _, err := q.w.Write(b); err != nil {
+		// Do not leave a partial record for readers to trip over.
+		q.w.Truncate(last.size)
+		return err
+	}
+	last.size += n
+
+	q.pending++
+	q.pendingBytes += n
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Ready is signalled when records are appended.
+func (q *Queue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Read returns up to max records from the start of the queue, and the cursor
+// to acknowledge them with. Until then, Read returns the same records again.
+func (q *Queue) Read(max int) ([]Record, Cursor, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	c := Cursor{seq: q.segments[0].seq, offset: q.cursor}
+	var records []Record
+	for i, s := range q.segments {
+		if i > 0 {
+			if c.offset < q.segments[i-1].size {
+				break
+			}
+			// Moving past the previous segment lets Ack delete it.
+			c.seq, c.offset = s.seq, 0
+		}
+		if len(records) == max || c.offset >= s.size {
+			continue
+		}
+
+		f, err := os.Open(q.segmentPath(s.seq))
+		if err != nil {
+			return nil, c, err
+		}
+		if _, err := f.Seek(c.offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, c, err
+		}
+		r := &segmentReader{r: f, offset: c.offset, end: s.size}
+		for len(records) < max && r.offset < s.size {
+			record, err := r.next()
+			if err != nil {
+				f.Close()
+				return nil, c, fmt.Errorf("reading %s at %d: %v", f.Name(), c.offset, err)
+			}
+			records = append(records, record)
+			c.records++
+			c.bytes += r.offset - c.offset
+			c.offset = r.offset
+		}
+		f.Close()
+	}
+	return records, c, nil
+}
+
+// Ack removes the records up to c from the queue.
+func (q *Queue) Ack(c Cursor) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.segments) > 1 && q.segments[0].seq < c.seq {
+		if err := os.Remove(q.segmentPath(q.segments[0].seq)); err != nil {
+			return err
+		}
+		q.segments = q.segments[1:]
+	}
+	q.cursor = c.offset
+	q.pending -= c.records
+	q.pendingBytes -= c.bytes
+	return q.writeCursor(c.seq, c.offset)
+}
+
+// Stats returns the number and size of the records in the queue, and when
+// the oldest of them was appended.
+func (q *Queue) Stats() (records int, bytes int64, oldest time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending == 0 {
+		return 0, 0, time.Time{}
+	}
+	for _, s := range q.segments {
+		offset := int64(0)
+		if s.seq == q.segments[0].seq {
+			offset = q.cursor
+		}
+		if offset >= s.size {
+			continue
+		}
+		f, err := os.Open(q.segmentPath(s.seq))
+		if err != nil {
+			break
+		}
+		header := make([]byte, headerSize)
+		_, err = f.ReadAt(header, offset)
+		f.Close()
+		if err == nil {
+			oldest = time.Unix(0, int64(binary.BigEndian.Uint64(header[8:])))
+		}
+		break
+	}
+	return q.pending, q.pendingBytes, oldest
+}
+
+// Sync commits the records appended so far to stable storage.
+func (q *Queue) Sync() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.w.Sync()
+}
+
+// Close syncs and closes the segment being appended to.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.w.Sync(); err != nil {
+		return err
+	}
+	return q.w.Close()
+}
+
+// segmentReader reads the records of a segment up to end, tracking its
+// offset.
+type segmentReader struct {
+	r      io.Reader
+	offset int64
+	end    int64
+}
+
+var errCorrupt = errors.New("corrupt record")
+
+func (sr *segmentReader) next() (Record, error) {
+	if sr.offset >= sr.end {
+		return Record{}, io.EOF
+	}
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(sr.r, header); err != nil {
+		return Record{}, errCorrupt
+	}
+	length := int64(binary.BigEndian.Uint32(header))
+	if sr.offset+headerSize+length > sr.end {
+		return Record{}, errCorrupt
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(sr.r, data); err != nil || crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return Record{}, errCorrupt
+	}
+	sr.offset += headerSize + length
+	return Record{Time: time.Unix(0, int64(binary.BigEndian.Uint64(header[8:]))), Data: data}, nil
+}
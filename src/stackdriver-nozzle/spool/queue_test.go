@@ -0,0 +1,181 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Queue", func() {
+	var (
+		dir     string
+		subject *Queue
+	)
+
+	open := func(maxBytes, segmentBytes int64) *Queue {
+		q, err := Open(dir, maxBytes, segmentBytes)
+		Expect(err).NotTo(HaveOccurred())
+		return q
+	}
+
+	appendAll := func(q *Queue, data ...string) {
+		for _, d := range data {
+			Expect(q.Append([]byte(d))).To(Succeed())
+		}
+	}
+
+	read := func(q *Queue, max int) ([]string, Cursor) {
+		records, cursor, err := q.Read(max)
+		Expect(err).NotTo(HaveOccurred())
+		var data []string
+		for _, r := range records {
+			data = append(data, string(r.Data))
+		}
+		return data, cursor
+	}
+
+	segments := func() []string {
+		names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+		Expect(err).NotTo(HaveOccurred())
+		return names
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "spool")
+		Expect(err).NotTo(HaveOccurred())
+		// Records of 2 bytes take 18 bytes, so segments hold 3 of them.
+		subject = open(1000, 60)
+	})
+
+	AfterEach(func() {
+		subject.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("reads records in order until they are acknowledged", func() {
+		appendAll(subject, "r0", "r1", "r2", "r3", "r4")
+
+		data, _ := read(subject, 2)
+		Expect(data).To(Equal([]string{"r0", "r1"}))
+		data, cursor := read(subject, 4)
+		Expect(data).To(Equal([]string{"r0", "r1", "r2", "r3"}))
+
+		Expect(subject.Ack(cursor)).To(Succeed())
+		data, _ = read(subject, 10)
+		Expect(data).To(Equal([]string{"r4"}))
+	})
+
+	It("deletes segments once their records are acknowledged", func() {
+		for i := 0; i < 7; i++ {
+			appendAll(subject, fmt.Sprintf("r%d", i))
+		}
+		Expect(segments()).To(HaveLen(3))
+
+		_, cursor := read(subject, 4)
+		Expect(subject.Ack(cursor)).To(Succeed())
+		Expect(segments()).To(HaveLen(2))
+
+		_, cursor = read(subject, 10)
+		Expect(subject.Ack(cursor)).To(Succeed())
+		Expect(segments()).To(HaveLen(1))
+		data, _ := read(subject, 10)
+		Expect(data).To(BeEmpty())
+	})
+
+	It("tracks the records waiting to be acknowledged", func() {
+		records, bytes, _ := subject.Stats()
+		Expect(records).To(Equal(0))
+		Expect(bytes).To(BeZero())
+
+		appendAll(subject, "r0", "r1", "r2", "r3")
+		records, bytes, oldest := subject.Stats()
+		Expect(records).To(Equal(4))
+		Expect(bytes).To(Equal(int64(4 * 18)))
+		Expect(oldest).NotTo(BeZero())
+
+		_, cursor := read(subject, 3)
+		Expect(subject.Ack(cursor)).To(Succeed())
+		records, bytes, _ = subject.Stats()
+		Expect(records).To(Equal(1))
+		Expect(bytes).To(Equal(int64(18)))
+	})
+
+	It("signals appended records", func() {
+		Consistently(subject.Ready()).ShouldNot(Receive())
+		appendAll(subject, "r0")
+		Eventually(subject.Ready()).Should(Receive())
+	})
+
+	It("refuses records over the size cap", func() {
+		subject.Close()
+		subject = open(100, 60)
+
+		appendAll(subject, "r0", "r1", "r2", "r3", "r4")
+		Expect(subject.Append([]byte("r5"))).To(Equal(ErrFull))
+
+		_, cursor := read(subject, 3)
+		Expect(subject.Ack(cursor)).To(Succeed())
+		appendAll(subject, "r5")
+		data, _ := read(subject, 10)
+		Expect(data).To(Equal([]string{"r3", "r4", "r5"}))
+	})
+
+	It("resumes after the acknowledged records when reopened", func() {
+		appendAll(subject, "r0", "r1", "r2", "r3", "r4")
+		_, cursor := read(subject, 2)
+		Expect(subject.Ack(cursor)).To(Succeed())
+		Expect(subject.Close()).To(Succeed())
+
+		subject = open(1000, 60)
+		Eventually(subject.Ready()).Should(Receive())
+		records, _, _ := subject.Stats()
+		Expect(records).To(Equal(3))
+
+		appendAll(subject, "r5")
+		data, _ := read(subject, 10)
+		Expect(data).To(Equal([]string{"r2", "r3", "r4", "r5"}))
+	})
+
+	It("drops a record partially written before a crash", func() {
+		appendAll(subject, "r0", "r1")
+		Expect(subject.Close()).To(Succeed())
+
+		names := segments()
+		f, err := os.OpenFile(names[len(names)-1], os.O_WRONLY|os.O_APPEND, 0644)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = f.Write([]byte{0, 0, 0, 2, 1, 2, 3})
+		Expect(err).NotTo(HaveOccurred())
+		f.Close()
+
+		subject = open(1000, 60)
+		appendAll(subject, "r2")
+		data, _ := read(subject, 10)
+		Expect(data).To(Equal([]string{"r0", "r1", "r2"}))
+	})
+
+	It("rejects segments larger than the spool", func() {
+		_, err := Open(dir, 10, 60)
+		Expect(err).To(HaveOccurred())
+	})
+})
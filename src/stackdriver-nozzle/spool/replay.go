@@ -0,0 +1,140 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package spool
+
+import (
+	"context"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
+	"github.com/googleapis/gax-go"
+)
+
+// statsPeriod is how often the depth and age of an idle spool are refreshed.
+const statsPeriod = 10 * time.Second
+
+// replayBackoff is the backoff between attempts to deliver the same records.
+var replayBackoff = gax.Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2}
+
+// stats are the telemetry of the spool for one kind of data.
+type stats struct {
+	// Records and bytes waiting to be delivered, and the age in seconds
+	// of the oldest of them.
+	depth      *telemetry.Gauge
+	depthBytes *telemetry.Gauge
+	age        *telemetry.Gauge
+
+	// Records are a log, or a batch of metrics.
+	written  *telemetry.Counter
+	replayed *telemetry.Counter
+	retries  *telemetry.Counter
+	// Records that could not be spooled or decoded.
+	dropped *telemetry.Counter
+}
+
+var (
+	logStats    *stats
+	metricStats *stats
+)
+
+func init() {
+	logStats = newStats("logs")
+	metricStats = newStats("metrics")
+}
+
+func newStats(kind string) *stats {
+	prefix := "spool." + kind + "."
+	return &stats{
+		depth:      telemetry.NewGauge(telemetry.Nozzle, prefix+"depth"),
+		depthBytes: telemetry.NewGauge(telemetry.Nozzle, prefix+"depth_bytes"),
+		age:        telemetry.NewGauge(telemetry.Nozzle, prefix+"age"),
+		written:    telemetry.NewCounter(telemetry.Nozzle, prefix+"written"),
+		replayed:   telemetry.NewCounter(telemetry.Nozzle, prefix+"replayed"),
+		retries:    telemetry.NewCounter(telemetry.Nozzle, prefix+"retries"),
+		dropped:    telemetry.NewCounter(telemetry.Nozzle, prefix+"dropped"),
+	}
+}
+
+func (st *stats) update(q *Queue) {
+	records, bytes, oldest := q.Stats()
+	st.depth.Set(int64(records))
+	st.depthBytes.Set(bytes)
+	if records == 0 {
+		st.age.Set(0)
+	} else {
+		st.age.Set(int64(time.Since(oldest) / time.Second))
+	}
+}
+
+// replay delivers the records of q in order until ctx is done, up to batch
+// records at a time. Records are acknowledged once deliver succeeds; while it
+// fails, the same records are delivered again after a backoff.
+func replay(ctx context.Context, q *Queue, batch int, deliver func([]Record) error, st *stats, logger lager.Logger) {
+	ticker := time.NewTicker(statsPeriod)
+	defer ticker.Stop()
+
+	backoff := replayBackoff
+	pause := func() bool {
+		select {
+		case <-time.After(backoff.Pause()):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		st.update(q)
+		if ctx.Err() != nil {
+			return
+		}
+
+		records, cursor, err := q.Read(batch)
+		if err != nil {
+			logger.Error("spool.replay", err, lager.Data{"info": "Could not read from the spool"})
+			if !pause() {
+				return
+			}
+			continue
+		}
+		if len(records) == 0 {
+			select {
+			case <-q.Ready():
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		if err := deliver(records); err != nil {
+			st.retries.Increment()
+			logger.Error("spool.replay", err, lager.Data{"info": "Delivery failed, retrying", "records": len(records), "oldest": records[0].Time})
+			if !pause() {
+				return
+			}
+			continue
+		}
+		backoff = replayBackoff
+
+		st.replayed.Add(int64(len(records)))
+		if err := q.Ack(cursor); err != nil {
+			logger.Error("spool.replay", err, lager.Data{"info": "Could not acknowledge delivered records"})
+		}
+	}
+}
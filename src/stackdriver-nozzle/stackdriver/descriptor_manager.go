@@ -0,0 +1,280 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stackdriver
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
+	labelpb "google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// DescriptorPolicy is what a DescriptorManager does when an existing metric
+// descriptor does not match the metrics written to it.
+type DescriptorPolicy string
+
+const (
+	// DescriptorPolicyReport logs and counts mismatches, and leaves the
+	// descriptor alone. Points Stackdriver rejects because of them are lost.
+	DescriptorPolicyReport DescriptorPolicy = "report"
+	// DescriptorPolicyRecreate deletes the descriptor and creates one that
+	// matches. Deleting a descriptor deletes the data written to it.
+	DescriptorPolicyRecreate DescriptorPolicy = "recreate"
+)
+
+var (
+	descriptorMismatches *telemetry.CounterMap
+	descriptorRecreated  *telemetry.Counter
+)
+
+func init() {
+	descriptorMismatches = telemetry.NewCounterMap(telemetry.Nozzle, "metrics.descriptor.mismatches", "field")
+	descriptorRecreated = telemetry.NewCounter(telemetry.Nozzle, "metrics.descriptor.recreated")
+}
+
+// DescriptorManager keeps the custom metric descriptors of a project in line
+// with the metrics written to them. It lists the existing descriptors, keyed by
+// metric type, creates those that are missing, and applies its policy to
+// those that differ in labels, kind, value type or unit.
+//
+// Descriptors are listed again by Refresh, so that changes made outside the
+// nozzle are noticed.
+type DescriptorManager struct {
+	projectName string
+	client      MetricClient
+	policy      DescriptorPolicy
+	logger      lager.Logger
+
+	mu       sync.Mutex
+	existing map[string]*metricpb.MetricDescriptor
+	// checked holds the keys of the descriptors metrics need which have
+	// been compared to the existing ones since the last refresh.
+	checked map[string]struct{}
+}
+
+// NewDescriptorManager returns a DescriptorManager for the project. It knows no
+// descriptors until Refresh is called.
+func NewDescriptorManager(projectID string, client MetricClient, policy DescriptorPolicy, logger lager.Logger) *DescriptorManager {
+	return &DescriptorManager{
+		projectName: path.Join("projects", projectID),
+		client:      client,
+		policy:      policy,
+		logger:      logger,
+		existing:    map[string]*metricpb.MetricDescriptor{},
+		checked:     map[string]struct{}{},
+	}
+}
+
+// Refresh lists the custom metric descriptors of the project. Metrics are
+// compared to them again as they are next written.
+func (dm *DescriptorManager) Refresh() error {
+	req := &monitoringpb.ListMetricDescriptorsRequest{
+		Name:   dm.projectName,
+		Filter: `metric.type = starts_with("custom.googleapis.com/")`,
+	}
+
+	descriptors, err := dm.client.ListMetricDescriptors(req)
+	if err != nil {
+		return err
+	}
+
+	existing := map[string]*metricpb.MetricDescriptor{}
+	for _, descriptor := range descriptors {
+		existing[descriptor.Type] = descriptor
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.existing = existing
+	dm.checked = map[string]struct{}{}
+	return nil
+}
+
+// Start refreshes the descriptors every period until ctx is done.
+func (dm *DescriptorManager) Start(ctx context.Context, period time.Duration) {
+	if period <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := dm.Refresh(); err != nil {
+					dm.logger.Error("descriptorManager.Refresh", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Ensure makes sure metric can be written to its descriptor, creating it if
+// needed, and applies the policy if the existing descriptor differs. It
+// returns an error if a descriptor could not be created or recreated.
+func (dm *DescriptorManager) Ensure(metric *messages.Metric) error {
+	desired := metric.MetricDescriptor(dm.projectName)
+	key := descriptorKey(desired)
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if _, ok := dm.checked[key]; ok {
+		return nil
+	}
+
+	existing, ok := dm.existing[desired.Type]
+	if !ok {
+		if metric.NeedsMetricDescriptor() {
+			if err := dm.create(desired); err != nil {
+				return err
+			}
+		}
+		// Otherwise Stackdriver creates a descriptor when the metric is
+		// first written, which is listed at the next refresh.
+		dm.checked[key] = struct{}{}
+		return nil
+	}
+
+	mismatches := diffDescriptors(existing, desired, metric.NeedsMetricDescriptor())
+	if len(mismatches) == 0 {
+		dm.checked[key] = struct{}{}
+		return nil
+	}
+
+	var details []string
+	for _, m := range mismatches {
+		descriptorMismatches.MustCounter(m.field).Increment()
+		details = append(details, m.detail)
+	}
+	data := lager.Data{"metricType": desired.Type, "mismatches": details, "policy": dm.policy}
+
+	if dm.policy != DescriptorPolicyRecreate {
+		dm.logger.Error("descriptorManager.Ensure", fmt.Errorf("metric descriptor %s does not match its metrics", desired.Type), data)
+		dm.checked[key] = struct{}{}
+		return nil
+	}
+
+	dm.logger.Info("descriptorManager.Ensure", lager.Data{"info": "Recreating metric descriptor", "metricType": desired.Type, "mismatches": details})
+	// Keep the labels of the existing descriptor, which other metrics of
+	// the same type may use.
+	desired.Labels = mergeLabels(existing.Labels, desired.Labels)
+	if err := dm.client.DeleteMetricDescriptor(&monitoringpb.DeleteMetricDescriptorRequest{Name: existing.Name}); err != nil {
+		return err
+	}
+	delete(dm.existing, desired.Type)
+	if err := dm.create(desired); err != nil {
+		return err
+	}
+	descriptorRecreated.Increment()
+	dm.checked[key] = struct{}{}
+	return nil
+}
+
+func (dm *DescriptorManager) create(descriptor *metricpb.MetricDescriptor) error {
+	err := dm.client.CreateMetricDescriptor(&monitoringpb.CreateMetricDescriptorRequest{
+		Name:             dm.projectName,
+		MetricDescriptor: descriptor,
+	})
+	if err != nil {
+		return err
+	}
+	dm.existing[descriptor.Type] = descriptor
+	return nil
+}
+
+// descriptorKey identifies the fields of a descriptor that are compared.
+func descriptorKey(d *metricpb.MetricDescriptor) string {
+	return strings.Join([]string{d.Type, d.MetricKind.String(), d.ValueType.String(), d.Unit, strings.Join(labelKeys(d.Labels), ",")}, "|")
+}
+
+func labelKeys(labels []*labelpb.LabelDescriptor) []string {
+	var keys []string
+	for _, l := range labels {
+		keys = append(keys, l.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type descriptorMismatch struct {
+	// One of labels, metric_kind, value_type or unit.
+	field  string
+	detail string
+}
+
+// diffDescriptors returns how existing differs from desired, ignoring labels
+// desired does not have. Units and labels are only compared if the nozzle
+// creates desired: Stackdriver creates descriptors without units, which gain
+// labels as points are written.
+func diffDescriptors(existing, desired *metricpb.MetricDescriptor, created bool) []descriptorMismatch {
+	var mismatches []descriptorMismatch
+	if existing.MetricKind != desired.MetricKind {
+		mismatches = append(mismatches, descriptorMismatch{"metric_kind", fmt.Sprintf("metric kind is %s, want %s", existing.MetricKind, desired.MetricKind)})
+	}
+	if existing.ValueType != desired.ValueType {
+		mismatches = append(mismatches, descriptorMismatch{"value_type", fmt.Sprintf("value type is %s, want %s", existing.ValueType, desired.ValueType)})
+	}
+	if !created {
+		return mismatches
+	}
+	if existing.Unit != desired.Unit {
+		mismatches = append(mismatches, descriptorMismatch{"unit", fmt.Sprintf("unit is %q, want %q", existing.Unit, desired.Unit)})
+	}
+
+	have := map[string]bool{}
+	for _, l := range existing.Labels {
+		have[l.Key] = true
+	}
+	var missing []string
+	for _, key := range labelKeys(desired.Labels) {
+		if !have[key] {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		mismatches = append(mismatches, descriptorMismatch{"labels", fmt.Sprintf("labels %s are missing", strings.Join(missing, ", "))})
+	}
+	return mismatches
+}
+
+// mergeLabels returns the labels of a followed by those of b that a lacks.
+func mergeLabels(a, b []*labelpb.LabelDescriptor) []*labelpb.LabelDescriptor {
+	merged := append([]*labelpb.LabelDescriptor(nil), a...)
+	have := map[string]bool{}
+	for _, l := range a {
+		have[l.Key] = true
+	}
+	for _, l := range b {
+		if !have[l.Key] {
+			merged = append(merged, l)
+		}
+	}
+	return merged
+}
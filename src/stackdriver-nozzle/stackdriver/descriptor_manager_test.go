@@ -0,0 +1,204 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stackdriver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/mocks"
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	labelpb "google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+var _ = Describe("DescriptorManager", func() {
+	var (
+		client   *mocks.MockClient
+		logger   *mocks.MockLogger
+		existing []*metricpb.MetricDescriptor
+		lists    int
+	)
+
+	counter := &messages.Metric{
+		Name:   "requests",
+		Labels: map[string]string{"job": "router", "index": "0"},
+		Unit:   "1",
+		Type:   events.Envelope_CounterEvent,
+	}
+
+	newManager := func(policy DescriptorPolicy) *DescriptorManager {
+		dm := NewDescriptorManager("my-project", client, policy, logger)
+		Expect(dm.Refresh()).To(Succeed())
+		return dm
+	}
+
+	errorLogs := func() []mocks.Log {
+		var errs []mocks.Log
+		for _, log := range logger.Logs() {
+			if log.Level == lager.ERROR {
+				errs = append(errs, log)
+			}
+		}
+		return errs
+	}
+
+	BeforeEach(func() {
+		descriptorMismatches.MustCounter("metric_kind").Set(0)
+		descriptorMismatches.MustCounter("labels").Set(0)
+		descriptorRecreated.Set(0)
+
+		client = &mocks.MockClient{}
+		logger = &mocks.MockLogger{}
+		existing = nil
+		lists = 0
+		client.ListMetricDescriptorFn = func(req *monitoringpb.ListMetricDescriptorsRequest) ([]*metricpb.MetricDescriptor, error) {
+			client.Mutex.Lock()
+			defer client.Mutex.Unlock()
+			lists++
+			return existing, nil
+		}
+	})
+
+	It("creates missing descriptors once", func() {
+		subject := newManager(DescriptorPolicyReport)
+
+		Expect(subject.Ensure(counter)).To(Succeed())
+		Expect(subject.Ensure(counter)).To(Succeed())
+
+		Expect(client.DescriptorReqs).To(HaveLen(1))
+		Expect(client.DescriptorReqs[0].MetricDescriptor.Type).To(Equal("custom.googleapis.com/requests"))
+	})
+
+	It("finds existing descriptors by metric type", func() {
+		existing = []*metricpb.MetricDescriptor{counter.MetricDescriptor("projects/my-project")}
+		subject := newManager(DescriptorPolicyReport)
+
+		Expect(subject.Ensure(counter)).To(Succeed())
+
+		Expect(client.DescriptorReqs).To(BeEmpty())
+		Expect(errorLogs()).To(BeEmpty())
+	})
+
+	It("leaves metrics without units to Stackdriver", func() {
+		subject := newManager(DescriptorPolicyReport)
+
+		Expect(subject.Ensure(&messages.Metric{Name: "gauge"})).To(Succeed())
+
+		Expect(client.DescriptorReqs).To(BeEmpty())
+	})
+
+	It("returns errors creating descriptors, and tries again", func() {
+		client.CreateMetricDescriptorFn = func(req *monitoringpb.CreateMetricDescriptorRequest) error {
+			return errors.New("fail")
+		}
+		subject := newManager(DescriptorPolicyReport)
+
+		Expect(subject.Ensure(counter)).To(MatchError("fail"))
+		client.CreateMetricDescriptorFn = nil
+		Expect(subject.Ensure(counter)).To(Succeed())
+		Expect(client.DescriptorReqs).To(HaveLen(1))
+	})
+
+	Context("with a mismatched descriptor", func() {
+		BeforeEach(func() {
+			descriptor := counter.MetricDescriptor("projects/my-project")
+			descriptor.MetricKind = metricpb.MetricDescriptor_GAUGE
+			descriptor.Labels = []*labelpb.LabelDescriptor{{Key: "job"}, {Key: "origin"}}
+			existing = []*metricpb.MetricDescriptor{descriptor}
+		})
+
+		It("reports the mismatch once", func() {
+			subject := newManager(DescriptorPolicyReport)
+
+			Expect(subject.Ensure(counter)).To(Succeed())
+			Expect(subject.Ensure(counter)).To(Succeed())
+
+			Expect(client.DescriptorReqs).To(BeEmpty())
+			Expect(client.DeleteReqs).To(BeEmpty())
+			Expect(descriptorMismatches.MustCounter("metric_kind").IntValue()).To(Equal(1))
+			Expect(descriptorMismatches.MustCounter("labels").IntValue()).To(Equal(1))
+			errs := errorLogs()
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Datas[0]["mismatches"]).To(ConsistOf(
+				"metric kind is GAUGE, want CUMULATIVE",
+				"labels index are missing",
+			))
+		})
+
+		It("recreates the descriptor, keeping its labels", func() {
+			subject := newManager(DescriptorPolicyRecreate)
+
+			Expect(subject.Ensure(counter)).To(Succeed())
+			Expect(subject.Ensure(counter)).To(Succeed())
+
+			Expect(client.DeleteReqs).To(HaveLen(1))
+			Expect(client.DeleteReqs[0].Name).To(Equal("projects/my-project/metricDescriptors/custom.googleapis.com/requests"))
+			Expect(client.DescriptorReqs).To(HaveLen(1))
+			recreated := client.DescriptorReqs[0].MetricDescriptor
+			Expect(recreated.MetricKind).To(Equal(metricpb.MetricDescriptor_CUMULATIVE))
+			Expect(labelKeys(recreated.Labels)).To(Equal([]string{"index", "job", "origin"}))
+			Expect(descriptorRecreated.IntValue()).To(Equal(1))
+		})
+
+		It("ignores labels and units of descriptors Stackdriver created", func() {
+			gauge := &messages.Metric{Name: "requests", Labels: map[string]string{"index": "0"}}
+			existing[0].ValueType = metricpb.MetricDescriptor_DOUBLE
+			existing[0].Unit = ""
+			subject := newManager(DescriptorPolicyReport)
+
+			Expect(subject.Ensure(gauge)).To(Succeed())
+
+			Expect(errorLogs()).To(BeEmpty())
+		})
+	})
+
+	It("compares metrics again after a refresh", func() {
+		subject := newManager(DescriptorPolicyReport)
+		Expect(subject.Ensure(counter)).To(Succeed())
+
+		descriptor := counter.MetricDescriptor("projects/my-project")
+		descriptor.ValueType = metricpb.MetricDescriptor_DOUBLE
+		existing = []*metricpb.MetricDescriptor{descriptor}
+		Expect(subject.Refresh()).To(Succeed())
+		Expect(subject.Ensure(counter)).To(Succeed())
+
+		Expect(errorLogs()).To(HaveLen(1))
+	})
+
+	It("refreshes periodically until stopped", func() {
+		subject := newManager(DescriptorPolicyReport)
+		ctx, cancel := context.WithCancel(context.Background())
+		subject.Start(ctx, 10*time.Millisecond)
+
+		count := func() int {
+			client.Mutex.Lock()
+			defer client.Mutex.Unlock()
+			return lists
+		}
+		Eventually(count).Should(BeNumerically(">", 2))
+		cancel()
+		time.Sleep(20 * time.Millisecond)
+		Consistently(count, 50*time.Millisecond).Should(Equal(count()))
+	})
+})
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stackdriver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	mrpb "google.golang.org/genproto/googleapis/api/monitoredres"
+)
+
+// DryRunAdapter is a LogAdapter and MetricAdapter that writes what would be
+// sent to Stackdriver as newline-delimited JSON instead of sending it. Each
+// line holds one object with a single key:
+//
+//   - "logEntry": a LogEntry, in the JSON form of the Logging API
+//   - "metricDescriptor": a MetricDescriptor the nozzle would create, written
+//     the first time a metric needing one is seen
+//   - "timeSeries": a TimeSeries, in the JSON form of the Monitoring API
+type DryRunAdapter struct {
+	projectName string
+	logName     string
+	resource    json.RawMessage
+	logger      lager.Logger
+	marshaler   jsonpb.Marshaler
+
+	mu          sync.Mutex // protects `w` and `descriptors`
+	w           io.Writer
+	descriptors map[string]struct{}
+}
+
+// NewDryRunAdapter creates a DryRunAdapter writing to w, with resource names
+// in the given project.
+func NewDryRunAdapter(w io.Writer, projectID string, logger lager.Logger) *DryRunAdapter {
+	a := &DryRunAdapter{
+		projectName: path.Join("projects", projectID),
+		logName:     path.Join("projects", projectID, "logs", logID),
+		logger:      logger,
+		w:           w,
+		descriptors: map[string]struct{}{},
+	}
+	// Same resource as the logAdapter.
+	a.resource = a.protoJSON(&mrpb.MonitoredResource{
+		Type:   "global",
+		Labels: map[string]string{"project_id": projectID},
+	})
+	return a
+}
+
+type dryRunLogEntry struct {
+	LogName     string            `json:"logName"`
+	Resource    json.RawMessage   `json:"resource"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Severity    string            `json:"severity"`
+	JSONPayload interface{}       `json:"jsonPayload"`
+}
+
+// PostLog writes the LogEntry for log.
+func (a *DryRunAdapter) PostLog(log *messages.Log) {
+	logsCount.Increment()
+	a.write("logEntry", &dryRunLogEntry{
+		LogName:     a.logName,
+		Resource:    a.resource,
+		Labels:      log.Labels,
+		Severity:    strings.ToUpper(log.Severity.String()),
+		JSONPayload: log.Payload,
+	})
+}
+
+// Flush does nothing, as entries are written as they are posted.
+func (a *DryRunAdapter) Flush() error {
+	return nil
+}
+
+// PostMetrics writes the TimeSeries for metrics, preceded by any
+// MetricDescriptors that would be created for them.
+func (a *DryRunAdapter) PostMetrics(metrics []*messages.Metric) {
+	for _, metric := range metrics {
+		if metric.NeedsMetricDescriptor() && a.newDescriptor(metric.Name) {
+			a.write("metricDescriptor", a.protoJSON(metric.MetricDescriptor(a.projectName)))
+		}
+		timeSeriesCount.Increment()
+		a.write("timeSeries", a.protoJSON(metric.TimeSeries()))
+	}
+}
+
+func (a *DryRunAdapter) newDescriptor(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.descriptors[name]; ok {
+		return false
+	}
+	a.descriptors[name] = struct{}{}
+	return true
+}
+
+func (a *DryRunAdapter) protoJSON(pb proto.Message) json.RawMessage {
+	var buf bytes.Buffer
+	if err := a.marshaler.Marshal(&buf, pb); err != nil {
+		a.logger.Error("dryRunAdapter.protoJSON", err)
+		return json.RawMessage("null")
+	}
+	return buf.Bytes()
+}
+
+func (a *DryRunAdapter) write(kind string, v interface{}) {
+	line, err := json.Marshal(map[string]interface{}{kind: v})
+	if err != nil {
+		a.logger.Error("dryRunAdapter.write", err, lager.Data{"kind": kind})
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		a.logger.Error("dryRunAdapter.write", err, lager.Data{"kind": kind})
+	}
+}
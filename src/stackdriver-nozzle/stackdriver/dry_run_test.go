@@ -0,0 +1,95 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stackdriver
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/mocks"
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DryRunAdapter", func() {
+	var (
+		out     *bytes.Buffer
+		subject *DryRunAdapter
+	)
+
+	lines := func() []map[string]map[string]interface{} {
+		var result []map[string]map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var v map[string]map[string]interface{}
+			Expect(json.Unmarshal([]byte(line), &v)).To(Succeed())
+			result = append(result, v)
+		}
+		return result
+	}
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		subject = NewDryRunAdapter(out, "my-project", &mocks.MockLogger{})
+	})
+
+	It("writes log entries", func() {
+		subject.PostLog(&messages.Log{
+			Payload:  map[string]interface{}{"message": "hello"},
+			Labels:   map[string]string{"job": "router"},
+			Severity: logging.Error,
+		})
+		Expect(subject.Flush()).To(Succeed())
+
+		Expect(lines()).To(Equal([]map[string]map[string]interface{}{{
+			"logEntry": {
+				"logName":     "projects/my-project/logs/cf_logs",
+				"resource":    map[string]interface{}{"type": "global", "labels": map[string]interface{}{"project_id": "my-project"}},
+				"labels":      map[string]interface{}{"job": "router"},
+				"severity":    "ERROR",
+				"jsonPayload": map[string]interface{}{"message": "hello"},
+			},
+		}}))
+	})
+
+	It("writes time series, and descriptors the first time they are needed", func() {
+		eventTime := time.Unix(1500000000, 0)
+		counter := &messages.Metric{Name: "firehose/requests", IntValue: 3, Labels: map[string]string{"job": "router"}, EventTime: eventTime, StartTime: eventTime.Add(-time.Minute), Type: events.Envelope_CounterEvent}
+		gauge := &messages.Metric{Name: "firehose/latency", Value: 1.5, EventTime: eventTime, StartTime: eventTime, Type: events.Envelope_ValueMetric}
+		subject.PostMetrics([]*messages.Metric{counter, gauge})
+		subject.PostMetrics([]*messages.Metric{counter})
+
+		written := lines()
+		Expect(written).To(HaveLen(4))
+
+		Expect(written[0]).To(HaveKey("metricDescriptor"))
+		Expect(written[0]["metricDescriptor"]).To(HaveKeyWithValue("type", "custom.googleapis.com/firehose/requests"))
+		Expect(written[0]["metricDescriptor"]).To(HaveKeyWithValue("metricKind", "CUMULATIVE"))
+
+		Expect(written[1]).To(HaveKey("timeSeries"))
+		Expect(written[1]["timeSeries"]).To(HaveKeyWithValue("metric", map[string]interface{}{
+			"type":   "custom.googleapis.com/firehose/requests",
+			"labels": map[string]interface{}{"job": "router"},
+		}))
+		Expect(written[2]["timeSeries"]["metric"]).To(HaveKeyWithValue("type", "custom.googleapis.com/firehose/latency"))
+		Expect(written[3]).To(HaveKey("timeSeries"))
+	})
+})
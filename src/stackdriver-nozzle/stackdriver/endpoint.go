@@ -0,0 +1,43 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stackdriver
+
+import (
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// Endpoint is where a Stackdriver API client connects. The zero value is the
+// public Stackdriver API.
+type Endpoint struct {
+	// Address (host:port) replaces the API's default address if set.
+	Address string
+	// Insecure connects without TLS and credentials, e.g. to a local
+	// fakestackdriver server.
+	Insecure bool
+}
+
+func (e Endpoint) clientOptions() []option.ClientOption {
+	var opts []option.ClientOption
+	if e.Address != "" {
+		opts = append(opts, option.WithEndpoint(e.Address))
+	}
+	if e.Insecure {
+		opts = append(opts, option.WithoutAuthentication(), option.WithGRPCDialOption(grpc.WithInsecure()))
+	}
+	return opts
+}
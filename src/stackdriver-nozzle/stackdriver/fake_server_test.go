@@ -0,0 +1,222 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stackdriver
+
+import (
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/fakestackdriver"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/mocks"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/googleapis/gax-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+var _ = DescribeTable("parseTimeSeriesErrors", func(message string, expected TimeSeriesErrors) {
+	Expect(parseTimeSeriesErrors(message)).To(Equal(expected))
+},
+	Entry("a single time series",
+		"One or more TimeSeries could not be written: Points must be written in order.: timeSeries[3]",
+		TimeSeriesErrors{{Index: 3, Reason: "Points must be written in order."}}),
+	Entry("ranges and several reasons",
+		"One or more TimeSeries could not be written: Unrecognized metric label.: timeSeries[0-1,4]; Field timeSeries[2].points[0] had an invalid value: timeSeries[2]",
+		TimeSeriesErrors{
+			{Index: 0, Reason: "Unrecognized metric label."},
+			{Index: 1, Reason: "Unrecognized metric label."},
+			{Index: 4, Reason: "Unrecognized metric label."},
+			{Index: 2, Reason: "Field timeSeries[2].points[0] had an invalid value"},
+		}),
+	Entry("other messages", "Request contains an invalid argument.", nil),
+	Entry("malformed indices", "One or more TimeSeries could not be written: reason: timeSeries[3-1]", nil),
+)
+
+var _ = Describe("Stackdriver clients against a fake server", func() {
+	var (
+		server   *fakestackdriver.Server
+		endpoint Endpoint
+	)
+
+	BeforeEach(func() {
+		var err error
+		server, err = fakestackdriver.NewServer()
+		Expect(err).NotTo(HaveOccurred())
+		endpoint = Endpoint{Address: server.Addr(), Insecure: true}
+	})
+
+	AfterEach(func() {
+		server.Stop()
+	})
+
+	Context("MetricAdapter", func() {
+		var (
+			client  MetricClient
+			subject MetricAdapter
+			logger  *mocks.MockLogger
+		)
+
+		BeforeEach(func() {
+			var err error
+			client, err = NewMetricClient(endpoint, time.Second)
+			Expect(err).NotTo(HaveOccurred())
+			client.(*metricClient).backoff = gax.Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond}
+			logger = &mocks.MockLogger{}
+			descriptors := NewDescriptorManager("my-project", client, DescriptorPolicyReport, logger)
+			Expect(descriptors.Refresh()).To(Succeed())
+			subject = NewMetricAdapter("my-project", client, descriptors, batchSize, 4, 0, 0, logger)
+		})
+
+		It("creates descriptors and writes time series in batches", func() {
+			eventTime := time.Now()
+			var metrics []*messages.Metric
+			for i := 0; i < batchSize+1; i++ {
+				metrics = append(metrics, &messages.Metric{
+					Name:      "firehose/requests",
+					Labels:    map[string]string{"index": fmt.Sprint(i)},
+					IntValue:  int64(i),
+					EventTime: eventTime,
+					StartTime: eventTime.Add(-time.Minute),
+					Type:      events.Envelope_CounterEvent,
+					Unit:      "1",
+				})
+			}
+			subject.PostMetrics(metrics)
+
+			Expect(server.Requests(fakestackdriver.CreateMetricDescriptor)).To(Equal(1))
+			Expect(server.Requests(fakestackdriver.CreateTimeSeries)).To(Equal(2))
+			Expect(server.TimeSeries()).To(HaveLen(batchSize + 1))
+
+			descriptors := server.MetricDescriptors()
+			Expect(descriptors).To(HaveLen(1))
+			Expect(descriptors[0].Type).To(Equal("custom.googleapis.com/firehose/requests"))
+			Expect(descriptors[0].MetricKind).To(Equal(metricpb.MetricDescriptor_CUMULATIVE))
+			Expect(descriptors[0].Unit).To(Equal("1"))
+		})
+
+		It("absorbs out of order errors", func() {
+			timeSeriesErrOutOfOrder.Set(0)
+			metric := &messages.Metric{Name: "gauge", Value: 1, EventTime: time.Now()}
+			subject.PostMetrics([]*messages.Metric{metric})
+			subject.PostMetrics([]*messages.Metric{metric})
+
+			Expect(server.Requests(fakestackdriver.CreateTimeSeries)).To(Equal(2))
+			Expect(timeSeriesErrOutOfOrder.IntValue()).To(Equal(1))
+			for _, log := range logger.Logs() {
+				Expect(log.Level).NotTo(Equal(lager.ERROR))
+			}
+		})
+
+		Context("errors", func() {
+			var request *monitoringpb.CreateTimeSeriesRequest
+
+			BeforeEach(func() {
+				timeSeriesErrUnknown.Set(0)
+				timeSeriesErrOutOfOrder.Set(0)
+				timeSeriesRetries.Set(0)
+				timeSeriesInvalid.Set(0)
+				request = &monitoringpb.CreateTimeSeriesRequest{
+					Name:       "projects/my-project",
+					TimeSeries: []*monitoringpb.TimeSeries{(&messages.Metric{Name: "gauge", EventTime: time.Now()}).TimeSeries()},
+				}
+			})
+
+			It("retries while Stackdriver is unavailable or out of quota", func() {
+				unavailable := timeSeriesErrsByCode.MustCounter("Unavailable")
+				unavailable.Set(0)
+				server.FailNext(fakestackdriver.CreateTimeSeries, fakestackdriver.ErrUnavailable, 2)
+				server.FailNext(fakestackdriver.CreateTimeSeries, fakestackdriver.ErrQuotaExceeded, 1)
+
+				Expect(client.Post(request)).To(Succeed())
+				Expect(server.Requests(fakestackdriver.CreateTimeSeries)).To(Equal(4))
+				Expect(server.TimeSeries()).To(HaveLen(1))
+				Expect(timeSeriesRetries.IntValue()).To(Equal(3))
+				Expect(unavailable.IntValue()).To(Equal(2))
+			})
+
+			It("gives up after the retry timeout", func() {
+				server.FailNext(fakestackdriver.CreateTimeSeries, fakestackdriver.ErrQuotaExceeded, 1000)
+
+				start := time.Now()
+				err := client.Post(request)
+				Expect(err).To(MatchError(ContainSubstring("Quota exceeded")))
+				Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+				Expect(timeSeriesErrUnknown.IntValue()).To(Equal(1))
+			})
+
+			It("does not retry invalid requests", func() {
+				server.FailNext(fakestackdriver.CreateTimeSeries, fakestackdriver.ErrInvalidArgument, 1)
+
+				Expect(client.Post(request)).NotTo(Succeed())
+				Expect(server.Requests(fakestackdriver.CreateTimeSeries)).To(Equal(1))
+				Expect(timeSeriesErrUnknown.IntValue()).To(Equal(1))
+			})
+
+			It("reports the rejected time series of a request", func() {
+				eventTime := time.Now()
+				Expect(client.Post(&monitoringpb.CreateTimeSeriesRequest{
+					Name:       "projects/my-project",
+					TimeSeries: []*monitoringpb.TimeSeries{(&messages.Metric{Name: "a", EventTime: eventTime}).TimeSeries()},
+				})).To(Succeed())
+
+				wrongType := &messages.Metric{Name: "a", IntValue: 1, EventTime: eventTime, StartTime: eventTime.Add(-time.Second), Type: events.Envelope_CounterEvent}
+				err := client.Post(&monitoringpb.CreateTimeSeriesRequest{
+					Name: "projects/my-project",
+					TimeSeries: []*monitoringpb.TimeSeries{
+						(&messages.Metric{Name: "a", EventTime: eventTime}).TimeSeries(),
+						(&messages.Metric{Name: "b", EventTime: eventTime}).TimeSeries(),
+						wrongType.TimeSeries(),
+					},
+				})
+
+				Expect(err).To(BeAssignableToTypeOf(TimeSeriesErrors{}))
+				errs := err.(TimeSeriesErrors)
+				Expect(errs).To(HaveLen(1))
+				Expect(errs[0].Index).To(Equal(2))
+				Expect(server.TimeSeries()).To(HaveLen(2))
+				Expect(timeSeriesErrOutOfOrder.IntValue()).To(Equal(1))
+				Expect(timeSeriesInvalid.IntValue()).To(Equal(1))
+			})
+		})
+	})
+
+	It("writes logs through the LogAdapter", func() {
+		subject, errs := NewLogAdapter("my-project", endpoint, 10, time.Hour, 1)
+		Expect(subject).NotTo(BeNil())
+
+		subject.PostLog(&messages.Log{
+			Payload:  map[string]interface{}{"message": "hello"},
+			Labels:   map[string]string{"job": "router"},
+			Severity: logging.Error,
+		})
+		Expect(subject.Flush()).To(Succeed())
+		Consistently(errs).ShouldNot(Receive())
+
+		entries := server.LogEntries()
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].LogName).To(Equal("projects/my-project/logs/cf_logs"))
+		Expect(entries[0].Labels).To(Equal(map[string]string{"job": "router"}))
+		Expect(entries[0].Severity.String()).To(Equal("ERROR"))
+		Expect(entries[0].GetJsonPayload().Fields["message"].GetStringValue()).To(Equal("hello"))
+	})
+})
@@ -46,9 +46,10 @@ type LogAdapter interface {
 }
 
 // NewLogAdapter returns a LogAdapter that can post to Stackdriver Logging.
-func NewLogAdapter(projectID string, batchCount int, batchDuration time.Duration, inFlight int) (LogAdapter, <-chan error) {
+func NewLogAdapter(projectID string, endpoint Endpoint, batchCount int, batchDuration time.Duration, inFlight int) (LogAdapter, <-chan error) {
 	errs := make(chan error)
-	loggingClient, err := logging.NewClient(context.Background(), projectID, option.WithUserAgent(version.UserAgent()))
+	opts := append([]option.ClientOption{option.WithUserAgent(version.UserAgent())}, endpoint.clientOptions()...)
+	loggingClient, err := logging.NewClient(context.Background(), projectID, opts...)
 	if err != nil {
 		go func() { errs <- err }()
 		return nil, errs
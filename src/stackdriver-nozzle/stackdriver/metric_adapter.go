@@ -17,10 +17,11 @@
 package stackdriver
 
 import (
-	"fmt"
-	"math"
+	"errors"
+	"hash/fnv"
 	"path"
 	"sync"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
@@ -32,75 +33,185 @@ type MetricAdapter interface {
 	PostMetrics([]*messages.Metric)
 }
 
+// A MetricWriter is a MetricAdapter that reports whether metrics could be
+// delivered, so that they can be written again later.
+type MetricWriter interface {
+	MetricAdapter
+	// WriteMetrics is PostMetrics returning an error if some metrics were
+	// not written because of a transient failure (see IsRetryable). Other
+	// failures are logged, and those metrics dropped.
+	WriteMetrics([]*messages.Metric) error
+}
+
 var (
 	timeSeriesCount *telemetry.Counter
+
+	postMetricsCount        *telemetry.Counter
+	postMetricsDuration     *telemetry.Counter
+	postMetricsLastDuration *telemetry.Gauge
 )
 
 func init() {
 	timeSeriesCount = telemetry.NewCounter(telemetry.Nozzle, "metrics.timeseries.count")
+
+	postMetricsCount = telemetry.NewCounter(telemetry.Nozzle, "metrics.post.count")
+	postMetricsDuration = telemetry.NewCounter(telemetry.Nozzle, "metrics.post.duration_ms")
+	postMetricsLastDuration = telemetry.NewGauge(telemetry.Nozzle, "metrics.post.last_duration_ms")
 }
 
 type metricAdapter struct {
-	projectID             string
-	client                MetricClient
-	descriptors           map[string]struct{}
-	createDescriptorMutex *sync.Mutex
-	batchSize             int
-	logger                lager.Logger
+	projectID   string
+	client      MetricClient
+	descriptors *DescriptorManager
+	batchSize   int
+	inFlight    int
+	tracker     *seriesTracker
+	limiter     *requestLimiter
+	logger      lager.Logger
 }
 
-// NewMetricAdapter returns a MetricAdapater that can write to Stackdriver Monitoring
-func NewMetricAdapter(projectID string, client MetricClient, batchSize int, logger lager.Logger) (MetricAdapter, error) {
-	ma := &metricAdapter{
-		projectID:             projectID,
-		client:                client,
-		createDescriptorMutex: &sync.Mutex{},
-		descriptors:           map[string]struct{}{},
-		batchSize:             batchSize,
-		logger:                logger,
+// NewMetricAdapter returns a MetricAdapater that can write to Stackdriver Monitoring,
+// with up to inFlight CreateTimeSeries requests of batchSize time series at once.
+// The descriptors of the metrics are kept in line by descriptors. Points of a
+// time series written less than minPointInterval apart are held back, and
+// requests are limited to requestsPerSecond, if positive.
+func NewMetricAdapter(projectID string, client MetricClient, descriptors *DescriptorManager, batchSize, inFlight int, minPointInterval time.Duration, requestsPerSecond int, logger lager.Logger) MetricAdapter {
+	if inFlight < 1 {
+		inFlight = 1
+	}
+	return &metricAdapter{
+		projectID:   projectID,
+		client:      client,
+		descriptors: descriptors,
+		batchSize:   batchSize,
+		inFlight:    inFlight,
+		tracker:     newSeriesTracker(minPointInterval),
+		limiter:     newRequestLimiter(requestsPerSecond),
+		logger:      logger,
 	}
-
-	err := ma.fetchMetricDescriptorNames()
-	return ma, err
 }
 
 func (ma *metricAdapter) PostMetrics(metrics []*messages.Metric) {
-	series := ma.buildTimeSeries(metrics)
+	ma.WriteMetrics(metrics)
+}
+
+func (ma *metricAdapter) WriteMetrics(metrics []*messages.Metric) error {
+	start := time.Now()
+	series, retryErr := ma.buildTimeSeries(metrics)
+	series = ma.tracker.admit(series)
+	lanes := ma.lanes(series)
+
+	ma.logger.Info("metricAdapter.PostMetrics", lager.Data{"info": "Posting TimeSeries to Stackdriver", "count": len(series), "lanes": len(lanes)})
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, lane := range lanes {
+		wg.Add(1)
+		go func(lane []*monitoring.TimeSeries) {
+			defer wg.Done()
+			if err := ma.postLane(lane); err != nil {
+				mu.Lock()
+				retryErr = err
+				mu.Unlock()
+			}
+		}(lane)
+	}
+	wg.Wait()
+
+	elapsed := int64(time.Since(start) / time.Millisecond)
+	postMetricsCount.Increment()
+	postMetricsDuration.Add(elapsed)
+	postMetricsLastDuration.Set(elapsed)
+	return retryErr
+}
+
+// lanes splits series into as many lanes as there are requests to make, up to
+// inFlight. All the points of a time series are in the same lane, in order,
+// so they are written in order when the lanes are posted concurrently.
+func (ma *metricAdapter) lanes(series []*monitoring.TimeSeries) [][]*monitoring.TimeSeries {
+	n := (len(series) + ma.batchSize - 1) / ma.batchSize
+	if n > ma.inFlight {
+		n = ma.inFlight
+	}
+	if n <= 1 {
+		if len(series) == 0 {
+			return nil
+		}
+		return [][]*monitoring.TimeSeries{series}
+	}
+
+	lanes := make([][]*monitoring.TimeSeries, n)
+	for _, s := range series {
+		h := fnv.New32a()
+		h.Write([]byte(seriesKey(s)))
+		i := h.Sum32() % uint32(n)
+		lanes[i] = append(lanes[i], s)
+	}
+	return lanes
+}
+
+// postLane posts series in requests of up to batchSize time series, one after
+// another. It returns the last transient error.
+func (ma *metricAdapter) postLane(series []*monitoring.TimeSeries) error {
 	projectName := path.Join("projects", ma.projectID)
 
-	count := len(series)
-	chunks := int(math.Ceil(float64(count) / float64(ma.batchSize)))
-
-	ma.logger.Info("metricAdapter.PostMetrics", lager.Data{"info": "Posting TimeSeries to Stackdriver", "count": count, "chunks": chunks})
-	var low, high int
-	for i := 0; i < chunks; i++ {
-		low = i * ma.batchSize
-		high = low + ma.batchSize
-		// if we're at the last chunk, take the remaining size
-		// so we don't over index
-		if i == chunks-1 {
-			high = count
+	var retryErr error
+	for low := 0; low < len(series); low += ma.batchSize {
+		high := low + ma.batchSize
+		if high > len(series) {
+			high = len(series)
 		}
 
+		ma.limiter.wait()
 		timeSeriesReqs.Increment()
 		request := &monitoring.CreateTimeSeriesRequest{
 			Name:       projectName,
 			TimeSeries: series[low:high],
 		}
 
-		if err := ma.client.Post(request); err != nil {
+		err := ma.client.Post(request)
+		if err == nil {
+			ma.tracker.written(request.TimeSeries)
+		} else if errs, ok := err.(TimeSeriesErrors); ok {
+			// Only the rejected time series are lost.
+			rejected := map[int]bool{}
+			for _, e := range errs {
+				rejected[e.Index] = true
+				data := lager.Data{"info": "Rejected TimeSeries", "reason": e.Reason}
+				if e.Index < len(request.TimeSeries) {
+					data["timeSeries"] = request.TimeSeries[e.Index]
+				}
+				ma.logger.Error("metricAdapter.PostMetrics", errors.New(e.Reason), data)
+			}
+			var accepted []*monitoring.TimeSeries
+			for i, ts := range request.TimeSeries {
+				if !rejected[i] {
+					accepted = append(accepted, ts)
+				}
+			}
+			ma.tracker.written(accepted)
+		} else if err != nil {
 			ma.logger.Error("metricAdapter.PostMetrics", err, lager.Data{"info": "Unexpected Error", "request": request})
+			if IsRetryable(err) {
+				retryErr = err
+			}
 		}
 	}
+	return retryErr
 }
 
-func (ma *metricAdapter) buildTimeSeries(metrics []*messages.Metric) []*monitoring.TimeSeries {
+// buildTimeSeries returns the time series of metrics that have a metric
+// descriptor, and the last transient error creating a descriptor.
+func (ma *metricAdapter) buildTimeSeries(metrics []*messages.Metric) ([]*monitoring.TimeSeries, error) {
 	var timeSerieses []*monitoring.TimeSeries
+	var retryErr error
 
 	for _, metric := range metrics {
-		err := ma.ensureMetricDescriptor(metric)
+		err := ma.descriptors.Ensure(metric)
 		if err != nil {
 			ma.logger.Error("metricAdapter.buildTimeSeries", err, lager.Data{"metric": metric})
+			if IsRetryable(err) {
+				retryErr = err
+			}
 			continue
 		}
 
@@ -108,53 +219,5 @@ func (ma *metricAdapter) buildTimeSeries(metrics []*messages.Metric) []*monitori
 		timeSerieses = append(timeSerieses, metric.TimeSeries())
 	}
 
-	return timeSerieses
-}
-
-func (ma *metricAdapter) CreateMetricDescriptor(metric *messages.Metric) error {
-	projectName := path.Join("projects", ma.projectID)
-
-	req := &monitoring.CreateMetricDescriptorRequest{
-		Name:             projectName,
-		MetricDescriptor: metric.MetricDescriptor(projectName),
-	}
-
-	return ma.client.CreateMetricDescriptor(req)
-}
-
-func (ma *metricAdapter) fetchMetricDescriptorNames() error {
-	req := &monitoring.ListMetricDescriptorsRequest{
-		Name:   fmt.Sprintf("projects/%s", ma.projectID),
-		Filter: `metric.type = starts_with("custom.googleapis.com/")`,
-	}
-
-	descriptors, err := ma.client.ListMetricDescriptors(req)
-	if err != nil {
-		return err
-	}
-
-	for _, descriptor := range descriptors {
-		ma.descriptors[descriptor.Name] = struct{}{}
-	}
-	return nil
-}
-
-func (ma *metricAdapter) ensureMetricDescriptor(metric *messages.Metric) error {
-	if !metric.NeedsMetricDescriptor() {
-		return nil
-	}
-
-	ma.createDescriptorMutex.Lock()
-	defer ma.createDescriptorMutex.Unlock()
-
-	if _, ok := ma.descriptors[metric.Name]; ok {
-		return nil
-	}
-
-	err := ma.CreateMetricDescriptor(metric)
-	if err != nil {
-		return err
-	}
-	ma.descriptors[metric.Name] = struct{}{}
-	return nil
+	return timeSerieses, retryErr
 }
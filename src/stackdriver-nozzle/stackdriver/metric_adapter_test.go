@@ -22,6 +22,7 @@ import (
 	"sync"
 	"time"
 
+	"code.cloudfoundry.org/lager"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/mocks"
 	"github.com/cloudfoundry/sonde-go/events"
@@ -31,6 +32,8 @@ import (
 	labelpb "google.golang.org/genproto/googleapis/api/label"
 	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const batchSize = 200
@@ -47,7 +50,9 @@ var _ = Describe("MetricAdapter", func() {
 
 		client = &mocks.MockClient{}
 		logger = &mocks.MockLogger{}
-		subject, _ = NewMetricAdapter("my-awesome-project", client, batchSize, logger)
+		descriptors := NewDescriptorManager("my-awesome-project", client, DescriptorPolicyReport, logger)
+		Expect(descriptors.Refresh()).To(Succeed())
+		subject = NewMetricAdapter("my-awesome-project", client, descriptors, batchSize, 1, 0, 0, logger)
 	})
 
 	It("takes metrics and posts a time series", func() {
@@ -226,14 +231,6 @@ var _ = Describe("MetricAdapter", func() {
 		}).Should(Equal(3))
 	})
 
-	It("returns the adapter even if we fail to list the metric descriptors", func() {
-		expectedErr := errors.New("fail")
-		client.ListErr = expectedErr
-		subj, err := NewMetricAdapter("my-awesome-project", client, 1, logger)
-		Expect(subj).To(Not(BeNil()))
-		Expect(err).To(Equal(expectedErr))
-	})
-
 	It("increments metrics counters", func() {
 		metrics := []*messages.Metric{
 			{
@@ -256,4 +253,136 @@ var _ = Describe("MetricAdapter", func() {
 		subject.PostMetrics(metrics)
 		Expect(timeSeriesCount.IntValue()).To(Equal(6))
 	})
+
+	It("logs only the rejected time series of a request", func() {
+		client.PostFn = func(req *monitoringpb.CreateTimeSeriesRequest) error {
+			return TimeSeriesErrors{{Index: 1, Reason: "Unrecognized metric label."}}
+		}
+
+		subject.PostMetrics([]*messages.Metric{{Name: "good"}, {Name: "bad"}})
+
+		var errs []mocks.Log
+		for _, log := range logger.Logs() {
+			if log.Level == lager.ERROR {
+				errs = append(errs, log)
+			}
+		}
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].Err).To(MatchError("Unrecognized metric label."))
+		Expect(errs[0].Datas[0]["timeSeries"].(*monitoringpb.TimeSeries).Metric.Type).To(Equal("custom.googleapis.com/bad"))
+	})
+
+	Context("with requests in flight", func() {
+		var (
+			mu       sync.Mutex
+			inFlight int
+			peak     int
+			posted   []*monitoringpb.TimeSeries
+		)
+
+		BeforeEach(func() {
+			inFlight, peak, posted = 0, 0, nil
+			client.PostFn = func(req *monitoringpb.CreateTimeSeriesRequest) error {
+				mu.Lock()
+				inFlight++
+				if inFlight > peak {
+					peak = inFlight
+				}
+				mu.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				mu.Lock()
+				inFlight--
+				posted = append(posted, req.TimeSeries...)
+				mu.Unlock()
+				return nil
+			}
+			subject = NewMetricAdapter("my-awesome-project", client, NewDescriptorManager("my-awesome-project", client, DescriptorPolicyReport, logger), 10, 3, 0, 0, logger)
+		})
+
+		It("posts concurrently, up to the limit", func() {
+			var metrics []*messages.Metric
+			for i := 0; i < 100; i++ {
+				metrics = append(metrics, &messages.Metric{Name: "gauge", Labels: map[string]string{"index": strconv.Itoa(i)}})
+			}
+			subject.PostMetrics(metrics)
+
+			Expect(posted).To(HaveLen(100))
+			Expect(peak).To(Equal(3))
+		})
+
+		It("writes the points of a time series in order", func() {
+			eventTime := time.Now()
+			var metrics []*messages.Metric
+			for _, offset := range []time.Duration{0, time.Second} {
+				for i := 0; i < 50; i++ {
+					metrics = append(metrics, &messages.Metric{Name: "gauge", Labels: map[string]string{"index": strconv.Itoa(i)}, EventTime: eventTime.Add(offset)})
+				}
+			}
+			subject.PostMetrics(metrics)
+
+			Expect(posted).To(HaveLen(100))
+			last := map[string]int64{}
+			for _, series := range posted {
+				index := series.Metric.Labels["index"]
+				seconds := series.Points[0].Interval.EndTime.Seconds
+				Expect(seconds).To(BeNumerically(">", last[index]), "series %s", index)
+				last[index] = seconds
+			}
+		})
+
+		It("reports how long posting took", func() {
+			count := postMetricsCount.IntValue()
+			subject.PostMetrics([]*messages.Metric{{Name: "gauge"}})
+
+			Expect(postMetricsCount.IntValue()).To(BeNumerically(">", count))
+			Expect(postMetricsLastDuration.IntValue()).To(BeNumerically(">=", 10))
+		})
+	})
+
+	Context("WriteMetrics", func() {
+		var writer MetricWriter
+
+		BeforeEach(func() {
+			writer = subject.(MetricWriter)
+		})
+
+		It("returns transient errors", func() {
+			unavailable := status.Error(codes.Unavailable, "The service is currently unavailable.")
+			client.PostFn = func(req *monitoringpb.CreateTimeSeriesRequest) error {
+				return unavailable
+			}
+
+			Expect(writer.WriteMetrics([]*messages.Metric{{Name: "a"}})).To(Equal(unavailable))
+		})
+
+		It("returns transient errors creating metric descriptors", func() {
+			client.CreateMetricDescriptorFn = func(req *monitoringpb.CreateMetricDescriptorRequest) error {
+				return status.Error(codes.ResourceExhausted, "Quota exceeded.")
+			}
+
+			err := writer.WriteMetrics([]*messages.Metric{{Name: "a", Unit: "ms"}, {Name: "b"}})
+			Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+			Expect(client.TimeSeries).To(HaveLen(1))
+		})
+
+		It("drops metrics rejected for other reasons", func() {
+			client.PostFn = func(req *monitoringpb.CreateTimeSeriesRequest) error {
+				return status.Error(codes.PermissionDenied, "Permission denied.")
+			}
+
+			Expect(writer.WriteMetrics([]*messages.Metric{{Name: "a"}})).To(Succeed())
+		})
+	})
 })
+
+var _ = DescribeTable("IsRetryable", func(err error, retryable bool) {
+	Expect(IsRetryable(err)).To(Equal(retryable))
+},
+	Entry("unavailable", status.Error(codes.Unavailable, "unavailable"), true),
+	Entry("out of quota", status.Error(codes.ResourceExhausted, "quota"), true),
+	Entry("invalid", status.Error(codes.InvalidArgument, "invalid"), false),
+	Entry("logging flush errors", errors.New("saw 2 errors; last: rpc error: code = Unavailable desc = unavailable"), true),
+	Entry("other errors", errors.New("boom"), false),
+)
@@ -18,15 +18,22 @@ package stackdriver
 
 import (
 	"context"
+	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/monitoring/apiv3"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
 	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/version"
+	"github.com/googleapis/gax-go"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -36,6 +43,10 @@ var (
 	timeSeriesErrOutOfOrder *telemetry.Counter
 	timeSeriesErrUnknown    *telemetry.Counter
 
+	timeSeriesErrsByCode *telemetry.CounterMap
+	timeSeriesRetries    *telemetry.Counter
+	timeSeriesInvalid    *telemetry.Counter
+
 	descriptorReqs *telemetry.Counter
 	descriptorErrs *telemetry.Counter
 )
@@ -47,19 +58,57 @@ func init() {
 	timeSeriesErrOutOfOrder = timeSeriesErrs.MustCounter("out_of_order")
 	timeSeriesErrUnknown = timeSeriesErrs.MustCounter("unknown")
 
+	timeSeriesErrsByCode = telemetry.NewCounterMap(telemetry.Nozzle, "metrics.timeseries.errors_by_code", "code")
+	timeSeriesRetries = telemetry.NewCounter(telemetry.Nozzle, "metrics.timeseries.retries")
+	timeSeriesInvalid = telemetry.NewCounter(telemetry.Nozzle, "metrics.timeseries.invalid")
+
 	descriptorReqs = telemetry.NewCounter(telemetry.Nozzle, "metrics.descriptor.requests")
 	descriptorErrs = telemetry.NewCounter(telemetry.Nozzle, "metrics.descriptor.errors")
 }
 
+// Backoff between CreateTimeSeries attempts; pauses are random up to an
+// envelope growing from the initial to the maximum value.
+const (
+	retryInitialBackoff = 500 * time.Millisecond
+	retryMaxBackoff     = 8 * time.Second
+)
+
+// retryableCodes are the errors after which CreateTimeSeries is tried again.
+var retryableCodes = map[codes.Code]bool{
+	codes.Unavailable:       true,
+	codes.DeadlineExceeded:  true,
+	codes.ResourceExhausted: true,
+}
+
+// IsRetryable reports whether err is a transient Stackdriver error, such as
+// the API being unavailable or out of quota.
+func IsRetryable(err error) bool {
+	if s, ok := status.FromError(err); ok {
+		return retryableCodes[s.Code()]
+	}
+	// The Logging client only reports the text of the last error of a flush.
+	for code := range retryableCodes {
+		if strings.Contains(err.Error(), "code = "+code.String()) {
+			return true
+		}
+	}
+	return false
+}
+
 type MetricClient interface {
 	Post(*monitoringpb.CreateTimeSeriesRequest) error
 	CreateMetricDescriptor(*monitoringpb.CreateMetricDescriptorRequest) error
+	DeleteMetricDescriptor(*monitoringpb.DeleteMetricDescriptorRequest) error
 	ListMetricDescriptors(*monitoringpb.ListMetricDescriptorsRequest) ([]*metricpb.MetricDescriptor, error)
 }
 
-func NewMetricClient() (MetricClient, error) {
+// NewMetricClient creates a MetricClient connecting to endpoint.
+// CreateTimeSeries requests are retried, and abandoned, until retryTimeout has
+// passed since the first attempt; zero disables retries.
+func NewMetricClient(endpoint Endpoint, retryTimeout time.Duration) (MetricClient, error) {
 	ctx := context.Background()
-	sdMetricClient, err := monitoring.NewMetricClient(ctx, option.WithScopes("https://www.googleapis.com/auth/monitoring.write"), option.WithUserAgent(version.UserAgent()))
+	opts := append([]option.ClientOption{option.WithScopes("https://www.googleapis.com/auth/monitoring.write"), option.WithUserAgent(version.UserAgent())}, endpoint.clientOptions()...)
+	sdMetricClient, err := monitoring.NewMetricClient(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -67,28 +116,154 @@ func NewMetricClient() (MetricClient, error) {
 	return &metricClient{
 		sdMetricClient: sdMetricClient,
 		ctx:            ctx,
+		retryTimeout:   retryTimeout,
+		backoff:        gax.Backoff{Initial: retryInitialBackoff, Max: retryMaxBackoff, Multiplier: 2},
 	}, nil
 }
 
 type metricClient struct {
 	sdMetricClient *monitoring.MetricClient
 	ctx            context.Context
+	retryTimeout   time.Duration
+	backoff        gax.Backoff
 }
 
+// Post creates the time series of request, retrying while Stackdriver is
+// unavailable, overloaded or out of quota.
+//
+// Stackdriver writes the valid time series of a request even if others are
+// rejected. Rejections because points are out of order are expected once more
+// than one nozzle writes a time series, and are absorbed; others are returned
+// as TimeSeriesErrors.
 func (m *metricClient) Post(request *monitoringpb.CreateTimeSeriesRequest) error {
-	timeSeriesReqs.Increment()
-	err := m.sdMetricClient.CreateTimeSeries(m.ctx, request)
-	if err != nil {
-		if strings.Contains(err.Error(), `Points must be written in order`) {
-			// This is an expected error once there is more than a single nozzle writing to Stackdriver.
-			// If one nozzle writes a metric occurring at time T2 and this one tries to write at T1 (where T2 later than T1)
-			// we will receive this error.
+	ctx := m.ctx
+	deadline := time.Now().Add(m.retryTimeout)
+	if m.retryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	backoff := m.backoff
+	var lastErr error
+	for {
+		timeSeriesReqs.Increment()
+		err := m.sdMetricClient.CreateTimeSeries(ctx, request)
+		if err == nil {
+			return nil
+		}
+		code := status.Code(err)
+		timeSeriesErrsByCode.MustCounter(code.String()).Increment()
+
+		if !retryableCodes[code] {
+			return classifyPostError(err)
+		}
+		if lastErr != nil && ctx.Err() != nil {
+			// Our own deadline cut the last attempt short; the error
+			// before it says why we were retrying.
+			err = lastErr
+		}
+		lastErr = err
+		pause := backoff.Pause()
+		if ctx.Err() != nil || time.Now().Add(pause).After(deadline) {
+			timeSeriesErrUnknown.Increment()
+			return err
+		}
+		timeSeriesRetries.Increment()
+		time.Sleep(pause)
+	}
+}
+
+// TimeSeriesError is the rejection of a single time series of a request.
+type TimeSeriesError struct {
+	// Index of the time series in the request.
+	Index  int
+	Reason string
+}
+
+// TimeSeriesErrors are returned by MetricClient.Post when Stackdriver rejects
+// some of the time series of a request. The others were written.
+type TimeSeriesErrors []TimeSeriesError
+
+func (errs TimeSeriesErrors) Error() string {
+	var parts []string
+	for _, e := range errs {
+		parts = append(parts, fmt.Sprintf("%s: timeSeries[%d]", e.Reason, e.Index))
+	}
+	return "One or more TimeSeries could not be written: " + strings.Join(parts, "; ")
+}
+
+const outOfOrderReason = "Points must be written in order"
+
+// classifyPostError turns an InvalidArgument error listing the rejected time
+// series into TimeSeriesErrors, without those rejected for being out of order,
+// and counts them. Other errors are returned as is.
+func classifyPostError(err error) error {
+	var failures TimeSeriesErrors
+	if status.Code(err) == codes.InvalidArgument {
+		failures = parseTimeSeriesErrors(status.Convert(err).Message())
+	}
+	if failures == nil {
+		if strings.Contains(err.Error(), outOfOrderReason) {
 			timeSeriesErrOutOfOrder.Increment()
-			return nil // absorb error
+			return nil
 		}
 		timeSeriesErrUnknown.Increment()
+		return err
 	}
-	return err
+
+	var errs TimeSeriesErrors
+	for _, f := range failures {
+		if strings.Contains(f.Reason, outOfOrderReason) {
+			timeSeriesErrOutOfOrder.Increment()
+			continue
+		}
+		timeSeriesInvalid.Increment()
+		errs = append(errs, f)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+var timeSeriesIndices = regexp.MustCompile(`^(.*): timeSeries\[([0-9,\-]+)\]$`)
+
+// parseTimeSeriesErrors parses messages like
+//
+//	One or more TimeSeries could not be written: <reason>: timeSeries[0-2,5]; <reason>: timeSeries[3]
+//
+// returning nil if the message is not of that form.
+func parseTimeSeriesErrors(message string) TimeSeriesErrors {
+	const prefix = "One or more TimeSeries could not be written: "
+	if !strings.HasPrefix(message, prefix) {
+		return nil
+	}
+
+	var errs TimeSeriesErrors
+	for _, part := range strings.Split(strings.TrimPrefix(message, prefix), "; ") {
+		m := timeSeriesIndices.FindStringSubmatch(part)
+		if m == nil {
+			return nil
+		}
+		for _, r := range strings.Split(m[2], ",") {
+			bounds := strings.SplitN(r, "-", 2)
+			low, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil
+			}
+			high := low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil || high < low {
+					return nil
+				}
+			}
+			for i := low; i <= high; i++ {
+				errs = append(errs, TimeSeriesError{Index: i, Reason: m[1]})
+			}
+		}
+	}
+	return errs
 }
 
 func (m *metricClient) CreateMetricDescriptor(request *monitoringpb.CreateMetricDescriptorRequest) error {
@@ -100,6 +275,15 @@ func (m *metricClient) CreateMetricDescriptor(request *monitoringpb.CreateMetric
 	return err
 }
 
+func (m *metricClient) DeleteMetricDescriptor(request *monitoringpb.DeleteMetricDescriptorRequest) error {
+	descriptorReqs.Increment()
+	err := m.sdMetricClient.DeleteMetricDescriptor(m.ctx, request)
+	if err != nil {
+		descriptorErrs.Increment()
+	}
+	return err
+}
+
 func (m *metricClient) ListMetricDescriptors(request *monitoringpb.ListMetricDescriptorsRequest) ([]*metricpb.MetricDescriptor, error) {
 	it := m.sdMetricClient.ListMetricDescriptors(m.ctx, request)
 
@@ -115,6 +115,11 @@ func (ts *telemetrySink) Init(registeredSeries []*expvar.KeyValue) {
 			}
 		}
 
+		kind := metric.MetricDescriptor_CUMULATIVE
+		if _, ok := series.Value.(*telemetry.Gauge); ok {
+			kind = metric.MetricDescriptor_GAUGE
+		}
+
 		req := &monitoring.CreateMetricDescriptorRequest{
 			Name: ts.projectPath,
 			MetricDescriptor: &metric.MetricDescriptor{
@@ -122,7 +127,7 @@ func (ts *telemetrySink) Init(registeredSeries []*expvar.KeyValue) {
 				Name:        name,
 				Type:        ts.metricDescriptorType(series.Key),
 				Labels:      labels,
-				MetricKind:  metric.MetricDescriptor_CUMULATIVE,
+				MetricKind:  kind,
 				ValueType:   metric.MetricDescriptor_INT64,
 				Description: "stackdriver-nozzle created custom metric.",
 			},
@@ -179,6 +184,10 @@ func (ts *telemetrySink) timeSeries(metricType string, interval *monitoring.Time
 	switch data := val.Value.(type) {
 	case *telemetry.Counter:
 		return []*monitoring.TimeSeries{ts.timeSeriesInt(metricType, interval, ts.labels, data.Value())}
+	case *telemetry.Gauge:
+		series := ts.timeSeriesInt(metricType, &monitoring.TimeInterval{EndTime: interval.EndTime}, ts.labels, data.Value())
+		series.MetricKind = metric.MetricDescriptor_GAUGE
+		return []*monitoring.TimeSeries{series}
 	case *telemetry.CounterMap:
 		var series []*monitoring.TimeSeries
 		data.Do(func(value expvar.KeyValue) {
@@ -117,6 +117,31 @@ var _ = Describe("TelemetrySink", func() {
 		})
 	})
 
+	Context("with a Gauge", func() {
+		value := &telemetry.Gauge{}
+		keyValue := &expvar.KeyValue{Key: "depth", Value: value}
+		BeforeEach(func() {
+			value.Set(7)
+		})
+
+		It("Init creates a gauge MetricDescriptor", func() {
+			sink.Init([]*expvar.KeyValue{keyValue})
+
+			Expect(client.DescriptorReqs).To(HaveLen(1))
+			Expect(client.DescriptorReqs[0].MetricDescriptor.MetricKind).To(Equal(metricpb.MetricDescriptor_GAUGE))
+		})
+
+		It("Report posts its current value", func() {
+			sink.Report([]*expvar.KeyValue{keyValue})
+
+			Expect(client.MetricReqs).To(HaveLen(1))
+			series := client.MetricReqs[0].TimeSeries[0]
+			Expect(series.MetricKind).To(Equal(metricpb.MetricDescriptor_GAUGE))
+			Expect(series.Points[0].Interval.StartTime).To(BeNil())
+			Expect(series.Points[0].Value.GetInt64Value()).To(Equal(int64(7)))
+		})
+	})
+
 	Context("with many metrics", func() {
 		var values []*expvar.KeyValue
 		BeforeEach(func() {
@@ -0,0 +1,226 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stackdriver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/telemetry"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+var (
+	pointsDeferred *telemetry.Counter
+	pointsMerged   *telemetry.Counter
+	pointsPending  *telemetry.Gauge
+
+	postThrottled *telemetry.Counter
+)
+
+func init() {
+	pointsDeferred = telemetry.NewCounter(telemetry.Nozzle, "metrics.points.deferred")
+	pointsMerged = telemetry.NewCounter(telemetry.Nozzle, "metrics.points.merged")
+	pointsPending = telemetry.NewGauge(telemetry.Nozzle, "metrics.points.pending")
+
+	postThrottled = telemetry.NewCounter(telemetry.Nozzle, "metrics.post.throttled_ms")
+}
+
+// seriesSweepPeriod is how often series that were not written to for
+// minInterval are forgotten.
+const seriesSweepPeriod = time.Minute
+
+// seriesTracker keeps points from being written to a time series less than
+// minInterval after the last one, which Stackdriver rejects. Such points are
+// held back until minInterval has passed, and then written at the earliest
+// time allowed, unless a newer point of the series replaces them first.
+// Cumulative points keep their interval, since the total is only known at
+// the original end time. Points held back are lost if the nozzle stops.
+type seriesTracker struct {
+	minInterval time.Duration
+	now         func() time.Time
+
+	mu sync.Mutex
+	// End time of the last point written to each series, by seriesKey.
+	last    map[string]time.Time
+	pending map[string]*monitoring.TimeSeries
+	swept   time.Time
+}
+
+func newSeriesTracker(minInterval time.Duration) *seriesTracker {
+	return &seriesTracker{
+		minInterval: minInterval,
+		now:         time.Now,
+		last:        map[string]time.Time{},
+		pending:     map[string]*monitoring.TimeSeries{},
+	}
+}
+
+func seriesKey(ts *monitoring.TimeSeries) string {
+	return ts.Metric.Type + "|" + messages.Flatten(ts.Metric.Labels)
+}
+
+// admit returns the points of series, and of those held back before, that can
+// be written now. Only the latest point of each series is kept.
+func (t *seriesTracker) admit(series []*monitoring.TimeSeries) []*monitoring.TimeSeries {
+	if t.minInterval <= 0 {
+		return series
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	latest := map[string]*monitoring.TimeSeries{}
+	var keys []string
+	add := func(ts *monitoring.TimeSeries) {
+		key := seriesKey(ts)
+		prev, ok := latest[key]
+		if !ok {
+			keys = append(keys, key)
+			latest[key] = ts
+			return
+		}
+		pointsMerged.Increment()
+		if !endTime(ts).Before(endTime(prev)) {
+			latest[key] = ts
+		}
+	}
+	for _, ts := range t.pending {
+		add(ts)
+	}
+	for _, ts := range series {
+		add(ts)
+	}
+
+	now := t.now()
+	pending := map[string]*monitoring.TimeSeries{}
+	var admitted []*monitoring.TimeSeries
+	for _, key := range keys {
+		ts := latest[key]
+		last, ok := t.last[key]
+		end := endTime(ts)
+		earliest := last.Add(t.minInterval)
+		// Points not after the last one are left for Stackdriver to reject.
+		if !ok || !end.After(last) || !end.Before(earliest) {
+			admitted = append(admitted, ts)
+			continue
+		}
+		if now.Before(earliest) {
+			if t.pending[key] != ts {
+				pointsDeferred.Increment()
+			}
+			pending[key] = ts
+			continue
+		}
+		if ts.MetricKind == metricpb.MetricDescriptor_CUMULATIVE {
+			admitted = append(admitted, ts)
+			continue
+		}
+		admitted = append(admitted, withEndTime(ts, earliest))
+	}
+	t.pending = pending
+	pointsPending.Set(int64(len(pending)))
+	return admitted
+}
+
+// written records points Stackdriver accepted.
+func (t *seriesTracker) written(series []*monitoring.TimeSeries) {
+	if t.minInterval <= 0 || len(series) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, ts := range series {
+		key := seriesKey(ts)
+		if end := endTime(ts); end.After(t.last[key]) {
+			t.last[key] = end
+		}
+	}
+
+	now := t.now()
+	if now.Sub(t.swept) < seriesSweepPeriod {
+		return
+	}
+	for key, last := range t.last {
+		if now.Sub(last) > t.minInterval {
+			delete(t.last, key)
+		}
+	}
+	t.swept = now
+}
+
+func endTime(ts *monitoring.TimeSeries) time.Time {
+	end := ts.Points[0].Interval.EndTime
+	return time.Unix(end.Seconds, int64(end.Nanos))
+}
+
+// withEndTime returns a copy of ts with its point ending at end, and starting
+// there too if it is a gauge point starting where it ended.
+func withEndTime(ts *monitoring.TimeSeries, end time.Time) *monitoring.TimeSeries {
+	ts = proto.Clone(ts).(*monitoring.TimeSeries)
+	interval := ts.Points[0].Interval
+	moveStart := interval.StartTime != nil && proto.Equal(interval.StartTime, interval.EndTime)
+	interval.EndTime = &timestamp.Timestamp{Seconds: end.Unix(), Nanos: int32(end.Nanosecond())}
+	if moveStart {
+		interval.StartTime = interval.EndTime
+	}
+	return ts
+}
+
+// requestLimiter spaces requests evenly, to stay within a rate.
+type requestLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// newRequestLimiter returns a limiter of perSecond requests a second, or nil,
+// which never waits, if perSecond is not positive.
+func newRequestLimiter(perSecond int) *requestLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &requestLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+// wait blocks until the next request may be made.
+func (l *requestLimiter) wait() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	if d := at.Sub(now); d > 0 {
+		postThrottled.Add(int64(d / time.Millisecond))
+		time.Sleep(d)
+	}
+}
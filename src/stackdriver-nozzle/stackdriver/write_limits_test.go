@@ -0,0 +1,193 @@
+/*
+ * Copyright 2019 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stackdriver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/messages"
+	"github.com/cloudfoundry-community/stackdriver-tools/src/stackdriver-nozzle/mocks"
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+var _ = Describe("seriesTracker", func() {
+	var (
+		subject *seriesTracker
+		now     time.Time
+	)
+
+	base := time.Unix(1546300800, 0)
+	point := func(name string, value float64, at time.Duration) *monitoringpb.TimeSeries {
+		return (&messages.Metric{Name: name, Value: value, EventTime: base.Add(at), StartTime: base.Add(at)}).TimeSeries()
+	}
+
+	BeforeEach(func() {
+		pointsDeferred.Set(0)
+		pointsMerged.Set(0)
+		now = base
+		subject = newSeriesTracker(5 * time.Second)
+		subject.now = func() time.Time { return now }
+	})
+
+	It("admits points of new series, and points far enough apart", func() {
+		first := []*monitoringpb.TimeSeries{point("a", 1, 0), point("b", 1, 0)}
+		Expect(subject.admit(first)).To(Equal(first))
+		subject.written(first)
+
+		now = base.Add(10 * time.Second)
+		next := []*monitoringpb.TimeSeries{point("a", 2, 5*time.Second)}
+		Expect(subject.admit(next)).To(Equal(next))
+	})
+
+	It("merges points of a series in the same write, keeping the latest", func() {
+		admitted := subject.admit([]*monitoringpb.TimeSeries{point("a", 2, time.Second), point("a", 1, 0)})
+
+		Expect(admitted).To(HaveLen(1))
+		Expect(admitted[0].Points[0].Value.GetDoubleValue()).To(Equal(2.0))
+		Expect(pointsMerged.IntValue()).To(Equal(1))
+	})
+
+	It("holds back points written too soon, then writes them at the earliest time allowed", func() {
+		subject.written([]*monitoringpb.TimeSeries{point("a", 1, 0)})
+
+		now = base.Add(2 * time.Second)
+		Expect(subject.admit([]*monitoringpb.TimeSeries{point("a", 2, 2*time.Second)})).To(BeEmpty())
+		Expect(pointsDeferred.IntValue()).To(Equal(1))
+		Expect(pointsPending.IntValue()).To(Equal(1))
+
+		now = base.Add(3 * time.Second)
+		Expect(subject.admit(nil)).To(BeEmpty())
+		Expect(pointsDeferred.IntValue()).To(Equal(1))
+
+		now = base.Add(6 * time.Second)
+		admitted := subject.admit(nil)
+		Expect(admitted).To(HaveLen(1))
+		Expect(admitted[0].Points[0].Value.GetDoubleValue()).To(Equal(2.0))
+		Expect(endTime(admitted[0])).To(Equal(base.Add(5 * time.Second)))
+		Expect(admitted[0].Points[0].Interval.StartTime).To(Equal(admitted[0].Points[0].Interval.EndTime))
+		Expect(pointsPending.IntValue()).To(Equal(0))
+	})
+
+	It("writes cumulative points held back with their own interval", func() {
+		cumulative := func(value int64, at time.Duration) *monitoringpb.TimeSeries {
+			return (&messages.Metric{Name: "c", IntValue: value, Type: events.Envelope_CounterEvent, StartTime: base, EventTime: base.Add(at)}).TimeSeries()
+		}
+		subject.written([]*monitoringpb.TimeSeries{cumulative(1, time.Second)})
+
+		now = base.Add(2 * time.Second)
+		Expect(subject.admit([]*monitoringpb.TimeSeries{cumulative(2, 2*time.Second)})).To(BeEmpty())
+
+		now = base.Add(6 * time.Second)
+		admitted := subject.admit(nil)
+		Expect(admitted).To(HaveLen(1))
+		Expect(admitted[0].Points[0].Value.GetInt64Value()).To(Equal(int64(2)))
+		Expect(endTime(admitted[0])).To(Equal(base.Add(2 * time.Second)))
+		Expect(admitted[0].Points[0].Interval.StartTime.Seconds).To(Equal(base.Unix()))
+	})
+
+	It("replaces points held back with newer ones", func() {
+		subject.written([]*monitoringpb.TimeSeries{point("a", 1, 0)})
+
+		now = base.Add(2 * time.Second)
+		subject.admit([]*monitoringpb.TimeSeries{point("a", 2, 2*time.Second)})
+		now = base.Add(7 * time.Second)
+		admitted := subject.admit([]*monitoringpb.TimeSeries{point("a", 3, 7*time.Second)})
+
+		Expect(admitted).To(HaveLen(1))
+		Expect(admitted[0].Points[0].Value.GetDoubleValue()).To(Equal(3.0))
+		Expect(endTime(admitted[0])).To(Equal(base.Add(7 * time.Second)))
+		Expect(pointsMerged.IntValue()).To(Equal(1))
+	})
+
+	It("only counts points that were written", func() {
+		now = base.Add(2 * time.Second)
+		Expect(subject.admit([]*monitoringpb.TimeSeries{point("a", 1, 0)})).To(HaveLen(1))
+		// Not written, e.g. because Stackdriver was unavailable.
+		Expect(subject.admit([]*monitoringpb.TimeSeries{point("a", 2, 2*time.Second)})).To(HaveLen(1))
+	})
+
+	It("forgets series not written to for a while", func() {
+		subject.written([]*monitoringpb.TimeSeries{point("a", 1, 0)})
+		now = base.Add(2 * seriesSweepPeriod)
+		subject.written([]*monitoringpb.TimeSeries{point("b", 1, 2*seriesSweepPeriod)})
+
+		Expect(subject.last).To(HaveLen(1))
+	})
+
+	It("does nothing without a minimum interval", func() {
+		subject = newSeriesTracker(0)
+		series := []*monitoringpb.TimeSeries{point("a", 1, 0), point("a", 2, 0)}
+		Expect(subject.admit(series)).To(Equal(series))
+	})
+})
+
+var _ = Describe("requestLimiter", func() {
+	It("spaces requests evenly", func() {
+		subject := newRequestLimiter(100)
+		start := time.Now()
+		for i := 0; i < 11; i++ {
+			subject.wait()
+		}
+		Expect(time.Since(start)).To(BeNumerically(">=", 100*time.Millisecond))
+	})
+
+	It("never waits without a limit", func() {
+		subject := newRequestLimiter(0)
+		Expect(subject).To(BeNil())
+		subject.wait()
+	})
+})
+
+var _ = Describe("MetricAdapter with write limits", func() {
+	It("holds back points of a series written too soon", func() {
+		client := &mocks.MockClient{}
+		logger := &mocks.MockLogger{}
+		descriptors := NewDescriptorManager("my-awesome-project", client, DescriptorPolicyReport, logger)
+		subject := NewMetricAdapter("my-awesome-project", client, descriptors, batchSize, 1, time.Minute, 0, logger)
+
+		eventTime := time.Now()
+		subject.PostMetrics([]*messages.Metric{{Name: "gauge", Value: 1, EventTime: eventTime}})
+		subject.PostMetrics([]*messages.Metric{{Name: "gauge", Value: 2, EventTime: eventTime.Add(time.Second)}})
+
+		Expect(client.TimeSeries).To(HaveLen(1))
+		Expect(client.TimeSeries[0].Points[0].Value.GetDoubleValue()).To(Equal(1.0))
+	})
+
+	It("limits requests a second", func() {
+		var mu sync.Mutex
+		var times []time.Time
+		client := &mocks.MockClient{}
+		client.PostFn = func(req *monitoringpb.CreateTimeSeriesRequest) error {
+			mu.Lock()
+			defer mu.Unlock()
+			times = append(times, time.Now())
+			return nil
+		}
+		logger := &mocks.MockLogger{}
+		descriptors := NewDescriptorManager("my-awesome-project", client, DescriptorPolicyReport, logger)
+		subject := NewMetricAdapter("my-awesome-project", client, descriptors, 1, 4, 0, 20, logger)
+
+		subject.PostMetrics([]*messages.Metric{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}})
+
+		Expect(times).To(HaveLen(4))
+		Expect(times[3].Sub(times[0])).To(BeNumerically(">=", 140*time.Millisecond))
+	})
+})
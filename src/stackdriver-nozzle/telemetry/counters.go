@@ -46,6 +46,18 @@ func (c *Counter) IntValue() int {
 	return int(c.Value())
 }
 
+// A Gauge is an integer expvar that can go up and down, such as the length of
+// a queue. It is reported as its current value rather than as a cumulative
+// count.
+type Gauge struct {
+	expvar.Int
+}
+
+// IntValue returns the gauge's value as an int rather than an int64.
+func (g *Gauge) IntValue() int {
+	return int(g.Value())
+}
+
 // A CounterMap is used to export a set of related Counters which have the
 // same label keys.
 type CounterMap struct {
@@ -123,6 +135,13 @@ func NewCounter(mp MetricPrefix, name string) *Counter {
 	return v
 }
 
+// NewGauge creates and exports a new Gauge for the MetricPrefix.
+func NewGauge(mp MetricPrefix, name string) *Gauge {
+	v := new(Gauge)
+	publish(mp, name, v)
+	return v
+}
+
 // NewCounterMap creates and exports a new CounterMap for the MetricPrefix.
 func NewCounterMap(mp MetricPrefix, name string, labelKeys ...string) *CounterMap {
 	v := &CounterMap{LabelKeys: labelKeys}
@@ -41,6 +41,7 @@ func (ls *logSink) Init([]*expvar.KeyValue) {
 func (ls *logSink) Report(values []*expvar.KeyValue) {
 	report := map[string]int64{}
 	reportDelta := map[string]int64{}
+	gauges := map[string]int64{}
 
 	record := func(name string, val *Counter) {
 		report[name] = val.Value()
@@ -51,6 +52,8 @@ func (ls *logSink) Report(values []*expvar.KeyValue) {
 		switch data := val.Value.(type) {
 		case *Counter:
 			record(val.Key, data)
+		case *Gauge:
+			gauges[val.Key] = data.Value()
 		case *CounterMap:
 			data.Do(func(mapVal expvar.KeyValue) {
 				if counterVal, ok := mapVal.Value.(*Counter); ok {
@@ -64,5 +67,5 @@ func (ls *logSink) Report(values []*expvar.KeyValue) {
 	}
 
 	ls.lastReport = report
-	ls.logger.Info("heartbeater", lager.Data{"counters.cumulative": report, "counters.delta": reportDelta})
+	ls.logger.Info("heartbeater", lager.Data{"counters.cumulative": report, "counters.delta": reportDelta, "gauges": gauges})
 }
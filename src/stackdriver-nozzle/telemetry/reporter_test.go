@@ -58,18 +58,22 @@ var _ = Describe("Reporter", func() {
 
 		It("initializes the sink on start", func() {
 			Expect(sink.GetInit()).NotTo(BeNil())
+			// Telemetry registered by the packages the test imports is there too.
 			init := sink.GetInit()
-			Expect(init).To(HaveLen(1))
 			Expect(init).To(ContainElement(&expvar.KeyValue{Key: telemetry.Nozzle.Qualify("int"), Value: intCount}))
 		})
 
 		It("reports updates", func() {
 			intCount.Set(100)
 			Eventually(sink.GetLastReport).Should(Not(BeNil()))
-			report := sink.GetLastReport()
-			Expect(report).To(HaveLen(1))
-			initCountKeyVal := report[0]
-			Expect(initCountKeyVal.Value.(*telemetry.Counter).Value()).To(Equal(int64(100)))
+			var reported expvar.Var
+			for _, kv := range sink.GetLastReport() {
+				if kv.Key == telemetry.Nozzle.Qualify("int") {
+					reported = kv.Value
+				}
+			}
+			Expect(reported).NotTo(BeNil())
+			Expect(reported.(*telemetry.Counter).Value()).To(Equal(int64(100)))
 		})
 	})
 	Context("with an existing expvar metric", func() {